@@ -1,14 +1,26 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
+	"bws-cache/internal/pkg/audit"
+	"bws-cache/internal/pkg/auth"
 	c "bws-cache/internal/pkg/config"
+	"bws-cache/internal/pkg/doctor"
 	h "bws-cache/internal/pkg/http"
+	"bws-cache/internal/pkg/logging"
+	"bws-cache/internal/pkg/redact"
+	"bws-cache/internal/pkg/secmem"
+	"bws-cache/internal/pkg/trace"
 
 	"github.com/spf13/cobra"
 )
@@ -24,7 +36,7 @@ var startCmd = &cobra.Command{
 	Short: "Starts bws-cache",
 	Long:  "Starts bws-cache",
 	Run: func(cmd *cobra.Command, args []string) {
-		start()
+		os.Exit(start(cmd))
 	},
 }
 
@@ -37,16 +49,68 @@ var versionCmd = &cobra.Command{
 	},
 }
 
-var loggingLevel = new(slog.LevelVar)
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Diagnose a bws-cache deployment",
+	Long:  "Checks the configuration, connectivity to bitwarden and what the access token can see, then prints a pass/fail report",
+	Run: func(cmd *cobra.Command, args []string) {
+		os.Exit(runDoctor(cmd))
+	},
+}
+
+var apiKeyCmd = &cobra.Command{
+	Use:   "apikey",
+	Short: "Generate a local API key",
+	Long:  "Generates a random local API key along with the key_sha256 to register it under api_keys in the config file",
+	Run: func(cmd *cobra.Command, args []string) {
+		os.Exit(generateAPIKey())
+	},
+}
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Work with audit logs",
+}
+
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify FILE...",
+	Short: "Verify the hash chain of audit log files",
+	Long:  "Verifies the hash chain of hash chained audit log files, given oldest first, and reports the first entry that has been altered, removed or reordered",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		os.Exit(verifyAudit(args))
+	},
+}
+
+var debugTokenCmd = &cobra.Command{
+	Use:   "debug-token",
+	Short: "Generate a token to debug log a request",
+	Long:  "Generates a token, signed with debug_key, to send in the X-BWS-Debug header to log a single request at every level",
+	Run: func(cmd *cobra.Command, args []string) {
+		os.Exit(generateDebugToken(cmd))
+	},
+}
 
 func init() {
+	c.Flags(startCmd.Flags())
+	c.Flags(doctorCmd.Flags())
+	doctorCmd.Flags().String("token-env", "BWS_ACCESS_TOKEN", "environment variable holding the access token")
+	doctorCmd.Flags().Bool("token-stdin", false, "read the access token from stdin")
+	doctorCmd.Flags().StringP("output", "o", "text", "output format (text, json)")
 	rootCmd.AddCommand(startCmd)
 	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(doctorCmd)
+	rootCmd.AddCommand(apiKeyCmd)
+	c.Flags(debugTokenCmd.Flags())
+	debugTokenCmd.Flags().Duration("ttl", 15*time.Minute, "how long the token is valid for")
+	rootCmd.AddCommand(debugTokenCmd)
+	auditCmd.AddCommand(auditVerifyCmd)
+	rootCmd.AddCommand(auditCmd)
 }
 
 func main() {
 	if err := rootCmd.Execute(); err != nil {
-		slog.Error("%v", err)
+		slog.Error(err.Error())
 		os.Exit(1)
 	}
 }
@@ -55,38 +119,206 @@ func version() {
 	fmt.Println(c.Version)
 }
 
-func start() {
+func generateAPIKey() int {
+	key, err := auth.GenerateKey()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to generate key: %v\n", err)
+		return 1
+	}
+	fmt.Printf("key:        %s\n", key)
+	fmt.Printf("key_sha256: %s\n", auth.HashKey(key))
+	return 0
+}
+
+func generateDebugToken(cmd *cobra.Command) int {
 	config := &c.Config{}
-	c.LoadConfig(config)
+	if err := c.LoadConfig(config, cmd.Flags()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if config.DebugKey == "" {
+		fmt.Fprintln(os.Stderr, "debug_key is not set")
+		return 1
+	}
+	ttl, _ := cmd.Flags().GetDuration("ttl")
+	fmt.Println(logging.DebugToken(config.DebugKey, time.Now().Add(ttl)))
+	return 0
+}
+
+func verifyAudit(files []string) int {
+	prev := ""
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to open audit log: %v\n", err)
+			return 1
+		}
+		count, last, err := audit.Verify(f, prev)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+			return 1
+		}
+		fmt.Printf("%s: %d entries verified\n", file, count)
+		prev = last
+	}
+	return 0
+}
 
-	logger := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: loggingLevel})
-	slog.SetDefault(slog.New(logger))
-	loggingLevel.Set(getLoggerLevel(config.LogLevel))
+func runDoctor(cmd *cobra.Command) int {
+	logging.SetBase(slog.LevelError)
+	slog.SetDefault(slog.New(newLogHandler(os.Stderr, "text")))
+
+	tokenEnv, _ := cmd.Flags().GetString("token-env")
+	tokenStdin, _ := cmd.Flags().GetBool("token-stdin")
+	output, _ := cmd.Flags().GetString("output")
+
+	token := os.Getenv(tokenEnv)
+	if tokenStdin {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			slog.Error(fmt.Sprintf("Unable to read token from stdin: %v", err))
+			return 1
+		}
+		token = strings.TrimSpace(line)
+	}
+	redact.Add(token)
+
+	config := &c.Config{}
+	configErr := c.LoadConfig(config, cmd.Flags())
+	report := doctor.Run(config, configErr, token)
+
+	switch output {
+	case "json":
+		report.WriteJSON(os.Stdout)
+	default:
+		report.WriteText(os.Stdout)
+	}
+	if !report.Passed {
+		return 1
+	}
+	return 0
+}
+
+func start(cmd *cobra.Command) int {
+	slog.SetDefault(slog.New(newLogHandler(os.Stdout, "json")))
+
+	config := &c.Config{}
+	if err := c.LoadConfig(config, cmd.Flags()); err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	logging.SetBase(getLoggerLevel(config.LogLevel))
+	slog.SetDefault(slog.New(newLogHandler(os.Stdout, config.LogFormat)))
+	redact.SetPatterns(config.LogRedactPatterns)
+	redact.Add(config.DebugKey)
 	slog.Info("Starting")
+	if err := secmem.DisableCoreDumps(); err != nil {
+		slog.Warn(fmt.Sprintf("Unable to disable core dumps: %v", err))
+	}
 
-	if config.OrgID == "" {
-		slog.Error("Org ID must be specified")
-		os.Exit(1)
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigCh)
+
+	reloadCh := make(chan struct{}, 1)
+	err := c.Watch(cmd.Flags(), func() {
+		select {
+		case reloadCh <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
 	}
 
+	for _, value := range config.Tracing.Headers {
+		redact.Add(value)
+	}
+	tracer, err := trace.New(trace.Config(config.Tracing), c.Version)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	trace.SetDefault(tracer)
+
 	ctx, cancelF := context.WithCancel(context.Background())
 	defer cancelF()
 
-	httpErrCh, server := h.Start(ctx, config)
+	httpErrCh, server, err := h.Start(ctx, config)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
 
-	errCh := make(chan error)
-	select {
-	case err := <-httpErrCh:
+	exitCode := 0
+	running := true
+	for running {
 		select {
-		case errCh <- err:
-		case <-ctx.Done():
+		case err := <-httpErrCh:
+			slog.Error(fmt.Sprintf("Server failed: %v", err))
+			exitCode = 1
+			running = false
+		case <-reloadCh:
+			slog.Info("Config file changed, reloading configuration")
+			config = reload(cmd, config, server)
+		case sig := <-sigCh:
+			if sig == syscall.SIGHUP {
+				slog.Info("Received SIGHUP, reloading configuration")
+				config = reload(cmd, config, server)
+				continue
+			}
+			slog.Info(fmt.Sprintf("Received %s, shutting down", sig))
+			running = false
 		}
-	case <-ctx.Done():
 	}
 
-	if err := server.Shutdown(ctx); err != nil {
-		slog.Error("Failed to shutdown properly: %v", err)
+	shutdownCtx, shutdownCancelF := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer shutdownCancelF()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error(fmt.Sprintf("Failed to shutdown properly: %v", err))
+		exitCode = 1
+	}
+	if err := tracer.Shutdown(shutdownCtx); err != nil {
+		slog.Error(fmt.Sprintf("Unable to export traces: %v", err))
+	}
+	slog.Info("Stopped")
+	return exitCode
+}
+
+// reload re-reads the configuration and applies the settings that can be
+// changed on a running server. It returns the configuration now in effect.
+func reload(cmd *cobra.Command, current *c.Config, server *h.Server) *c.Config {
+	next := &c.Config{}
+	if err := c.LoadConfig(next, cmd.Flags()); err != nil {
+		slog.Error(fmt.Sprintf("Keeping current configuration: %v", err))
+		return current
+	}
+
+	config, applied, restart := current.Reload(next)
+	logging.SetBase(getLoggerLevel(config.LogLevel))
+	redact.SetPatterns(config.LogRedactPatterns)
+	redact.Add(config.DebugKey)
+	server.Reload(config)
+
+	if len(applied) > 0 {
+		slog.Info(fmt.Sprintf("Applied settings: %s", strings.Join(applied, ", ")))
+	}
+	if len(restart) > 0 {
+		slog.Warn(fmt.Sprintf("Settings require a restart to take effect: %s", strings.Join(restart, ", ")))
+	}
+	return config
+}
+
+// newLogHandler returns a handler in format at the levels set with the
+// logging package that masks tokens and secret values.
+func newLogHandler(w io.Writer, format string) slog.Handler {
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	if format == "text" {
+		return logging.NewHandler(redact.NewHandler(slog.NewTextHandler(w, options)))
 	}
+	return logging.NewHandler(redact.NewHandler(slog.NewJSONHandler(w, options)))
 }
 
 func getLoggerLevel(config string) slog.Level {
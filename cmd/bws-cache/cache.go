@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"bws-cache/internal/pkg/api"
+
+	"github.com/spf13/cobra"
+)
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Inspect and flush the cache of a running server",
+	Long:  "Inspects and flushes the cache of a running bws-cache through its admin API, without revealing secret values",
+}
+
+var cacheStatsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show the number of cached entries and their memory use",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		os.Exit(cacheStats(cmd))
+	},
+}
+
+var cacheListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the keymap, or the cached secrets with --secrets",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		os.Exit(cacheList(cmd))
+	},
+}
+
+var cacheFlushCmd = &cobra.Command{
+	Use:   "flush",
+	Short: "Flush the cache, or a single secret with --id or --key",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		os.Exit(cacheFlush(cmd))
+	},
+}
+
+func init() {
+	flags := cacheCmd.PersistentFlags()
+	flags.String("url", "http://localhost:8080", "URL of the bws-cache server")
+	flags.String("socket", "", "unix socket of the bws-cache server, instead of --url")
+	flags.String("token", "", "admin key to authenticate with, defaults to $BWS_CACHE_ADMIN_KEY")
+	flags.String("profile", "", "only the cache of this upstream profile")
+	flags.StringP("output", "o", "text", "output format (text, json)")
+	cacheListCmd.Flags().Bool("secrets", false, "list cached secrets instead of the keymap")
+	cacheFlushCmd.Flags().String("id", "", "flush only the secret with this ID")
+	cacheFlushCmd.Flags().String("key", "", "flush only the secret with this key")
+	cacheCmd.AddCommand(cacheStatsCmd)
+	cacheCmd.AddCommand(cacheListCmd)
+	cacheCmd.AddCommand(cacheFlushCmd)
+	rootCmd.AddCommand(cacheCmd)
+}
+
+// adminKeyEnv holds the admin key when --token isn't given, which keeps it
+// out of the process list.
+const adminKeyEnv = "BWS_CACHE_ADMIN_KEY"
+
+// adminRequest calls the admin API at path, decoding the response into
+// result.
+func adminRequest(cmd *cobra.Command, method string, path string, query url.Values, result any) error {
+	base, _ := cmd.Flags().GetString("url")
+	socket, _ := cmd.Flags().GetString("socket")
+	token, _ := cmd.Flags().GetString("token")
+	if token == "" {
+		token = os.Getenv(adminKeyEnv)
+	}
+	if profile, _ := cmd.Flags().GetString("profile"); profile != "" {
+		query.Set("profile", profile)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	if socket != "" {
+		base = "http://bws-cache"
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		}
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(base, "/")+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// printJSON writes result to stdout if json output was asked for,
+// reporting whether it did.
+func printJSON(cmd *cobra.Command, result any) bool {
+	if output, _ := cmd.Flags().GetString("output"); output != "json" {
+		return false
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(result)
+	return true
+}
+
+func cacheStats(cmd *cobra.Command) int {
+	var report api.CacheReport
+	if err := adminRequest(cmd, http.MethodGet, "/admin/cache", url.Values{}, &report); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to get cache stats: %v\n", err)
+		return 1
+	}
+	if printJSON(cmd, report) {
+		return 0
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROFILE\tORG\tKEYS\tSECRETS\tPROJECTS\tNEGATIVE\tHITS\tMEMORY\tLOCKED")
+	row := func(name string, org string, stats api.CacheStats) {
+		memory := stats.Keymap.Bytes + stats.Secrets.Bytes + stats.Projects.Bytes + stats.Negative.Bytes
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%s\t%s\n", name, org, stats.Keymap.Entries, stats.Secrets.Entries,
+			stats.Projects.Entries, stats.Negative.Entries, stats.Hits, formatBytes(memory), formatBytes(stats.LockedBytes))
+	}
+	for _, name := range sortedKeys(report.Profiles) {
+		row(name, report.Profiles[name].OrgID, report.Profiles[name])
+	}
+	row("total", "", api.CacheStats{Stats: report.Total})
+	w.Flush()
+	return 0
+}
+
+func cacheList(cmd *cobra.Command) int {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	now := time.Now()
+	if secrets, _ := cmd.Flags().GetBool("secrets"); secrets {
+		var list []api.CacheSecret
+		if err := adminRequest(cmd, http.MethodGet, "/admin/cache/secrets", url.Values{}, &list); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to list cached secrets: %v\n", err)
+			return 1
+		}
+		if printJSON(cmd, list) {
+			return 0
+		}
+		fmt.Fprintln(w, "PROFILE\tKEY\tID\tPROJECT\tREVISION\tTOKEN\tAGE\tTTL\tHITS\tBYTES")
+		for _, s := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n", s.Profile, s.Key, s.ID, s.ProjectID, s.RevisionDate,
+				s.Token, now.Sub(s.Created).Round(time.Second), s.Expires.Sub(now).Round(time.Second), s.Hits, s.Bytes)
+		}
+	} else {
+		var list []api.CacheKey
+		if err := adminRequest(cmd, http.MethodGet, "/admin/cache/keys", url.Values{}, &list); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to list keymap: %v\n", err)
+			return 1
+		}
+		if printJSON(cmd, list) {
+			return 0
+		}
+		fmt.Fprintln(w, "PROFILE\tORG\tPROJECT\tKEY\tID\tAGE\tTTL")
+		for _, k := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", k.Profile, k.OrgID, k.ProjectID, k.Key, k.ID,
+				now.Sub(k.Created).Round(time.Second), k.Expires.Sub(now).Round(time.Second))
+		}
+	}
+	w.Flush()
+	return 0
+}
+
+func cacheFlush(cmd *cobra.Command) int {
+	query := url.Values{}
+	if id, _ := cmd.Flags().GetString("id"); id != "" {
+		query.Set("id", id)
+	}
+	if key, _ := cmd.Flags().GetString("key"); key != "" {
+		query.Set("key", key)
+	}
+	var result map[string]int
+	if err := adminRequest(cmd, http.MethodDelete, "/admin/cache", query, &result); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to flush cache: %v\n", err)
+		return 1
+	}
+	if !printJSON(cmd, result) {
+		fmt.Printf("Flushed %d cached secrets\n", result["flushed"])
+	}
+	return 0
+}
+
+func formatBytes(n int) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
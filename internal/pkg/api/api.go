@@ -1,15 +1,21 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"net/http"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"bws-cache/internal/pkg/audit"
+	"bws-cache/internal/pkg/auth"
 	"bws-cache/internal/pkg/client"
 	c "bws-cache/internal/pkg/config"
 	"bws-cache/internal/pkg/metrics"
+	"bws-cache/internal/pkg/ratelimit"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -18,34 +24,58 @@ import (
 	"github.com/pkg/errors"
 )
 
+// ProfileHeader selects a named upstream profile for a request.
+const ProfileHeader = "X-BWS-Profile"
+
 type API struct {
-	SecretTTL time.Duration
-	WebTTL    time.Duration
-	OrgID     string
-	Client    *client.Bitwarden
-	Metrics   *metrics.BwsMetrics
+	Client *client.Bitwarden
+	// Profiles hold a client, and so a cache, per named upstream.
+	Profiles map[string]*client.Bitwarden
+	Metrics  *metrics.BwsMetrics
+	// Audit records secret access, nil if auditing is disabled.
+	Audit   *audit.Logger
+	config  atomic.Pointer[c.Config]
+	auth    atomic.Pointer[auth.Authenticator]
+	network atomic.Pointer[network]
+	policy  policyState
+	limits  *ratelimit.Limits
+	router  chi.Router
+	// background runs prewarming and refreshing, see startBackground.
+	background       sync.WaitGroup
+	cancelBackground context.CancelFunc
 }
 
-func New(config *c.Config) http.Handler {
-	api := API{
-		SecretTTL: config.SecretTTL,
-		OrgID:     config.OrgID,
-		Metrics:   metrics.New(),
+func New(config *c.Config) (*API, error) {
+	api := &API{
+		Profiles: make(map[string]*client.Bitwarden),
+		Metrics:  metrics.New(),
+		limits:   ratelimit.New(config.RateLimit),
+	}
+	api.config.Store(config)
+	authenticator, err := auth.New(config)
+	if err != nil {
+		return nil, err
+	}
+	api.auth.Store(authenticator)
+	network, err := newNetwork(config)
+	if err != nil {
+		return nil, err
+	}
+	api.network.Store(network)
+	if err := api.loadPolicy(config.PolicyFile); err != nil {
+		return nil, err
+	}
+	api.Audit, err = audit.New(config.Audit)
+	if err != nil {
+		api.stopPolicyWatch()
+		return nil, err
 	}
 
 	// Logger
 	logger := httplog.NewLogger("bws-cache", httplog.Options{
-		JSON:             true,
-		LogLevel:         slog.LevelInfo,
-		Concise:          false,
-		RequestHeaders:   true,
-		MessageFieldName: "msg",
-		TimeFieldFormat:  time.RFC3339,
-		TimeFieldName:    "time",
-		Tags: map[string]string{
-			"version": c.Version,
-			"commit":  c.Commit,
-		},
+		JSON:           config.LogFormat == "json",
+		Concise:        false,
+		RequestHeaders: true,
 		QuietDownRoutes: []string{
 			"/",
 			"/metrics",
@@ -53,10 +83,18 @@ func New(config *c.Config) http.Handler {
 		},
 		QuietDownPeriod: 10 * time.Minute,
 	})
+	// Log requests through the default logger so they follow log_level and
+	// log_format and are redacted like every other log.
+	logger.Logger = slog.Default().With(
+		slog.String("service", "bws-cache"),
+		slog.Group("tags", slog.String("version", c.Version), slog.String("commit", c.Commit)),
+	)
 
 	router := chi.NewRouter()
 	router.Use(middleware.RequestID)
-	router.Use(middleware.RealIP)
+	router.Use(api.realIP)
+	router.Use(traceRequest)
+	router.Use(api.debugRequest)
 	router.Use(httplog.RequestLogger(logger))
 	router.Use(middleware.Recoverer)
 	router.Use(middleware.Timeout(config.WebTTL))
@@ -67,23 +105,115 @@ func New(config *c.Config) http.Handler {
 	}, []string{"/"})) // path prefix filters records generic http request metrics
 	router.Use(middleware.Heartbeat("/ping"))
 	// Enable profiler
-	router.Mount("/debug", middleware.Profiler())
+	router.With(api.allowAdmin).Mount("/debug", middleware.Profiler())
 
 	slog.Debug("Router middleware setup finished")
 
 	slog.Debug("Creating new bitwarden client connection")
-	api.Client = client.New(api.SecretTTL)
+	endpoints, _ := config.Endpoints()
+	api.Client = client.New(config.SecretTTL, endpoints, api.Metrics.Tagged(map[string]string{"profile": "default"}))
+	for name, profile := range config.Profiles {
+		slog.Debug(fmt.Sprintf("Creating bitwarden client for profile %s", name))
+		endpoints, _ := profile.Endpoints()
+		api.Profiles[name] = client.New(config.SecretTTL, endpoints, api.Metrics.Tagged(map[string]string{"profile": name}))
+	}
+	api.configureCaches(config)
+	api.auditChanges()
+	api.startBackground(config)
 	slog.Debug("Client created")
 
-	router.Route("/id", func(r chi.Router) {
-		r.Get("/{secret_id}", api.getSecretByID)
-	})
-	router.Route("/key", func(r chi.Router) {
-		r.Get("/{secret_key}", api.getSecretByKey)
+	secretRoutes := func(r chi.Router) {
+		// Resetting empties the cache of every token, so it is an admin
+		// endpoint kept at its old path.
+		r.With(api.allowAdmin).Get("/reset", api.resetConnection)
+		r.Group(func(r chi.Router) {
+			r.Use(api.allowSecret)
+			r.Use(noStore)
+			r.Use(api.authenticate)
+			r.Get("/id/{secret_id}", api.getSecretByID)
+			r.Get("/key/{secret_key}", api.getSecretByKey)
+		})
+	}
+	router.Group(secretRoutes)
+	router.Route("/profile/{profile}", secretRoutes)
+	router.Route("/admin", func(r chi.Router) {
+		r.Use(api.allowAdmin)
+		r.Get("/config", api.getConfig)
+		r.Get("/log-level", api.getLogLevel)
+		r.Put("/log-level", api.setLogLevel)
+		r.Delete("/log-level", api.clearLogLevel)
+		r.Get("/cache", api.getCacheStats)
+		r.Delete("/cache", api.flushCache)
+		r.Get("/cache/keys", api.getCacheKeys)
+		r.Get("/cache/secrets", api.getCacheSecrets)
 	})
-	router.Get("/reset", api.resetConnection)
 
-	return router
+	api.router = router
+	return api, nil
+}
+
+// Config returns the configuration currently in effect.
+func (api *API) Config() *c.Config {
+	return api.config.Load()
+}
+
+// Reload applies the live-reloadable settings from config to new requests.
+func (api *API) Reload(config *c.Config) {
+	authenticator, err := auth.New(config)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Keeping current API keys: %v", err))
+	} else {
+		api.auth.Store(authenticator)
+	}
+	network, err := newNetwork(config)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Keeping current network settings: %v", err))
+	} else {
+		api.network.Store(network)
+	}
+	if err := api.loadPolicy(config.PolicyFile); err != nil {
+		slog.Error(fmt.Sprintf("Keeping current policy: %v", err))
+	}
+	api.limits.Configure(config.RateLimit)
+	api.config.Store(config)
+	api.configureCaches(config)
+}
+
+func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.router.ServeHTTP(w, r)
+}
+
+// Shutdown releases the bitwarden client once the http server has stopped
+// handing requests to the API.
+func (api *API) Shutdown() {
+	api.stopPolicyWatch()
+	api.stopBackground()
+	slog.Debug("Shutting down bitwarden client")
+	api.Client.Shutdown()
+	for name, bw := range api.Profiles {
+		slog.Debug(fmt.Sprintf("Shutting down bitwarden client for profile %s", name))
+		bw.Shutdown()
+	}
+	if err := api.Audit.Close(); err != nil {
+		slog.Error(fmt.Sprintf("Unable to close audit log: %v", err))
+	}
+}
+
+// upstream returns the client and org ID of the profile selected by the
+// request, or of the default upstream if none was selected.
+func (api *API) upstream(r *http.Request) (*client.Bitwarden, string, error) {
+	name := chi.URLParam(r, "profile")
+	if name == "" {
+		name = r.Header.Get(ProfileHeader)
+	}
+	if name == "" {
+		return api.Client, api.Config().OrgID, nil
+	}
+	bw, ok := api.Profiles[name]
+	if !ok {
+		return nil, "", errors.Errorf("Unknown profile: %s", name)
+	}
+	return bw, api.Config().Profiles[name].OrgID, nil
 }
 
 func (api *API) getSecretByID(w http.ResponseWriter, r *http.Request) {
@@ -92,26 +222,49 @@ func (api *API) getSecretByID(w http.ResponseWriter, r *http.Request) {
 	api.Metrics.Counter("get", tag)
 	ctx := r.Context()
 	slog.DebugContext(ctx, "Getting secret by ID")
-	token, err := getAuthToken(r)
-	slog.DebugContext(ctx, "Got auth token")
+	identity := auth.FromContext(ctx)
+	if !identity.Scope.AllowMethod("id") {
+		api.auditRequest(r, audit.Denied, "scope")
+		http.Error(w, "Not allowed to get secrets by ID", http.StatusForbidden)
+		return
+	}
+	bw, orgID, err := api.upstream(r)
 	if err != nil {
-		slog.Error(fmt.Sprintf("%+v", err))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		slog.ErrorContext(ctx, fmt.Sprintf("%+v", err))
+		api.auditRequest(r, audit.Error, err.Error())
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 	id := chi.URLParam(r, "secret_id")
+	if allowed, reason := api.preauthorize(r, id, ""); !allowed {
+		api.auditRequest(r, audit.Denied, reason)
+		http.Error(w, "Not allowed to read this secret", http.StatusForbidden)
+		return
+	}
 
 	slog.DebugContext(ctx, fmt.Sprintf("Getting secret by ID: %s", id))
 	span := api.Metrics.RecordSpan("get", tag)
 	defer span.Stop()
-	res, err := api.Client.GetByID(ctx, id, token)
+	r = api.limitUpstream(r)
+	res, err := bw.GetByID(client.WithFreshness(r.Context(), freshness(r)), id, identity.Token)
+	if api.rateLimited(w, r, err) || api.notCached(w, r, err) {
+		return
+	}
 	if err != nil {
 		slog.ErrorContext(ctx, fmt.Sprintf("%+v", err))
+		api.auditRequest(r, audit.Error, err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if res.Hit && !res.Stale && !api.limitHit(w, r) {
+		return
+	}
+	if !api.checkSecrets(w, r, bw, orgID, res.Value, res.Hit) {
+		return
+	}
 	slog.DebugContext(ctx, "Got secret")
-	fmt.Fprint(w, res)
+	setCacheHeaders(w, res)
+	fmt.Fprint(w, res.Value)
 }
 
 func (api *API) getSecretByKey(w http.ResponseWriter, r *http.Request) {
@@ -120,44 +273,104 @@ func (api *API) getSecretByKey(w http.ResponseWriter, r *http.Request) {
 	api.Metrics.Counter("get", tag)
 	ctx := r.Context()
 	slog.DebugContext(ctx, "Getting secret by key")
-	token, err := getAuthToken(r)
+	identity := auth.FromContext(ctx)
+	if !identity.Scope.AllowMethod("key") {
+		api.auditRequest(r, audit.Denied, "scope")
+		http.Error(w, "Not allowed to get secrets by key", http.StatusForbidden)
+		return
+	}
+	bw, orgID, err := api.upstream(r)
 	if err != nil {
 		slog.ErrorContext(ctx, fmt.Sprintf("%+v", err))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		api.auditRequest(r, audit.Error, err.Error())
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 	key := chi.URLParam(r, "secret_key")
+	if !identity.Scope.AllowKey(key) {
+		slog.WarnContext(ctx, fmt.Sprintf("%s is not allowed to read key %s", identity.Name, key))
+		api.auditRequest(r, audit.Denied, "scope")
+		http.Error(w, "Not allowed to read this secret", http.StatusForbidden)
+		return
+	}
+	if allowed, reason := api.preauthorize(r, "", key); !allowed {
+		api.auditRequest(r, audit.Denied, reason)
+		http.Error(w, "Not allowed to read this secret", http.StatusForbidden)
+		return
+	}
 
 	slog.DebugContext(ctx, fmt.Sprintf("Searching for key: %s", key))
 	span := api.Metrics.RecordSpan("get", tag)
 	defer span.Stop()
-	res, err := api.Client.GetByKey(ctx, key, api.OrgID, token)
+	r = api.limitUpstream(r)
+	res, err := bw.GetByKey(client.WithFreshness(r.Context(), freshness(r)), key, orgID, identity.Token)
+	if api.rateLimited(w, r, err) || api.notCached(w, r, err) {
+		return
+	}
 	if err != nil {
 		slog.ErrorContext(ctx, fmt.Sprintf("%+v", err))
+		api.auditRequest(r, audit.Error, err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if res.Hit && !res.Stale && !api.limitHit(w, r) {
+		return
+	}
+	if !api.checkSecrets(w, r, bw, orgID, res.Value, res.Hit) {
+		return
+	}
 	slog.DebugContext(ctx, "Got key")
-	fmt.Fprint(w, res)
+	setCacheHeaders(w, res)
+	fmt.Fprint(w, res.Value)
+}
+
+// checkSecrets authorizes and audits the secrets in res, writing an error
+// response if the caller may not read them.
+func (api *API) checkSecrets(w http.ResponseWriter, r *http.Request, bw *client.Bitwarden, orgID string, res string, hit bool) bool {
+	secrets, err := parseSecrets(res)
+	if err != nil {
+		slog.ErrorContext(r.Context(), err.Error())
+		api.auditRequest(r, audit.Error, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	allowed, reason := api.authorize(r, bw, orgID, secrets)
+	if !allowed {
+		api.auditSecrets(r, secrets, hit, audit.Denied, reason)
+		http.Error(w, "Not allowed to read this secret", http.StatusForbidden)
+		return false
+	}
+	api.auditSecrets(r, secrets, hit, audit.Allowed, reason)
+	return true
 }
 
 func (api *API) resetConnection(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	slog.InfoContext(ctx, "Resetting cache")
 
-	api.Client.Cache.Reset()
+	if chi.URLParam(r, "profile") != "" || r.Header.Get(ProfileHeader) != "" {
+		bw, _, err := api.upstream(r)
+		if err != nil {
+			slog.ErrorContext(ctx, fmt.Sprintf("%+v", err))
+			api.Audit.Log(auditEvent(r, audit.Invalidate, audit.Error, err.Error()))
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		bw.Cache.Reset()
+	} else {
+		api.Client.Cache.Reset()
+		for _, bw := range api.Profiles {
+			bw.Cache.Reset()
+		}
+	}
+	api.Audit.Log(auditEvent(r, audit.Invalidate, audit.Allowed, ""))
 	tag := make(map[string]string)
-	tag["endpoint"] = "cache"
-	api.Metrics.Counter("get", tag)
+	tag["endpoint"] = "reset"
+	api.Metrics.Counter("reset", tag)
 	slog.InfoContext(ctx, "Cache reset")
 }
 
-func getAuthToken(r *http.Request) (string, error) {
-	prefix := "Bearer "
-	authHeader := r.Header.Get("Authorization")
-	reqToken := strings.TrimPrefix(authHeader, prefix)
-	if authHeader == "" || reqToken == "" {
-		return "", errors.Errorf("No token or invalid token sent")
-	}
-	return reqToken, nil
+func (api *API) getConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.Config().Redacted())
 }
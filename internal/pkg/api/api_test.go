@@ -0,0 +1,225 @@
+package api
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"bws-cache/internal/pkg/client"
+	c "bws-cache/internal/pkg/config"
+	"bws-cache/internal/pkg/logging"
+	"bws-cache/internal/pkg/redact"
+	"bws-cache/internal/pkg/sdktest"
+)
+
+const (
+	orgID       = "7f3a3c5e-2a0b-4e8e-9d43-1c1f3f0b9a11"
+	serverToken = "server-token-0001"
+	clientToken = "client-token-0002"
+	apiKey      = "local-api-key-0003"
+)
+
+// logBuffer collects log output written from several goroutines.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// newTestAPI starts an API configured by yaml against bw, logging at DEBUG
+// through the redaction layer into the returned buffer.
+func newTestAPI(t *testing.T, yaml string, bw *sdktest.Bitwarden) (*API, *logBuffer) {
+	t.Helper()
+	logs := &logBuffer{}
+	logger := slog.Default()
+	slog.SetDefault(slog.New(logging.NewHandler(redact.NewHandler(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})))))
+	logging.SetBase(slog.LevelDebug)
+	newSDKClient, tokenStateDir := client.NewSDKClient, client.TokenStateDir
+	client.NewSDKClient, client.TokenStateDir = bw.NewClient, t.TempDir()
+	t.Cleanup(func() {
+		slog.SetDefault(logger)
+		logging.SetBase(slog.LevelInfo)
+		client.NewSDKClient, client.TokenStateDir = newSDKClient, tokenStateDir
+	})
+
+	file := filepath.Join(t.TempDir(), "bws-cache.yml")
+	if err := os.WriteFile(file, []byte("org_id: "+orgID+"\n"+yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BWS_CACHE_CONFIG", file)
+	config := &c.Config{}
+	if err := c.LoadConfig(config, nil); err != nil {
+		t.Fatal(err)
+	}
+	api, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(api.Shutdown)
+	return api, logs
+}
+
+func get(t *testing.T, handler http.Handler, path string, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.RemoteAddr = "127.0.0.1:40000"
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestDebugLogsAreRedacted(t *testing.T) {
+	bw := sdktest.New(serverToken, clientToken)
+	id := bw.AddSecret(orgID, "", "db_password", "hunter2-value", "")
+	bw.AddSecret(orgID, "", "api_secret", "correct horse battery", "")
+	api, logs := newTestAPI(t, `
+tokens:
+  main: `+serverToken+`
+api_keys:
+  - name: web
+    key: `+apiKey+`
+    token: main
+allow_client_tokens: true
+`, bw)
+
+	for _, test := range []struct{ path, token string }{
+		{"/key/db_password", apiKey},
+		{"/key/api_secret", apiKey},
+		{"/id/" + id, clientToken},
+	} {
+		if w := get(t, api, test.path, test.token); w.Code != http.StatusOK {
+			t.Fatalf("GET %s: got %d %s", test.path, w.Code, w.Body)
+		}
+	}
+	if w := get(t, api, "/id/"+id, "unknown-token-0004"); w.Code == http.StatusOK {
+		t.Fatalf("unknown token: got %d", w.Code)
+	}
+
+	out := logs.String()
+	if !strings.Contains(out, "level=DEBUG") {
+		t.Fatalf("nothing logged at DEBUG: %s", out)
+	}
+	for _, secret := range []string{serverToken, clientToken, apiKey, "hunter2-value", "correct horse battery"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("%q logged", secret)
+		}
+		if redact.String(secret) != redact.Mask {
+			t.Errorf("%q not registered for redaction", secret)
+		}
+	}
+	if redact.String("unknown-token-0004") != "unknown-token-0004" {
+		t.Error("token that didn't authenticate registered for redaction")
+	}
+}
+
+func TestAdminCacheRequiresAdminKey(t *testing.T) {
+	const adminKey = "admin-key-0005"
+	bw := sdktest.New(serverToken)
+	bw.AddSecret(orgID, "", "db_password", "hunter2-value", "")
+	api, _ := newTestAPI(t, `
+tokens:
+  main: `+serverToken+`
+api_keys:
+  - name: web
+    key: `+apiKey+`
+    token: main
+admin_keys:
+  - name: ops
+    key: `+adminKey+`
+`, bw)
+	if w := get(t, api, "/key/db_password", apiKey); w.Code != http.StatusOK {
+		t.Fatalf("GET /key/db_password: got %d %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		token  string
+		code   int
+	}{
+		{http.MethodGet, "/admin/cache/keys", "", http.StatusUnauthorized},
+		{http.MethodGet, "/admin/cache/secrets", apiKey, http.StatusUnauthorized},
+		{http.MethodDelete, "/admin/cache", serverToken, http.StatusUnauthorized},
+		{http.MethodGet, "/admin/cache/keys", adminKey, http.StatusOK},
+		{http.MethodGet, "/admin/cache/secrets", adminKey, http.StatusOK},
+		{http.MethodDelete, "/admin/cache", adminKey, http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		r.RemoteAddr = "127.0.0.1:40000"
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s %s: got %d, want %d", test.method, test.path, w.Code, test.code)
+		}
+	}
+	if stats := api.Client.Cache.Stats(); stats.Secrets.Entries != 0 {
+		t.Errorf("got %d cached secrets after flush, want 0", stats.Secrets.Entries)
+	}
+}
+
+func TestResetRequiresAdminKey(t *testing.T) {
+	const adminKey = "admin-key-0005"
+	tests := []struct {
+		name  string
+		yaml  string
+		token string
+		code  int
+	}{
+		{"no admin keys", "", serverToken, http.StatusForbidden},
+		{"no key", "admin_keys:\n  - name: ops\n    key: " + adminKey + "\n", "", http.StatusUnauthorized},
+		{"bws token", "admin_keys:\n  - name: ops\n    key: " + adminKey + "\n", serverToken, http.StatusUnauthorized},
+		{"api key", "admin_keys:\n  - name: ops\n    key: " + adminKey + "\n", apiKey, http.StatusUnauthorized},
+		{"admin key", "admin_keys:\n  - name: ops\n    key: " + adminKey + "\n", adminKey, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bw := sdktest.New(serverToken)
+			bw.AddSecret(orgID, "", "db_password", "hunter2-value", "")
+			api, _ := newTestAPI(t, `
+tokens:
+  main: `+serverToken+`
+api_keys:
+  - name: web
+    key: `+apiKey+`
+    token: main
+`+test.yaml, bw)
+			if w := get(t, api, "/key/db_password", apiKey); w.Code != http.StatusOK {
+				t.Fatalf("GET /key/db_password: got %d %s", w.Code, w.Body)
+			}
+			if w := get(t, api, "/reset", test.token); w.Code != test.code {
+				t.Errorf("GET /reset: got %d, want %d", w.Code, test.code)
+			}
+			want := 1
+			if test.code == http.StatusOK {
+				want = 0
+			}
+			if entries := api.Client.Cache.Stats().Secrets.Entries; entries != want {
+				t.Errorf("got %d cached secrets, want %d", entries, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"net/http"
+
+	"bws-cache/internal/pkg/audit"
+	"bws-cache/internal/pkg/auth"
+
+	sdk "github.com/bitwarden/sdk-go"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// auditEvent fills in the request details common to every audit event.
+func auditEvent(r *http.Request, action string, outcome string, reason string) audit.Event {
+	event := audit.Event{
+		Action:    action,
+		RequestID: middleware.GetReqID(r.Context()),
+		Caller:    auditCaller(auth.FromContext(r.Context())),
+		Addr:      r.RemoteAddr,
+		Profile:   chi.URLParam(r, "profile"),
+		SecretID:  chi.URLParam(r, "secret_id"),
+		Key:       chi.URLParam(r, "secret_key"),
+		Outcome:   outcome,
+		Reason:    reason,
+	}
+	if event.Profile == "" {
+		event.Profile = r.Header.Get(ProfileHeader)
+	}
+	return event
+}
+
+func auditCaller(identity *auth.Identity) *audit.Caller {
+	if identity == nil {
+		return nil
+	}
+	caller := audit.Caller{
+		Kind:        identity.Kind,
+		Name:        identity.Name,
+		Subject:     identity.Subject,
+		Fingerprint: identity.Fingerprint,
+	}
+	if identity.Certificate != nil {
+		caller.Certificate = identity.Certificate.Subject
+		caller.SANs = identity.Certificate.SANs
+	}
+	if identity.Peer != nil {
+		caller.Peer = identity.Peer.String()
+	}
+	return &caller
+}
+
+// auditRequest records a read that failed before any secret was found.
+func (api *API) auditRequest(r *http.Request, outcome string, reason string) {
+	api.Audit.Log(auditEvent(r, audit.Read, outcome, reason))
+}
+
+// auditSecrets records a read of each secret returned by a request.
+func (api *API) auditSecrets(r *http.Request, secrets []sdk.SecretResponse, hit bool, outcome string, reason string) {
+	cache := audit.Miss
+	if hit {
+		cache = audit.Hit
+	}
+	for _, secret := range secrets {
+		event := auditEvent(r, audit.Read, outcome, reason)
+		event.SecretID = secret.ID
+		event.Key = secret.Key
+		if secret.ProjectID != nil {
+			event.ProjectID = *secret.ProjectID
+		}
+		event.Cache = cache
+		api.Audit.Log(event)
+	}
+}
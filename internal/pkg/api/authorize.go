@@ -0,0 +1,236 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"bws-cache/internal/pkg/audit"
+	"bws-cache/internal/pkg/auth"
+	"bws-cache/internal/pkg/client"
+	"bws-cache/internal/pkg/policy"
+	"bws-cache/internal/pkg/watch"
+
+	sdk "github.com/bitwarden/sdk-go"
+	"github.com/fsnotify/fsnotify"
+)
+
+type policyState struct {
+	current atomic.Pointer[policy.Policy]
+	mu      sync.Mutex
+	file    string
+	watcher *fsnotify.Watcher
+}
+
+// authenticate identifies the caller and stores the identity in the request
+// context for the handlers.
+func (api *API) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, err := api.auth.Load().Authenticate(r)
+		if err != nil {
+			slog.ErrorContext(r.Context(), fmt.Sprintf("%+v", err))
+			api.auditRequest(r, audit.Denied, err.Error())
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		slog.DebugContext(r.Context(), fmt.Sprintf("Authenticated %s %s", identity.Kind, identity.Name))
+		next.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), identity)))
+	})
+}
+
+// authenticateAdmin requires one of the admin keys on the admin endpoints.
+// Without admin keys, only callers on the Unix socket and addresses in the
+// admin_access allow list are let through, so the admin endpoints aren't
+// open to everyone by default.
+func (api *API) authenticateAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authenticator := api.auth.Load()
+		if !authenticator.HasAdminKeys() {
+			if onSocket(r) || len(api.network.Load().admin.allow) > 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			slog.WarnContext(r.Context(), fmt.Sprintf("Refusing %s %s from %s, set admin_keys or admin_access to allow it", r.Method, r.URL.Path, r.RemoteAddr))
+			api.auditRequest(r, audit.Denied, "admin endpoints disabled")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		identity, err := authenticator.AuthenticateAdmin(r)
+		if err != nil {
+			slog.WarnContext(r.Context(), fmt.Sprintf("Refusing %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err))
+			api.auditRequest(r, audit.Denied, err.Error())
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		slog.DebugContext(r.Context(), fmt.Sprintf("Authenticated %s %s", identity.Kind, identity.Name))
+		next.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), identity)))
+	})
+}
+
+// parseSecrets parses res, either a single secret or a list of them.
+func parseSecrets(res string) ([]sdk.SecretResponse, error) {
+	var secrets struct {
+		sdk.SecretResponse
+		Data []sdk.SecretResponse `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(res), &secrets); err != nil {
+		return nil, fmt.Errorf("unable to parse secret: %w", err)
+	}
+	if secrets.Data == nil {
+		secrets.Data = []sdk.SecretResponse{secrets.SecretResponse}
+	}
+	return secrets.Data, nil
+}
+
+// preauthorize checks a read of the secret with id or key against the
+// access policy before it is read, so a read the policy denies whatever the
+// secret turns out to be doesn't reach Bitwarden or the cache. Reads it
+// allows are checked again by authorize once the secret is read.
+func (api *API) preauthorize(r *http.Request, id string, key string) (bool, string) {
+	rules := api.policy.current.Load()
+	if rules == nil {
+		return true, ""
+	}
+	ctx := r.Context()
+	identity := auth.FromContext(ctx)
+	decision, decided := rules.Precheck(policy.Request{
+		Identity: identity,
+		Addr:     remoteAddr(r),
+		ID:       id,
+		Key:      key,
+	})
+	if !decided || decision.Allowed || api.Config().PolicyDryRun {
+		return true, ""
+	}
+	rule := decision.Rule
+	if rule == "" {
+		rule = "default"
+	}
+	secret := id
+	if secret == "" {
+		secret = key
+	}
+	slog.WarnContext(ctx, fmt.Sprintf("Policy denied %s reading secret %s by %s", identity.Name, secret, rule))
+	return false, "policy: " + rule
+}
+
+// authorize checks every secret against the caller's API key scope and the
+// access policy. The reason explains a denial, or an allow that was only
+// granted by dry run.
+func (api *API) authorize(r *http.Request, bw *client.Bitwarden, orgID string, secrets []sdk.SecretResponse) (bool, string) {
+	ctx := r.Context()
+	identity := auth.FromContext(ctx)
+	rules := api.policy.current.Load()
+	if identity.Scope == nil && rules == nil {
+		return true, ""
+	}
+
+	reason := ""
+	for _, secret := range secrets {
+		projectID := ""
+		if secret.ProjectID != nil {
+			projectID = *secret.ProjectID
+		}
+		if !identity.Scope.AllowKey(secret.Key) || !identity.Scope.AllowProject(projectID) {
+			slog.WarnContext(ctx, fmt.Sprintf("%s is not allowed to read secret %s by its API key scope", identity.Name, secret.ID))
+			return false, "scope"
+		}
+		if rules == nil {
+			continue
+		}
+
+		req := policy.Request{
+			Identity: identity,
+			Addr:     remoteAddr(r),
+			ID:       secret.ID,
+			Key:      secret.Key,
+		}
+		if projectID != "" && rules.UsesProjects() {
+			name, err := bw.GetProjectName(ctx, projectID, orgID, identity.Token)
+			if err != nil {
+				slog.ErrorContext(ctx, fmt.Sprintf("Unable to look up project for policy: %v", err))
+				return false, "project lookup failed"
+			}
+			req.Project = name
+		}
+
+		decision := rules.Evaluate(req)
+		rule := decision.Rule
+		if rule == "" {
+			rule = "default"
+		}
+		switch {
+		case decision.Allowed:
+			slog.DebugContext(ctx, fmt.Sprintf("Policy allowed %s to read secret %s by %s", identity.Name, secret.ID, rule))
+		case api.Config().PolicyDryRun:
+			slog.InfoContext(ctx, fmt.Sprintf("Policy dry run: would deny %s reading secret %s by %s", identity.Name, secret.ID, rule))
+			reason = "policy dry run would deny: " + rule
+		default:
+			slog.WarnContext(ctx, fmt.Sprintf("Policy denied %s reading secret %s by %s", identity.Name, secret.ID, rule))
+			return false, "policy: " + rule
+		}
+	}
+	return true, reason
+}
+
+// loadPolicy replaces the access policy with the one in file, or removes it
+// if file is empty, and watches the file for changes.
+func (api *API) loadPolicy(file string) error {
+	api.policy.mu.Lock()
+	defer api.policy.mu.Unlock()
+
+	if file == "" {
+		api.policy.current.Store(nil)
+		api.stopPolicyWatchLocked()
+		api.policy.file = ""
+		return nil
+	}
+
+	rules, err := policy.Load(file)
+	if err != nil {
+		return err
+	}
+	api.policy.current.Store(rules)
+	slog.Info(fmt.Sprintf("Loaded %d policy rules from %s", len(rules.Rules), file))
+
+	if file == api.policy.file && api.policy.watcher != nil {
+		return nil
+	}
+	api.stopPolicyWatchLocked()
+	api.policy.file = file
+	api.policy.watcher, err = watch.File(file, func() {
+		// Reload outside the watcher's goroutine, closing the watcher
+		// waits for it to return.
+		go func() {
+			if err := api.loadPolicy(file); err != nil {
+				slog.Error(fmt.Sprintf("Keeping current policy: %v", err))
+			}
+		}()
+	})
+	return err
+}
+
+func (api *API) stopPolicyWatch() {
+	api.policy.mu.Lock()
+	defer api.policy.mu.Unlock()
+	api.stopPolicyWatchLocked()
+}
+
+func (api *API) stopPolicyWatchLocked() {
+	if api.policy.watcher != nil {
+		api.policy.watcher.Close()
+		api.policy.watcher = nil
+	}
+}
+
+func remoteAddr(r *http.Request) netip.Addr {
+	if addrPort, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		return addrPort.Addr()
+	}
+	addr, _ := netip.ParseAddr(r.RemoteAddr)
+	return addr
+}
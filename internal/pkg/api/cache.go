@@ -0,0 +1,219 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+
+	"bws-cache/internal/pkg/audit"
+	"bws-cache/internal/pkg/cache"
+	"bws-cache/internal/pkg/client"
+	c "bws-cache/internal/pkg/config"
+)
+
+// DefaultProfile names the default upstream in the cache admin API.
+const DefaultProfile = "default"
+
+// CacheStats is the summary of the cache of an upstream profile.
+type CacheStats struct {
+	OrgID string `json:"org_id"`
+	cache.Stats
+}
+
+// CacheReport is the summary returned by GET /admin/cache.
+type CacheReport struct {
+	Profiles map[string]CacheStats `json:"profiles"`
+	Total    cache.Stats           `json:"total"`
+}
+
+// CacheKey is a keymap entry listed by GET /admin/cache/keys.
+type CacheKey struct {
+	Profile string `json:"profile"`
+	cache.KeyInfo
+}
+
+// CacheSecret is a secret listed by GET /admin/cache/secrets.
+type CacheSecret struct {
+	Profile string `json:"profile"`
+	cache.SecretInfo
+}
+
+// clients returns the client of every profile, by name.
+func (api *API) clients() map[string]*client.Bitwarden {
+	clients := map[string]*client.Bitwarden{DefaultProfile: api.Client}
+	for name, bw := range api.Profiles {
+		clients[name] = bw
+	}
+	return clients
+}
+
+// profileClients returns the clients selected by the profile query
+// parameter, or every client if it isn't set.
+func (api *API) profileClients(r *http.Request) (map[string]*client.Bitwarden, error) {
+	clients := api.clients()
+	name := r.URL.Query().Get("profile")
+	if name == "" {
+		return clients, nil
+	}
+	bw, ok := clients[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown profile: %s", name)
+	}
+	return map[string]*client.Bitwarden{name: bw}, nil
+}
+
+// auditChanges audits the entries each cache evicts because they changed
+// upstream.
+func (api *API) auditChanges() {
+	for name, bw := range api.clients() {
+		profile := name
+		if profile == DefaultProfile {
+			profile = ""
+		}
+		bw.Cache.OnChange(func(change cache.Change) {
+			api.Audit.Log(audit.Event{
+				Action:   audit.Invalidate,
+				Profile:  profile,
+				SecretID: change.ID,
+				Key:      change.Key,
+				Outcome:  audit.Allowed,
+				Reason:   change.String(),
+			})
+		})
+	}
+}
+
+// configureCaches applies the cache TTLs and limits of config to every
+// client, and whether they refresh the keymap on a miss.
+func (api *API) configureCaches(config *c.Config) {
+	ttls := cache.TTLs{
+		Keymap:   config.KeymapTTL,
+		Secrets:  config.SecretTTL,
+		Negative: config.NegativeTTL,
+		Jitter:   config.TTLJitter,
+		NoteMax:  config.NoteTTLMax,
+		Stale:    config.StaleTTL,
+	}
+	if ttls.Keymap == 0 {
+		ttls.Keymap = config.SecretTTL
+	}
+	for _, override := range config.TTLOverrides {
+		ttls.Overrides = append(ttls.Overrides, cache.Override(override))
+	}
+	limits := cache.Limits{
+		Keymap:       cache.Limit(config.Cache.Keymap),
+		Secrets:      cache.Limit(config.Cache.Secrets),
+		Tenant:       cache.Limit(config.Cache.Tenant),
+		KeymapTenant: cache.Limit(config.Cache.KeymapTenant),
+	}
+	for _, bw := range api.clients() {
+		bw.Cache.SetTTLs(ttls)
+		bw.Cache.SetLimits(limits)
+		bw.SetRefreshOnMiss(config.RefreshKeyMap)
+	}
+}
+
+func (api *API) orgID(profile string) string {
+	if profile == DefaultProfile {
+		return api.Config().OrgID
+	}
+	return api.Config().Profiles[profile].OrgID
+}
+
+func (api *API) getCacheStats(w http.ResponseWriter, r *http.Request) {
+	clients, err := api.profileClients(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	report := CacheReport{Profiles: make(map[string]CacheStats)}
+	for name, bw := range clients {
+		stats := bw.Cache.Stats()
+		report.Profiles[name] = CacheStats{OrgID: api.orgID(name), Stats: stats}
+		for _, pair := range []struct{ total, count *cache.Count }{
+			{&report.Total.Keymap, &stats.Keymap},
+			{&report.Total.Secrets, &stats.Secrets},
+			{&report.Total.Projects, &stats.Projects},
+			{&report.Total.Negative, &stats.Negative},
+		} {
+			pair.total.Entries += pair.count.Entries
+			pair.total.Bytes += pair.count.Bytes
+		}
+		report.Total.Hits += stats.Hits
+		report.Total.LockedBytes += stats.LockedBytes
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func (api *API) getCacheKeys(w http.ResponseWriter, r *http.Request) {
+	clients, err := api.profileClients(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	keys := []CacheKey{}
+	for name, bw := range clients {
+		for _, key := range bw.Cache.Keys() {
+			keys = append(keys, CacheKey{Profile: name, KeyInfo: key})
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].Profile < keys[j].Profile })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+func (api *API) getCacheSecrets(w http.ResponseWriter, r *http.Request) {
+	clients, err := api.profileClients(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	secrets := []CacheSecret{}
+	for name, bw := range clients {
+		for _, secret := range bw.Cache.Secrets() {
+			secrets = append(secrets, CacheSecret{Profile: name, SecretInfo: secret})
+		}
+	}
+	sort.SliceStable(secrets, func(i, j int) bool { return secrets[i].Profile < secrets[j].Profile })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(secrets)
+}
+
+// flushCache empties the caches selected by the profile query parameter,
+// or removes just the secret selected by the id or key parameter.
+func (api *API) flushCache(w http.ResponseWriter, r *http.Request) {
+	clients, err := api.profileClients(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	key := r.URL.Query().Get("key")
+	flushed := 0
+	for _, bw := range clients {
+		switch {
+		case id != "":
+			if bw.Cache.Delete(id) {
+				flushed++
+			}
+		case key != "":
+			if bw.Cache.DeleteKey(key) {
+				flushed++
+			}
+		default:
+			flushed += bw.Cache.Stats().Secrets.Entries
+			bw.Cache.Reset()
+		}
+	}
+	event := auditEvent(r, audit.Invalidate, audit.Allowed, "")
+	event.Profile = r.URL.Query().Get("profile")
+	event.SecretID = id
+	event.Key = key
+	api.Audit.Log(event)
+	slog.InfoContext(r.Context(), fmt.Sprintf("Flushed %d cached secrets", flushed))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"flushed": flushed})
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bws-cache/internal/pkg/audit"
+	"bws-cache/internal/pkg/client"
+)
+
+// freshness reads what a request accepts from the cache from its
+// Cache-Control header, or a Pragma: no-cache header without one.
+func freshness(r *http.Request) client.Freshness {
+	var freshness client.Freshness
+	header := r.Header.Values("Cache-Control")
+	if len(header) == 0 {
+		header = r.Header.Values("Pragma")
+	}
+	for _, value := range header {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			switch strings.ToLower(name) {
+			case "no-cache":
+				freshness.NoCache = true
+			case "only-if-cached":
+				freshness.OnlyIfCached = true
+			case "max-age":
+				seconds, err := strconv.Atoi(strings.Trim(arg, `"`))
+				if err != nil || seconds < 0 {
+					continue
+				}
+				if seconds == 0 {
+					freshness.NoCache = true
+				} else if freshness.MaxAge == 0 || time.Duration(seconds)*time.Second < freshness.MaxAge {
+					freshness.MaxAge = time.Duration(seconds) * time.Second
+				}
+			}
+		}
+	}
+	return freshness
+}
+
+// notCached writes a 504 response if err is client.ErrNotCached, for a
+// request with Cache-Control: only-if-cached.
+func (api *API) notCached(w http.ResponseWriter, r *http.Request, err error) bool {
+	if !errors.Is(err, client.ErrNotCached) {
+		return false
+	}
+	slog.DebugContext(r.Context(), err.Error())
+	api.auditRequest(r, audit.Error, err.Error())
+	http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	return true
+}
+
+// noStore stops clients and proxies from storing secrets.
+func noStore(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setCacheHeaders describes where res came from in the X-Cache and Age
+// headers.
+func setCacheHeaders(w http.ResponseWriter, res client.Result) {
+	status := "MISS"
+	if res.Stale {
+		status = "STALE"
+	} else if res.Hit {
+		status = "HIT"
+	}
+	w.Header().Set("X-Cache", status)
+	w.Header().Set("Age", strconv.Itoa(int(res.Age.Seconds())))
+}
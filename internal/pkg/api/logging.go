@@ -0,0 +1,88 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"bws-cache/internal/pkg/logging"
+)
+
+// logLevelRequest changes the log level of a component, or of every
+// component if Component is empty, for Duration if it is set.
+type logLevelRequest struct {
+	Level     string `json:"level"`
+	Component string `json:"component"`
+	Duration  string `json:"duration"`
+}
+
+func (api *API) getLogLevel(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logging.Current())
+}
+
+func (api *API) setLogLevel(w http.ResponseWriter, r *http.Request) {
+	var req logLevelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(req.Level)); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid level: %v", err), http.StatusBadRequest)
+		return
+	}
+	var duration time.Duration
+	if req.Duration != "" {
+		var err error
+		if duration, err = time.ParseDuration(req.Duration); err != nil || duration < 0 {
+			http.Error(w, fmt.Sprintf("Invalid duration: %s", req.Duration), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := logging.Set(req.Component, level, duration); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	message := fmt.Sprintf("Log level of %s set to %s", componentName(req.Component), level)
+	if duration > 0 {
+		message += fmt.Sprintf(" for %s", duration)
+	}
+	slog.InfoContext(r.Context(), message)
+	api.getLogLevel(w, r)
+}
+
+func (api *API) clearLogLevel(w http.ResponseWriter, r *http.Request) {
+	component := r.URL.Query().Get("component")
+	logging.Clear(component)
+	slog.InfoContext(r.Context(), fmt.Sprintf("Log level override of %s cleared", componentName(component)))
+	api.getLogLevel(w, r)
+}
+
+func componentName(component string) string {
+	if component == "" {
+		return "all components"
+	}
+	return component
+}
+
+// debugRequest logs a request at every level if it has a valid
+// X-BWS-Debug token signed with debug_key.
+func (api *API) debugRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(logging.DebugHeader)
+		key := api.Config().DebugKey
+		if token == "" || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err := logging.VerifyDebugToken(key, token, time.Now()); err != nil {
+			slog.WarnContext(r.Context(), fmt.Sprintf("Ignoring %s header: %v", logging.DebugHeader, err))
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(logging.WithDebug(r.Context())))
+	})
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"bws-cache/internal/pkg/audit"
+	c "bws-cache/internal/pkg/config"
+)
+
+// network holds the parsed trusted proxies and address allowlists.
+type network struct {
+	trusted []netip.Prefix
+	secret  cidrList
+	admin   cidrList
+}
+
+type cidrList struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+func newNetwork(config *c.Config) (*network, error) {
+	trusted, err := c.ParsePrefixes(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := newCIDRList(config.SecretAccess)
+	if err != nil {
+		return nil, err
+	}
+	admin, err := newCIDRList(config.AdminAccess)
+	if err != nil {
+		return nil, err
+	}
+	return &network{trusted: trusted, secret: secret, admin: admin}, nil
+}
+
+func newCIDRList(config c.CIDRList) (cidrList, error) {
+	allow, err := c.ParsePrefixes(config.Allow)
+	if err != nil {
+		return cidrList{}, err
+	}
+	deny, err := c.ParsePrefixes(config.Deny)
+	if err != nil {
+		return cidrList{}, err
+	}
+	return cidrList{allow: allow, deny: deny}, nil
+}
+
+func contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	return slices.ContainsFunc(prefixes, func(prefix netip.Prefix) bool {
+		return prefix.Contains(addr)
+	})
+}
+
+// permits reports whether addr is allowed. An unknown or invalid address,
+// such as one a trusted proxy forwarded malformed, never is.
+func (l *cidrList) permits(addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	addr = addr.Unmap()
+	if contains(l.deny, addr) {
+		return false
+	}
+	return len(l.allow) == 0 || contains(l.allow, addr)
+}
+
+// clientAddr returns the address of the client, following X-Forwarded-For
+// or X-Real-IP only through trusted proxies. X-Forwarded-For is read from
+// the right, the first address not of a trusted proxy is the client.
+func (n *network) clientAddr(r *http.Request) netip.Addr {
+	addr := remoteAddr(r).Unmap()
+	if !addr.IsValid() || !contains(n.trusted, addr) {
+		return addr
+	}
+
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				return netip.Addr{}
+			}
+			addr = hop.Unmap()
+			if !contains(n.trusted, addr) {
+				return addr
+			}
+		}
+		return addr
+	}
+	if realIP, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return realIP.Unmap()
+	}
+	return addr
+}
+
+// trustedProxyKey marks the context of a request received from a trusted
+// proxy.
+type trustedProxyKey struct{}
+
+// realIP replaces the remote address of requests forwarded by trusted
+// proxies with the address of the client, or with "unknown" if a trusted
+// proxy forwarded a malformed address.
+func (api *API) realIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote := remoteAddr(r)
+		if !remote.IsValid() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		n := api.network.Load()
+		if contains(n.trusted, remote.Unmap()) {
+			r = r.WithContext(context.WithValue(r.Context(), trustedProxyKey{}, true))
+		}
+		addr := n.clientAddr(r)
+		r.RemoteAddr = "unknown"
+		if addr.IsValid() {
+			r.RemoteAddr = addr.String()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// fromTrustedProxy reports whether r was received from a trusted proxy.
+func fromTrustedProxy(r *http.Request) bool {
+	trusted, _ := r.Context().Value(trustedProxyKey{}).(bool)
+	return trusted
+}
+
+// allowSecret and allowAdmin refuse requests from addresses outside the
+// secret and admin allowlists. Unix socket callers have no address and are
+// always let through, any other request without a valid address is
+// refused. allowAdmin then requires an admin key, see authenticateAdmin.
+func (api *API) allowSecret(next http.Handler) http.Handler {
+	return api.allowFrom(func(n *network) *cidrList { return &n.secret }, next)
+}
+
+func (api *API) allowAdmin(next http.Handler) http.Handler {
+	return api.allowFrom(func(n *network) *cidrList { return &n.admin }, api.authenticateAdmin(next))
+}
+
+func (api *API) allowFrom(list func(*network) *cidrList, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := remoteAddr(r)
+		if !onSocket(r) && !list(api.network.Load()).permits(addr) {
+			slog.WarnContext(r.Context(), fmt.Sprintf("Refusing %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr))
+			api.auditRequest(r, audit.Denied, "source address")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// onSocket reports whether r was received on a Unix socket.
+func onSocket(r *http.Request) bool {
+	addr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return addr != nil && addr.Network() == "unix"
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"bws-cache/internal/pkg/auth"
+	c "bws-cache/internal/pkg/config"
+)
+
+func TestPermits(t *testing.T) {
+	list, err := newCIDRList(c.CIDRList{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.9.0.0/16"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr    netip.Addr
+		permits bool
+	}{
+		{netip.MustParseAddr("10.1.2.3"), true},
+		{netip.MustParseAddr("::ffff:10.1.2.3"), true},
+		{netip.MustParseAddr("10.9.2.3"), false},
+		{netip.MustParseAddr("192.168.1.1"), false},
+		{netip.Addr{}, false},
+	}
+	for _, test := range tests {
+		if got := list.permits(test.addr); got != test.permits {
+			t.Errorf("%s: got %t, want %t", test.addr, got, test.permits)
+		}
+	}
+	var empty cidrList
+	if !empty.permits(netip.MustParseAddr("192.168.1.1")) || empty.permits(netip.Addr{}) {
+		t.Error("empty list must permit every valid address and no invalid one")
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	n, err := newNetwork(&c.Config{TrustedProxies: []string{"10.0.0.1/32"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded string
+		want      string
+	}{
+		{"direct", "192.168.1.1:1234", "", "192.168.1.1"},
+		{"untrusted proxy", "192.168.1.1:1234", "1.2.3.4", "192.168.1.1"},
+		{"trusted proxy", "10.0.0.1:1234", "5.6.7.8, 1.2.3.4", "1.2.3.4"},
+		{"through trusted proxies", "10.0.0.1:1234", "1.2.3.4, 10.0.0.1", "1.2.3.4"},
+		{"malformed", "10.0.0.1:1234", "not-an-address", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = test.remote
+			if test.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", test.forwarded)
+			}
+			addr := n.clientAddr(r)
+			if (test.want == "" && addr.IsValid()) || (test.want != "" && addr.String() != test.want) {
+				t.Errorf("got %s, want %q", addr, test.want)
+			}
+		})
+	}
+}
+
+func TestAllowFrom(t *testing.T) {
+	api := &API{}
+	n, err := newNetwork(&c.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.network.Store(n)
+	handler := api.allowSecret(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name   string
+		remote string
+		socket bool
+		code   int
+	}{
+		{"address", "192.168.1.1:1234", false, http.StatusOK},
+		{"unknown", "unknown", false, http.StatusForbidden},
+		{"empty", "", false, http.StatusForbidden},
+		{"socket", "", true, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = test.remote
+			if test.socket {
+				r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, &net.UnixAddr{Name: "/run/bws-cache.sock", Net: "unix"}))
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != test.code {
+				t.Errorf("got %d, want %d", w.Code, test.code)
+			}
+		})
+	}
+}
+
+func TestAllowAdmin(t *testing.T) {
+	adminKeys := []c.AdminKey{{Name: "ops", Key: "admin-key-0005"}}
+	local := c.CIDRList{Allow: []string{"127.0.0.1"}}
+	tests := []struct {
+		name   string
+		keys   []c.AdminKey
+		access c.CIDRList
+		remote string
+		socket bool
+		token  string
+		code   int
+	}{
+		{"unconfigured", nil, c.CIDRList{}, "127.0.0.1:1234", false, "", http.StatusForbidden},
+		{"unconfigured socket", nil, c.CIDRList{}, "", true, "", http.StatusOK},
+		{"allowed address", nil, local, "127.0.0.1:1234", false, "", http.StatusOK},
+		{"other address", nil, local, "192.168.1.1:1234", false, "", http.StatusForbidden},
+		{"key", adminKeys, c.CIDRList{}, "192.168.1.1:1234", false, "admin-key-0005", http.StatusOK},
+		{"no key", adminKeys, c.CIDRList{}, "192.168.1.1:1234", false, "", http.StatusUnauthorized},
+		{"wrong key", adminKeys, c.CIDRList{}, "192.168.1.1:1234", false, "admin-key-0006", http.StatusUnauthorized},
+		{"no key on socket", adminKeys, c.CIDRList{}, "", true, "", http.StatusUnauthorized},
+		{"key from other address", adminKeys, local, "192.168.1.1:1234", false, "admin-key-0005", http.StatusForbidden},
+		{"no key from allowed address", adminKeys, local, "127.0.0.1:1234", false, "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &c.Config{AdminKeys: test.keys, AdminAccess: test.access}
+			api := &API{}
+			n, err := newNetwork(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			api.network.Store(n)
+			authenticator, err := auth.New(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			api.auth.Store(authenticator)
+			handler := api.allowAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			r := httptest.NewRequest(http.MethodGet, "/admin/config", nil)
+			r.RemoteAddr = test.remote
+			if test.socket {
+				r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, &net.UnixAddr{Name: "/run/bws-cache.sock", Net: "unix"}))
+			}
+			if test.token != "" {
+				r.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != test.code {
+				t.Errorf("got %d, want %d", w.Code, test.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+
+	"bws-cache/internal/pkg/audit"
+	"bws-cache/internal/pkg/auth"
+	"bws-cache/internal/pkg/client"
+	"bws-cache/internal/pkg/ratelimit"
+)
+
+// limitKeys returns the keys a request is limited by: the client identity
+// and the fingerprint of the upstream token.
+func limitKeys(identity *auth.Identity) (string, string) {
+	return identity.Kind + ":" + identity.Name, auth.Fingerprint(identity.Token)
+}
+
+// limitUpstream returns r with a guard that charges every call to Bitwarden
+// made for it to the miss budgets and the daily quota.
+func (api *API) limitUpstream(r *http.Request) *http.Request {
+	clientKey, tokenKey := limitKeys(auth.FromContext(r.Context()))
+	ctx := client.WithGuard(r.Context(), func() error {
+		_, err := api.limits.Miss(clientKey, tokenKey)
+		return err
+	})
+	return r.WithContext(ctx)
+}
+
+// limitHit charges a request served from the cache to the hit budgets,
+// writing an error response if one is exhausted.
+func (api *API) limitHit(w http.ResponseWriter, r *http.Request) bool {
+	clientKey, tokenKey := limitKeys(auth.FromContext(r.Context()))
+	err := api.limits.Hit(clientKey, tokenKey)
+	return !api.rateLimited(w, r, err)
+}
+
+// rateLimited writes a 429 response if err is a rate limit error.
+func (api *API) rateLimited(w http.ResponseWriter, r *http.Request, err error) bool {
+	var limited *ratelimit.Error
+	if !errors.As(err, &limited) {
+		return false
+	}
+	identity := auth.FromContext(r.Context())
+	slog.WarnContext(r.Context(), fmt.Sprintf("Rate limited %s: %v", identity.Name, limited))
+	api.Metrics.Counter("rate_limited", map[string]string{"limit": limited.Limit})
+	api.auditRequest(r, audit.Denied, "rate limit: "+limited.Limit)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limited.RetryAfter.Seconds()))))
+	http.Error(w, limited.Error(), http.StatusTooManyRequests)
+	return true
+}
+
+// clientTenant labels the quota of tokens that aren't held by the server.
+const clientTenant = "client"
+
+// recordLimiters records the keys tracked per limit and the daily quota
+// used per token. Tokens held by the server are labelled with their name,
+// client tokens share a label with the most any of them has used, so the
+// labels are bounded by the config.
+func (api *API) recordLimiters() {
+	for _, limiter := range api.limits.Limiters() {
+		api.Metrics.Gauge("rate_limit_buckets", map[string]string{"limit": limiter.Name()}, float64(limiter.Len()))
+	}
+	names := make(map[string]string)
+	used := map[string]int{clientTenant: 0}
+	for name, token := range api.Config().Tokens {
+		names[auth.Fingerprint(token)] = name
+		used[name] = 0
+	}
+	for tokenKey, count := range api.limits.QuotaUsed() {
+		name, ok := names[tokenKey]
+		if !ok {
+			name = clientTenant
+		}
+		used[name] = max(used[name], count)
+	}
+	for name, count := range used {
+		api.Metrics.Gauge("upstream_quota_used", map[string]string{"tenant": name}, float64(count))
+	}
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"bws-cache/internal/pkg/auth"
+	"bws-cache/internal/pkg/sdktest"
+)
+
+func TestQuotaGaugeLabels(t *testing.T) {
+	bw := sdktest.New()
+	id := bw.AddSecret(orgID, "", "db_password", "hunter2-value", "")
+	api, _ := newTestAPI(t, `
+tokens:
+  main: `+serverToken+`
+api_keys:
+  - name: web
+    key: `+apiKey+`
+    token: main
+allow_client_tokens: true
+`, bw)
+
+	for _, token := range []string{apiKey, clientToken, "client-token-0005", "client-token-0006"} {
+		if w := get(t, api, "/id/"+id, token); w.Code != http.StatusOK {
+			t.Fatalf("got %d %s", w.Code, w.Body)
+		}
+	}
+	api.recordLimiters()
+
+	w := get(t, api, "/metrics", "")
+	var lines []string
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, "bws_cache_upstream_quota_used{") {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) != 2 || !strings.Contains(w.Body.String(), `tenant="main"`) || !strings.Contains(w.Body.String(), `tenant="client"`) {
+		t.Errorf("got gauges %q, want one for main and one for client tokens", lines)
+	}
+	if strings.Contains(w.Body.String(), auth.Fingerprint(clientToken)) {
+		t.Error("token fingerprint used as a label")
+	}
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"bws-cache/internal/pkg/auth"
+	"bws-cache/internal/pkg/client"
+	c "bws-cache/internal/pkg/config"
+)
+
+// refreshInterval is the longest between looking for secrets to refresh
+// ahead of expiry.
+const refreshInterval = 10 * time.Second
+
+// gaugeInterval is how often gauges are sampled, see gaugeLoop.
+const gaugeInterval = 15 * time.Second
+
+// backgroundContext returns a context for calls to Bitwarden made with
+// token in the background. They give way to requests, are charged to the
+// daily quota of token and stop once ctx is done.
+func (api *API) backgroundContext(ctx context.Context, token string) context.Context {
+	tokenKey := auth.Fingerprint(token)
+	return client.WithGuard(client.WithBackground(ctx), func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, err := api.limits.Background(tokenKey)
+		return err
+	})
+}
+
+// startBackground prewarms the caches, refreshes secrets ahead of expiry
+// and samples gauges until stopBackground is called.
+func (api *API) startBackground(config *c.Config) {
+	ctx, cancel := context.WithCancel(context.Background())
+	api.cancelBackground = cancel
+	api.background.Add(3)
+	go func() {
+		defer api.background.Done()
+		api.prewarm(ctx, config.Prewarm)
+	}()
+	go func() {
+		defer api.background.Done()
+		api.refreshLoop(ctx)
+	}()
+	go func() {
+		defer api.background.Done()
+		api.gaugeLoop(ctx)
+	}()
+}
+
+// stopBackground stops prewarming and refreshing, waiting for any call to
+// Bitwarden in progress.
+func (api *API) stopBackground() {
+	api.cancelBackground()
+	api.background.Wait()
+}
+
+func (api *API) prewarm(ctx context.Context, prewarms []c.Prewarm) {
+	clients := api.clients()
+	for _, prewarm := range prewarms {
+		profile := prewarm.Profile
+		if profile == "" {
+			profile = DefaultProfile
+		}
+		token := api.Config().Tokens[prewarm.Token]
+		slog.Debug(fmt.Sprintf("Prewarming cache of profile %s with token %s", profile, prewarm.Token))
+		cached, err := clients[profile].Prewarm(api.backgroundContext(ctx, token), token, api.orgID(profile),
+			prewarm.Keys, prewarm.IDs, prewarm.Projects)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Prewarmed %d secrets in profile %s with token %s, some failed: %v", cached, profile, prewarm.Token, err))
+			continue
+		}
+		slog.Info(fmt.Sprintf("Prewarmed %d secrets in profile %s with token %s", cached, profile, prewarm.Token))
+	}
+}
+
+// refreshLoop refreshes secrets read with the server's tokens ahead of
+// expiry, as configured by refresh_ahead.
+func (api *API) refreshLoop(ctx context.Context) {
+	for {
+		interval := refreshInterval
+		if window := api.Config().RefreshAhead.Window; window > 0 && window/2 < interval {
+			interval = max(window/2, time.Second)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		config := api.Config()
+		if config.RefreshAhead.Window <= 0 {
+			continue
+		}
+		for profile, bw := range api.clients() {
+			for name, token := range config.Tokens {
+				refreshed, err := bw.RefreshAhead(api.backgroundContext(ctx, token), token,
+					config.RefreshAhead.Window, int64(config.RefreshAhead.MinHits))
+				if ctx.Err() != nil {
+					return
+				}
+				if err != nil {
+					slog.Warn(fmt.Sprintf("Unable to refresh secrets in profile %s with token %s: %v", profile, name, err))
+				}
+				if refreshed > 0 {
+					slog.Debug(fmt.Sprintf("Refreshed %d secrets in profile %s with token %s", refreshed, profile, name))
+				}
+			}
+		}
+	}
+}
+
+// gaugeLoop samples the gauges every gaugeInterval, rather than on every
+// request.
+func (api *API) gaugeLoop(ctx context.Context) {
+	ticker := time.NewTicker(gaugeInterval)
+	defer ticker.Stop()
+	for {
+		api.recordLimiters()
+		for _, bw := range api.clients() {
+			bw.Cache.RecordGauges()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"bws-cache/internal/pkg/trace"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// traceRequest records a server span per request, continuing the trace in
+// a W3C traceparent header if there is one. Its sampled flag is only
+// followed from trusted proxies.
+func traceRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := trace.StartRemote(r.Context(), r.Method, r.Header, fromTrustedProxy(r))
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer span.Finish()
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("url.path", r.URL.Path)
+		span.SetAttribute("client.address", r.RemoteAddr)
+		span.SetAttribute("request_id", middleware.GetReqID(ctx))
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		if route := chi.RouteContext(ctx).RoutePattern(); route != "" {
+			span.SetName(r.Method + " " + route)
+			span.SetAttribute("http.route", route)
+		}
+		span.SetAttribute("http.response.status_code", ww.Status())
+		if ww.Status() >= http.StatusInternalServerError {
+			span.SetError(fmt.Errorf("%d %s", ww.Status(), http.StatusText(ww.Status())))
+		}
+	})
+}
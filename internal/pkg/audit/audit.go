@@ -0,0 +1,220 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"sync"
+	"time"
+
+	c "bws-cache/internal/pkg/config"
+)
+
+const (
+	Read       = "read"
+	Invalidate = "invalidate"
+)
+
+const (
+	Allowed = "allowed"
+	Denied  = "denied"
+	Error   = "error"
+)
+
+const (
+	Hit  = "hit"
+	Miss = "miss"
+)
+
+// Event is one audit record. It never contains a secret value or token.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	RequestID string    `json:"request_id,omitempty"`
+	Caller    *Caller   `json:"caller,omitempty"`
+	Addr      string    `json:"addr,omitempty"`
+	Profile   string    `json:"profile,omitempty"`
+	SecretID  string    `json:"secret_id,omitempty"`
+	Key       string    `json:"key,omitempty"`
+	ProjectID string    `json:"project_id,omitempty"`
+	Cache     string    `json:"cache,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Reason    string    `json:"reason,omitempty"`
+	// PrevHash and Hash chain entries together when hash chaining is
+	// enabled, see Verify.
+	PrevHash string `json:"prev_hash,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+type Caller struct {
+	Kind        string   `json:"kind"`
+	Name        string   `json:"name"`
+	Subject     string   `json:"subject,omitempty"`
+	Fingerprint string   `json:"fingerprint"`
+	Certificate string   `json:"certificate,omitempty"`
+	SANs        []string `json:"sans,omitempty"`
+	Peer        string   `json:"peer,omitempty"`
+}
+
+// Logger writes events as JSON lines. A nil Logger discards them.
+type Logger struct {
+	mu     sync.Mutex
+	out    io.WriteCloser
+	chain  bool
+	prev   string
+	closed bool
+}
+
+// New opens the audit output set in config, or returns nil if auditing is
+// disabled.
+func New(config c.Audit) (*Logger, error) {
+	logger := Logger{chain: config.HashChain}
+	switch config.Output {
+	case "":
+		return nil, nil
+	case "stdout":
+		logger.out = nopCloser{os.Stdout}
+	case "syslog":
+		writer, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, "bws-cache")
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to syslog: %w", err)
+		}
+		logger.out = writer
+	default:
+		if config.HashChain {
+			prev, err := lastHash(config.Output)
+			if err != nil {
+				return nil, err
+			}
+			logger.prev = prev
+		}
+		file, err := openRotating(config.Output, int64(config.MaxSize)<<20, config.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		logger.out = file
+	}
+	return &logger, nil
+}
+
+func (l *Logger) Log(event Event) {
+	if l == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	if l.chain {
+		event.PrevHash = l.prev
+		event.Hash = hash(event)
+		l.prev = event.Hash
+	}
+	line, _ := json.Marshal(event)
+	if _, err := l.out.Write(append(line, '\n')); err != nil {
+		slog.Error(fmt.Sprintf("Unable to write audit event: %v", err))
+	}
+}
+
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	return l.out.Close()
+}
+
+// hash is the SHA-256 of the event without its own hash, which includes the
+// hash of the previous event.
+func hash(event Event) string {
+	event.Hash = ""
+	data, _ := json.Marshal(event)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Verify checks the hash chain of the events read from r, starting from the
+// hash prev of the event before them, and returns the number of events and
+// the hash of the last one. The error names the first line that doesn't
+// chain, which has been altered, removed or reordered.
+func Verify(r io.Reader, prev string) (int, string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	count := 0
+	for scanner.Scan() {
+		count++
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return count, prev, fmt.Errorf("line %d: %w", count, err)
+		}
+		if event.Hash == "" {
+			return count, prev, fmt.Errorf("line %d: not hash chained", count)
+		}
+		if prev != "" && event.PrevHash != prev {
+			return count, prev, fmt.Errorf("line %d: does not follow the previous entry", count)
+		}
+		if hash(event) != event.Hash {
+			return count, prev, fmt.Errorf("line %d: hash does not match contents", count)
+		}
+		prev = event.Hash
+	}
+	return count, prev, scanner.Err()
+}
+
+// lastHash returns the hash of the last event written to file, or to the
+// newest file it was rotated to if it has none yet, so a restarted server
+// continues its chain.
+func lastHash(file string) (string, error) {
+	prev, err := lastHashIn(file)
+	if prev != "" || err != nil {
+		return prev, err
+	}
+	rotated, err := backups(file)
+	if err != nil || len(rotated) == 0 {
+		return "", err
+	}
+	return lastHashIn(rotated[len(rotated)-1])
+}
+
+func lastHashIn(file string) (string, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	prev := ""
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var event Event
+		if json.Unmarshal(scanner.Bytes(), &event) == nil {
+			prev = event.Hash
+		}
+	}
+	return prev, scanner.Err()
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,124 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	c "bws-cache/internal/pkg/config"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+func (failingWriter) Close() error              { return nil }
+
+type buffer struct{ bytes.Buffer }
+
+func (*buffer) Close() error { return nil }
+
+func TestLogWriteError(t *testing.T) {
+	var out bytes.Buffer
+	logger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&out, nil)))
+	t.Cleanup(func() { slog.SetDefault(logger) })
+
+	l := Logger{out: failingWriter{}}
+	l.Log(Event{Action: Read, Outcome: Allowed})
+	if !strings.Contains(out.String(), "level=ERROR") || !strings.Contains(out.String(), "disk full") {
+		t.Errorf("got log %q, want the write error", out.String())
+	}
+}
+
+func TestVerify(t *testing.T) {
+	var out buffer
+	l := Logger{out: &out, chain: true}
+	for _, key := range []string{"a", "b", "c"} {
+		l.Log(Event{Action: Read, Key: key, Outcome: Allowed})
+	}
+	lines := strings.SplitAfter(strings.TrimSpace(out.String()), "\n")
+
+	tests := []struct {
+		name  string
+		input string
+		valid bool
+	}{
+		{"intact", strings.Join(lines, ""), true},
+		{"removed", lines[0] + lines[2], false},
+		{"reordered", lines[1] + lines[0] + lines[2], false},
+		{"altered", strings.Replace(strings.Join(lines, ""), `"key":"b"`, `"key":"x"`, 1), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			count, _, err := Verify(strings.NewReader(test.input), "")
+			if (err == nil) != test.valid {
+				t.Errorf("got %d events, error %v, want valid %t", count, err, test.valid)
+			}
+		})
+	}
+}
+
+func TestChainContinuesAfterRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	config := c.Audit{Output: path, HashChain: true}
+	l, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Log(Event{Action: Read, Key: "a", Outcome: Allowed})
+	l.Close()
+	// Restarting right after a rotation finds the current file empty.
+	backup := path + ".20260101T000000.000000000"
+	if err := os.Rename(path, backup); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if l, err = New(config); err != nil {
+		t.Fatal(err)
+	}
+	l.Log(Event{Action: Read, Key: "b", Outcome: Allowed})
+	l.Close()
+
+	prev := ""
+	for _, file := range []string{backup, path} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, prev, err = Verify(bytes.NewReader(data), prev); err != nil {
+			t.Errorf("%s: %v", filepath.Base(file), err)
+		}
+	}
+}
+
+func TestRotateFailureKeepsWriting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	r, err := openRotating(path, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := r.Write([]byte("first line\n")); err != nil {
+		t.Fatal(err)
+	}
+	// Renaming a file that was removed fails.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Write([]byte("second line\n")); err != nil {
+		t.Fatalf("write after a failed rotation: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "second line\n" {
+		t.Errorf("got %q, want the line written after the failed rotation", data)
+	}
+}
@@ -0,0 +1,101 @@
+package audit
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// rotatingFile renames the file aside once it reaches maxSize bytes and
+// keeps the newest maxBackups of the renamed files. A maxSize of 0 never
+// rotates and a maxBackups of 0 keeps every file.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotating(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		// The file is still open unless reopening it failed, so keep
+		// writing to it and try again on the next write.
+		if err := r.rotate(); err != nil {
+			slog.Error(err.Error())
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate renames the file aside and opens a new one. If renaming fails the
+// file is opened again, so events are still written to it.
+func (r *rotatingFile) rotate() error {
+	r.file.Close()
+	backup := r.path + "." + time.Now().UTC().Format("20060102T150405.000000000")
+	if err := os.Rename(r.path, backup); err != nil {
+		if err := r.open(); err != nil {
+			return err
+		}
+		return fmt.Errorf("unable to rotate audit log: %w", err)
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	if r.maxBackups == 0 {
+		return nil
+	}
+	backups, err := backups(r.path)
+	if err != nil {
+		return err
+	}
+	for len(backups) > r.maxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// backups returns the files path was rotated to, oldest first.
+func backups(path string) ([]string, error) {
+	backups, err := filepath.Glob(path + ".[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	// The timestamp suffix sorts oldest first.
+	sort.Strings(backups)
+	return backups, nil
+}
+
+func (r *rotatingFile) Close() error {
+	return r.file.Close()
+}
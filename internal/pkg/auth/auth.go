@@ -0,0 +1,328 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	c "bws-cache/internal/pkg/config"
+	"bws-cache/internal/pkg/redact"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	KindToken    = "token"
+	KindAPIKey   = "api_key"
+	KindAdminKey = "admin_key"
+)
+
+var (
+	ErrNoToken         = errors.New("No token or invalid token sent")
+	ErrUnknownToken    = errors.New("Unknown API key")
+	ErrUnknownAdminKey = errors.New("Unknown admin key")
+)
+
+// Identity is the authenticated caller of a request.
+type Identity struct {
+	Kind string
+	// Name identifies the caller in logs, it never contains a token.
+	Name string
+	// Subject is the sub claim of a JWT.
+	Subject string
+	// Fingerprint is a short hash of the credential presented.
+	Fingerprint string
+	// Token is the access token sent upstream on behalf of the caller.
+	Token string
+	// Scope restricts what the caller may read, nil means unrestricted.
+	Scope *Scope
+	// Certificate is the verified TLS client certificate, if one was sent.
+	Certificate *Certificate
+	// Peer is the process connected over the Unix socket, if any.
+	Peer *Peer
+}
+
+// Certificate identifies a verified TLS client certificate.
+type Certificate struct {
+	Subject string
+	// SANs are the DNS names, email addresses, IP addresses and URIs of the
+	// certificate.
+	SANs []string
+}
+
+// Names returns the subject followed by the SANs.
+func (c *Certificate) Names() []string {
+	if c == nil {
+		return nil
+	}
+	return append([]string{c.Subject}, c.SANs...)
+}
+
+// Scope is the allowlist attached to a local API key. An empty list allows
+// everything.
+type Scope struct {
+	Keys     []string
+	Projects []string
+	Methods  []string
+}
+
+type apiKey struct {
+	name  string
+	hash  []byte
+	token string
+	scope *Scope
+}
+
+type Authenticator struct {
+	apiKeys           []apiKey
+	adminKeys         []apiKey
+	peers             []peerMapping
+	jwt               *jwtVerifier
+	allowClientTokens bool
+}
+
+type contextKey struct{}
+
+// Fingerprint returns a short, non-reversible identifier for a credential.
+func Fingerprint(credential string) string {
+	sum := sha256.Sum256([]byte(credential))
+	return hex.EncodeToString(sum[:8])
+}
+
+// HashKey returns the hex SHA-256 of a local API key, as used by key_sha256.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateKey returns a new random local API key.
+func GenerateKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return "bwsc_" + base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+func New(config *c.Config) (*Authenticator, error) {
+	authenticator := Authenticator{allowClientTokens: config.AllowClientTokens}
+	for _, token := range config.Tokens {
+		redact.Add(token)
+	}
+	for _, key := range config.APIKeys {
+		decoded, err := keyHash(key.Key, key.KeySHA256)
+		if err != nil {
+			return nil, fmt.Errorf("api key %s: %w", key.Name, err)
+		}
+		token, ok := config.Tokens[key.Token]
+		if !ok {
+			return nil, fmt.Errorf("api key %s: unknown token %q", key.Name, key.Token)
+		}
+		authenticator.apiKeys = append(authenticator.apiKeys, apiKey{
+			name:  key.Name,
+			hash:  decoded,
+			token: token,
+			scope: newScope(key.Scope),
+		})
+	}
+	for _, key := range config.AdminKeys {
+		decoded, err := keyHash(key.Key, key.KeySHA256)
+		if err != nil {
+			return nil, fmt.Errorf("admin key %s: %w", key.Name, err)
+		}
+		authenticator.adminKeys = append(authenticator.adminKeys, apiKey{name: key.Name, hash: decoded})
+	}
+	for _, peer := range config.Peers {
+		mapping, err := newPeerMapping(peer, config.Tokens)
+		if err != nil {
+			return nil, err
+		}
+		authenticator.peers = append(authenticator.peers, mapping)
+	}
+	if config.JWT.Enabled() {
+		verifier, err := newJWTVerifier(config)
+		if err != nil {
+			return nil, err
+		}
+		authenticator.jwt = verifier
+	}
+	return &authenticator, nil
+}
+
+// keyHash returns the SHA-256 of a local key given as is or by its hex
+// encoded hash. A key given as is is registered for redaction.
+func keyHash(key string, keySHA256 string) ([]byte, error) {
+	hash := keySHA256
+	if key != "" {
+		redact.Add(key)
+		hash = HashKey(key)
+	}
+	decoded, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key_sha256: %w", err)
+	}
+	return decoded, nil
+}
+
+func newScope(scope c.Scope) *Scope {
+	return &Scope{
+		Keys:     scope.Keys,
+		Projects: scope.Projects,
+		Methods:  scope.Methods,
+	}
+}
+
+// Authenticate identifies the caller from the bearer token in the request. A
+// registered local API key or a JWT that verifies is swapped for the
+// upstream token it maps to, anything else is treated as a BWS access token
+// if client tokens are allowed. Without a token, a caller on the Unix socket
+// is identified by its peer credentials.
+func (a *Authenticator) Authenticate(r *http.Request) (*Identity, error) {
+	peer := PeerFromContext(r.Context())
+	identity, err := a.authenticate(r)
+	if errors.Is(err, ErrNoToken) && peer != nil {
+		identity, err = a.authenticatePeer(peer)
+	}
+	if err != nil {
+		return nil, err
+	}
+	identity.Certificate = clientCertificate(r)
+	identity.Peer = peer
+	return identity, nil
+}
+
+func (a *Authenticator) authenticate(r *http.Request) (*Identity, error) {
+	token, err := bearerToken(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tokens are only registered for redaction once they've authenticated,
+	// client tokens once they have logged in upstream.
+	hash := sha256.Sum256([]byte(token))
+	for _, key := range a.apiKeys {
+		if subtle.ConstantTimeCompare(hash[:], key.hash) == 1 {
+			redact.Add(token)
+			return &Identity{
+				Kind:        KindAPIKey,
+				Name:        key.name,
+				Fingerprint: Fingerprint(token),
+				Token:       key.token,
+				Scope:       key.scope,
+			}, nil
+		}
+	}
+
+	if a.jwt != nil && isJWT(token) {
+		identity, err := a.jwt.authenticate(token)
+		if err == nil {
+			redact.AddToken(token)
+		}
+		return identity, err
+	}
+
+	if !a.allowClientTokens {
+		return nil, ErrUnknownToken
+	}
+	fingerprint := Fingerprint(token)
+	return &Identity{
+		Kind:        KindToken,
+		Name:        fingerprint,
+		Fingerprint: fingerprint,
+		Token:       token,
+	}, nil
+}
+
+// clientCertificate returns the client certificate of the request if it
+// was verified against the client CAs.
+func clientCertificate(r *http.Request) *Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	certificate := Certificate{Subject: cert.Subject.String()}
+	certificate.SANs = append(certificate.SANs, cert.DNSNames...)
+	certificate.SANs = append(certificate.SANs, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		certificate.SANs = append(certificate.SANs, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		certificate.SANs = append(certificate.SANs, uri.String())
+	}
+	return &certificate
+}
+
+// HasAdminKeys reports whether admin keys are configured.
+func (a *Authenticator) HasAdminKeys() bool {
+	return len(a.adminKeys) > 0
+}
+
+// AuthenticateAdmin identifies the caller of an admin endpoint from the admin
+// key sent as the bearer token.
+func (a *Authenticator) AuthenticateAdmin(r *http.Request) (*Identity, error) {
+	token, err := bearerToken(r)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(token))
+	for _, key := range a.adminKeys {
+		if subtle.ConstantTimeCompare(hash[:], key.hash) == 1 {
+			redact.Add(token)
+			return &Identity{
+				Kind:        KindAdminKey,
+				Name:        key.name,
+				Fingerprint: Fingerprint(token),
+				Certificate: clientCertificate(r),
+				Peer:        PeerFromContext(r.Context()),
+			}, nil
+		}
+	}
+	return nil, ErrUnknownAdminKey
+}
+
+func bearerToken(r *http.Request) (string, error) {
+	prefix := "Bearer "
+	authHeader := r.Header.Get("Authorization")
+	reqToken := strings.TrimPrefix(authHeader, prefix)
+	if authHeader == "" || reqToken == "" {
+		return "", ErrNoToken
+	}
+	return reqToken, nil
+}
+
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, identity)
+}
+
+func FromContext(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(contextKey{}).(*Identity)
+	return identity
+}
+
+func (s *Scope) AllowMethod(method string) bool {
+	return s == nil || len(s.Methods) == 0 || slices.Contains(s.Methods, method)
+}
+
+func (s *Scope) AllowKey(key string) bool {
+	if s == nil || len(s.Keys) == 0 {
+		return true
+	}
+	for _, pattern := range s.Keys {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Scope) AllowProject(projectID string) bool {
+	return s == nil || len(s.Projects) == 0 || slices.Contains(s.Projects, projectID)
+}
@@ -0,0 +1,342 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	c "bws-cache/internal/pkg/config"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/pkg/errors"
+)
+
+const KindJWT = "jwt"
+
+// clockSkew is how far exp, nbf and iat may be off to allow for clock drift.
+const clockSkew = time.Minute
+
+// minRSABits is the smallest RSA key accepted from a JWKS.
+const minRSABits = 2048
+
+// jwksRetry is how soon a JWKS URL is fetched again after a failed fetch or
+// when a JWT names an unknown key.
+const jwksRetry = time.Minute
+
+var ErrInvalidJWT = errors.New("Invalid JWT")
+
+// algorithms are the signature algorithms accepted, with the curve each
+// ECDSA algorithm is bound to.
+var algorithms = map[jose.SignatureAlgorithm]elliptic.Curve{
+	jose.RS256: nil, jose.RS384: nil, jose.RS512: nil,
+	jose.PS256: nil, jose.PS384: nil, jose.PS512: nil,
+	jose.ES256: elliptic.P256(), jose.ES384: elliptic.P384(), jose.ES512: elliptic.P521(),
+	jose.EdDSA: nil,
+}
+
+type jwtVerifier struct {
+	config   c.JWT
+	mappings []jwtMapping
+	keys     *keySet
+	algs     []jose.SignatureAlgorithm
+}
+
+type jwtMapping struct {
+	name   string
+	claims map[string]string
+	token  string
+	scope  *Scope
+}
+
+// keySet holds the public keys from a JWKS file or URL. Keys from a URL are
+// fetched in the background, every refresh interval or sooner when a JWT
+// names an unknown key, so requests never wait for the fetch.
+type keySet struct {
+	file    string
+	url     string
+	refresh time.Duration
+	keys    atomic.Pointer[jose.JSONWebKeySet]
+	// mu guards fetchedAt, fetching is set while a fetch runs.
+	mu        sync.Mutex
+	fetchedAt time.Time
+	fetching  bool
+}
+
+func newJWTVerifier(config *c.Config) (*jwtVerifier, error) {
+	refresh := config.JWT.JWKSRefresh
+	if refresh == 0 {
+		refresh = time.Hour
+	}
+	verifier := jwtVerifier{
+		config: config.JWT,
+		keys: &keySet{
+			file:    config.JWT.JWKSFile,
+			url:     config.JWT.JWKSURL,
+			refresh: refresh,
+		},
+	}
+	for alg := range algorithms {
+		verifier.algs = append(verifier.algs, alg)
+	}
+	for _, mapping := range config.JWT.Mappings {
+		token, ok := config.Tokens[mapping.Token]
+		if !ok {
+			return nil, fmt.Errorf("jwt mapping %s: unknown token %q", mapping.Name, mapping.Token)
+		}
+		verifier.mappings = append(verifier.mappings, jwtMapping{
+			name:   mapping.Name,
+			claims: mapping.Claims,
+			token:  token,
+			scope:  newScope(mapping.Scope),
+		})
+	}
+	if verifier.keys.file != "" {
+		if err := verifier.keys.load(); err != nil {
+			return nil, err
+		}
+	} else {
+		verifier.keys.keys.Store(&jose.JSONWebKeySet{})
+		verifier.keys.refreshAsync(time.Now())
+	}
+	return &verifier, nil
+}
+
+// isJWT reports whether token looks like a compact serialized JWS rather than
+// a BWS access token.
+func isJWT(token string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	return err == nil && bytes.HasPrefix(bytes.TrimSpace(header), []byte("{"))
+}
+
+// authenticate verifies a JWT and maps its claims to an identity.
+func (v *jwtVerifier) authenticate(token string) (*Identity, error) {
+	claims, err := v.verify(token, time.Now())
+	if err != nil {
+		slog.Debug(fmt.Sprintf("JWT rejected: %v", err))
+		return nil, ErrInvalidJWT
+	}
+
+	subject, _ := claims["sub"].(string)
+	for _, mapping := range v.mappings {
+		if !matchClaims(claims, mapping.claims) {
+			continue
+		}
+		return &Identity{
+			Kind:        KindJWT,
+			Name:        mapping.name,
+			Subject:     subject,
+			Fingerprint: Fingerprint(v.config.Issuer + " " + subject),
+			Token:       mapping.token,
+			Scope:       mapping.scope,
+		}, nil
+	}
+	slog.Debug(fmt.Sprintf("No JWT mapping for subject %s", subject))
+	return nil, ErrUnknownToken
+}
+
+// verify checks the signature, issuer, audience and validity period of a JWT
+// and returns its claims.
+func (v *jwtVerifier) verify(token string, now time.Time) (map[string]any, error) {
+	parsed, err := jwt.ParseSigned(token, v.algs)
+	if err != nil {
+		return nil, err
+	}
+	header := parsed.Headers[0]
+	key, err := v.keys.get(header.KeyID, now)
+	if err != nil {
+		return nil, err
+	}
+	alg := jose.SignatureAlgorithm(header.Algorithm)
+	if curve := algorithms[alg]; curve != nil {
+		if ec, ok := key.Key.(*ecdsa.PublicKey); !ok || ec.Curve != curve {
+			return nil, fmt.Errorf("key %q does not match alg %s", header.KeyID, alg)
+		}
+	}
+
+	var standard jwt.Claims
+	var raw json.RawMessage
+	if err := parsed.Claims(key.Key, &standard, &raw); err != nil {
+		return nil, err
+	}
+	if standard.Issuer != v.config.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", standard.Issuer)
+	}
+	if standard.Expiry == nil {
+		return nil, errors.New("missing exp")
+	}
+	if err := standard.ValidateWithLeeway(jwt.Expected{AnyAudience: v.config.Audiences, Time: now}, clockSkew); err != nil {
+		return nil, err
+	}
+
+	claims := make(map[string]any)
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %w", err)
+	}
+	return claims, nil
+}
+
+// matchClaims reports whether every claim path in patterns has a value
+// matching its glob. A list claim matches if any of its items do.
+func matchClaims(claims map[string]any, patterns map[string]string) bool {
+	for claimPath, pattern := range patterns {
+		values := claimValues(claims, strings.Split(claimPath, "/"))
+		if !slices.ContainsFunc(values, func(value string) bool {
+			ok, _ := path.Match(pattern, value)
+			return ok
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// claimValues returns the values of the claim at claimPath. Names are
+// matched exactly.
+func claimValues(claims map[string]any, claimPath []string) []string {
+	var value any = claims
+	for _, segment := range claimPath {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		if value, ok = object[segment]; !ok {
+			return nil
+		}
+	}
+
+	switch value := value.(type) {
+	case []any:
+		result := make([]string, 0, len(value))
+		for _, item := range value {
+			result = append(result, fmt.Sprint(item))
+		}
+		return result
+	case map[string]any, nil:
+		return nil
+	default:
+		return []string{fmt.Sprint(value)}
+	}
+}
+
+// get returns the key with kid, or the only key if kid is empty. An unknown
+// kid fetches the keys from a URL again in the background.
+func (s *keySet) get(kid string, now time.Time) (*jose.JSONWebKey, error) {
+	keys := s.keys.Load()
+	if s.url != "" {
+		s.mu.Lock()
+		stale := now.Sub(s.fetchedAt) > s.refresh
+		s.mu.Unlock()
+		if stale || (len(keys.Key(kid)) == 0 && kid != "") {
+			s.refreshAsync(now)
+		}
+	}
+
+	if found := keys.Key(kid); len(found) > 0 {
+		return &found[0], nil
+	}
+	if kid == "" && len(keys.Keys) == 1 {
+		return &keys.Keys[0], nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// refreshAsync fetches the keys from the URL in the background, unless a
+// fetch is already running or one was started within jwksRetry.
+func (s *keySet) refreshAsync(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fetching || (!s.fetchedAt.IsZero() && now.Sub(s.fetchedAt) < jwksRetry) {
+		return
+	}
+	s.fetching = true
+	s.fetchedAt = now
+	go func() {
+		err := s.fetch()
+		s.mu.Lock()
+		s.fetching = false
+		s.mu.Unlock()
+		if err != nil {
+			slog.Error(fmt.Sprintf("Unable to fetch JWKS: %v", err))
+		}
+	}()
+}
+
+func (s *keySet) load() error {
+	data, err := os.ReadFile(s.file)
+	if err != nil {
+		return fmt.Errorf("unable to read jwks file: %w", err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("unable to parse jwks file: %w", err)
+	}
+	s.keys.Store(keys)
+	return nil
+}
+
+func (s *keySet) fetch() error {
+	client := http.Client{Timeout: 10 * time.Second}
+	res, err := client.Get(s.url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	s.keys.Store(keys)
+	return nil
+}
+
+// parseJWKS parses the public signing keys in a JWKS. Keys for other uses
+// are skipped, weak or private keys are rejected.
+func parseJWKS(data []byte) (*jose.JSONWebKeySet, error) {
+	var jwks jose.JSONWebKeySet
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := jose.JSONWebKeySet{}
+	for _, key := range jwks.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		if !key.IsPublic() || !key.Valid() {
+			return nil, fmt.Errorf("key %q: not a valid public key", key.KeyID)
+		}
+		if rsaKey, ok := key.Key.(*rsa.PublicKey); ok && rsaKey.N.BitLen() < minRSABits {
+			return nil, fmt.Errorf("key %q: RSA key is shorter than %d bits", key.KeyID, minRSABits)
+		}
+		keys.Keys = append(keys.Keys, key)
+	}
+	return &keys, nil
+}
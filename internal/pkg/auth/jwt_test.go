@@ -0,0 +1,324 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	c "bws-cache/internal/pkg/config"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+const (
+	issuer   = "https://kubernetes.default.svc"
+	audience = "bws-cache"
+)
+
+// testKeys are signing keys, by kid, published in a local JWKS.
+type testKeys map[string]crypto.Signer
+
+func newTestKeys(t *testing.T) testKeys {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	_, ed, _ := ed25519.GenerateKey(rand.Reader)
+	return testKeys{"rsa": rsaKey, "p256": p256, "p384": p384, "ed": ed}
+}
+
+// writeJWKS writes the public keys to a JWKS file and returns its path.
+func (keys testKeys) writeJWKS(t *testing.T) string {
+	t.Helper()
+	var jwks jose.JSONWebKeySet
+	for kid, key := range keys {
+		jwks.Keys = append(jwks.Keys, jose.JSONWebKey{Key: key.Public(), KeyID: kid, Use: "sig"})
+	}
+	return writeFile(t, jwks)
+}
+
+func writeFile(t *testing.T, v any) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func (keys testKeys) sign(t *testing.T, kid string, alg jose.SignatureAlgorithm, claims any) string {
+	t.Helper()
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: alg, Key: jose.JSONWebKey{Key: keys[kid], KeyID: kid}},
+		(&jose.SignerOptions{}).WithType("JWT"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func claims(now time.Time, extra map[string]any) map[string]any {
+	result := map[string]any{
+		"iss": issuer,
+		"aud": []string{audience},
+		"sub": "system:serviceaccount:billing:app",
+		"exp": now.Add(time.Hour).Unix(),
+		"iat": now.Unix(),
+		"kubernetes.io": map[string]any{
+			"namespace":      "billing",
+			"serviceaccount": map[string]any{"name": "app"},
+		},
+	}
+	for name, value := range extra {
+		if value == nil {
+			delete(result, name)
+			continue
+		}
+		result[name] = value
+	}
+	return result
+}
+
+func newTestVerifier(t *testing.T, jwksFile string) *jwtVerifier {
+	t.Helper()
+	verifier, err := newJWTVerifier(&c.Config{
+		Tokens: map[string]string{"billing": "bws-billing-token"},
+		JWT: c.JWT{
+			JWKSFile:  jwksFile,
+			Issuer:    issuer,
+			Audiences: []string{audience},
+			Mappings: []c.JWTMapping{{
+				Name:   "billing",
+				Claims: map[string]string{"kubernetes.io/namespace": "billing", "kubernetes.io/serviceaccount/name": "app*"},
+				Token:  "billing",
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return verifier
+}
+
+func TestJWTVerify(t *testing.T) {
+	keys := newTestKeys(t)
+	verifier := newTestVerifier(t, keys.writeJWKS(t))
+	now := time.Now()
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"RS256", keys.sign(t, "rsa", jose.RS256, claims(now, nil)), true},
+		{"PS384", keys.sign(t, "rsa", jose.PS384, claims(now, nil)), true},
+		{"ES256", keys.sign(t, "p256", jose.ES256, claims(now, nil)), true},
+		{"ES384", keys.sign(t, "p384", jose.ES384, claims(now, nil)), true},
+		{"EdDSA", keys.sign(t, "ed", jose.EdDSA, claims(now, nil)), true},
+		{"expired within skew", keys.sign(t, "rsa", jose.RS256, claims(now, map[string]any{"exp": now.Add(-30 * time.Second).Unix()})), true},
+		{"expired", keys.sign(t, "rsa", jose.RS256, claims(now, map[string]any{"exp": now.Add(-time.Hour).Unix()})), false},
+		{"missing exp", keys.sign(t, "rsa", jose.RS256, claims(now, map[string]any{"exp": nil})), false},
+		{"not yet valid", keys.sign(t, "rsa", jose.RS256, claims(now, map[string]any{"nbf": now.Add(time.Hour).Unix()})), false},
+		{"issued in the future", keys.sign(t, "rsa", jose.RS256, claims(now, map[string]any{"iat": now.Add(time.Hour).Unix()})), false},
+		{"wrong issuer", keys.sign(t, "rsa", jose.RS256, claims(now, map[string]any{"iss": "https://evil.example"})), false},
+		{"wrong audience", keys.sign(t, "rsa", jose.RS256, claims(now, map[string]any{"aud": "other"})), false},
+		{"single audience", keys.sign(t, "rsa", jose.RS256, claims(now, map[string]any{"aud": audience})), true},
+		{"tampered", tamper(keys.sign(t, "rsa", jose.RS256, claims(now, nil))), false},
+		{"unsigned", unsigned(claims(now, nil)), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := verifier.verify(test.token, now)
+			if (err == nil) != test.valid {
+				t.Errorf("got error %v, want valid %t", err, test.valid)
+			}
+		})
+	}
+
+	t.Run("unknown key", func(t *testing.T) {
+		other := newTestKeys(t)
+		token := other.sign(t, "rsa", jose.RS256, claims(now, nil))
+		// Same kid, different key.
+		if _, err := verifier.verify(token, now); err == nil {
+			t.Error("verified a JWT signed with an unknown key")
+		}
+		if _, err := verifier.verify(keys.signAs(t, "p256", "unknown", jose.ES256, claims(now, nil)), now); err == nil {
+			t.Error("verified a JWT with an unknown kid")
+		}
+	})
+
+	t.Run("curve bound to alg", func(t *testing.T) {
+		// ES256 header naming a P-384 key.
+		token := keys.signAs(t, "p256", "p384", jose.ES256, claims(now, nil))
+		if _, err := verifier.verify(token, now); err == nil {
+			t.Error("verified ES256 against a P-384 key")
+		}
+	})
+}
+
+// signAs signs with the key kid but names the key as header kid.
+func (keys testKeys) signAs(t *testing.T, kid string, headerKid string, alg jose.SignatureAlgorithm, claims any) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: jose.JSONWebKey{Key: keys[kid], KeyID: headerKid}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func tamper(token string) string {
+	parts := strings.Split(token, ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	payload = []byte(strings.Replace(string(payload), "billing", "payroll", 1))
+	parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+	return strings.Join(parts, ".")
+}
+
+func unsigned(claims any) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	payload, _ := json.Marshal(claims)
+	return header + "." + base64.RawURLEncoding.EncodeToString(payload) + "."
+}
+
+func TestJWTAuthenticate(t *testing.T) {
+	keys := newTestKeys(t)
+	verifier := newTestVerifier(t, keys.writeJWKS(t))
+	now := time.Now()
+
+	identity, err := verifier.authenticate(keys.sign(t, "rsa", jose.RS256, claims(now, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Kind != KindJWT || identity.Name != "billing" || identity.Token != "bws-billing-token" {
+		t.Errorf("got identity %+v", identity)
+	}
+
+	tests := []struct {
+		name  string
+		extra map[string]any
+	}{
+		{"other namespace", map[string]any{"kubernetes.io": map[string]any{"namespace": "web", "serviceaccount": map[string]any{"name": "app"}}}},
+		{"claim names are case sensitive", map[string]any{"kubernetes.io": nil, "Kubernetes.io": map[string]any{"namespace": "billing", "serviceaccount": map[string]any{"name": "app"}}}},
+		{"missing claim", map[string]any{"kubernetes.io": map[string]any{"namespace": "billing"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := verifier.authenticate(keys.sign(t, "rsa", jose.RS256, claims(now, test.extra)))
+			if !errors.Is(err, ErrUnknownToken) {
+				t.Errorf("got error %v, want %v", err, ErrUnknownToken)
+			}
+		})
+	}
+}
+
+func TestMatchClaims(t *testing.T) {
+	claims := map[string]any{
+		"groups": []any{"dev", "ops"},
+		"uid":    json.Number("12345678901234"),
+		"nested": map[string]any{"name": "app"},
+	}
+	tests := []struct {
+		patterns map[string]string
+		match    bool
+	}{
+		{map[string]string{"groups": "ops"}, true},
+		{map[string]string{"groups": "admin"}, false},
+		{map[string]string{"uid": "12345678901234"}, true},
+		{map[string]string{"nested/name": "a*"}, true},
+		{map[string]string{"nested": "*"}, false},
+		{map[string]string{"Nested/name": "app"}, false},
+		{map[string]string{"groups": "dev", "nested/name": "other"}, false},
+	}
+	for _, test := range tests {
+		if got := matchClaims(claims, test.patterns); got != test.match {
+			t.Errorf("matchClaims(%v) = %t, want %t", test.patterns, got, test.match)
+		}
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	weak, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strong, _ := rsa.GenerateKey(rand.Reader, 2048)
+	tests := []struct {
+		name  string
+		keys  []jose.JSONWebKey
+		valid bool
+	}{
+		{"public keys", []jose.JSONWebKey{{Key: strong.Public(), KeyID: "a"}}, true},
+		{"weak RSA key", []jose.JSONWebKey{{Key: weak.Public(), KeyID: "a"}}, false},
+		{"private key", []jose.JSONWebKey{{Key: strong, KeyID: "a"}}, false},
+		{"encryption key skipped", []jose.JSONWebKey{{Key: weak.Public(), KeyID: "a", Use: "enc"}}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, _ := json.Marshal(jose.JSONWebKeySet{Keys: test.keys})
+			_, err := parseJWKS(data)
+			if (err == nil) != test.valid {
+				t.Errorf("got error %v, want valid %t", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestJWKSURL(t *testing.T) {
+	keys := newTestKeys(t)
+	jwks, err := os.ReadFile(keys.writeJWKS(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jwks)
+	}))
+	defer server.Close()
+
+	verifier, err := newJWTVerifier(&c.Config{JWT: c.JWT{JWKSURL: server.URL, Issuer: issuer, Audiences: []string{audience}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := keys.sign(t, "rsa", jose.RS256, claims(time.Now(), nil))
+	// The keys are fetched in the background.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := verifier.verify(token, time.Now())
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("keys not fetched: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
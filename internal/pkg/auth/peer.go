@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	c "bws-cache/internal/pkg/config"
+)
+
+const KindPeer = "peer"
+
+// Peer is the process on the other end of a Unix socket connection, as
+// reported by the kernel.
+type Peer struct {
+	UID uint32
+	GID uint32
+	PID int32
+}
+
+func (p *Peer) String() string {
+	return fmt.Sprintf("uid=%d gid=%d pid=%d", p.UID, p.GID, p.PID)
+}
+
+type peerMapping struct {
+	name  string
+	uids  []uint32
+	gids  []uint32
+	token string
+	scope *Scope
+}
+
+type peerKey struct{}
+
+// WithPeer stores the credentials of the connection's peer in ctx.
+func WithPeer(ctx context.Context, peer *Peer) context.Context {
+	return context.WithValue(ctx, peerKey{}, peer)
+}
+
+func PeerFromContext(ctx context.Context) *Peer {
+	peer, _ := ctx.Value(peerKey{}).(*Peer)
+	return peer
+}
+
+func newPeerMapping(config c.Peer, tokens map[string]string) (peerMapping, error) {
+	token, ok := tokens[config.Token]
+	if !ok {
+		return peerMapping{}, fmt.Errorf("peer %s: unknown token %q", config.Name, config.Token)
+	}
+	return peerMapping{
+		name:  config.Name,
+		uids:  config.UIDs,
+		gids:  config.GIDs,
+		token: token,
+		scope: newScope(config.Scope),
+	}, nil
+}
+
+func (m *peerMapping) match(peer *Peer) bool {
+	return (len(m.uids) == 0 || slices.Contains(m.uids, peer.UID)) &&
+		(len(m.gids) == 0 || slices.Contains(m.gids, peer.GID))
+}
+
+// authenticatePeer identifies a caller without a token by the first peer
+// mapping its credentials match.
+func (a *Authenticator) authenticatePeer(peer *Peer) (*Identity, error) {
+	for _, mapping := range a.peers {
+		if mapping.match(peer) {
+			return &Identity{
+				Kind:        KindPeer,
+				Name:        mapping.name,
+				Fingerprint: Fingerprint(fmt.Sprintf("uid=%d gid=%d", peer.UID, peer.GID)),
+				Token:       mapping.token,
+				Scope:       mapping.scope,
+			}, nil
+		}
+	}
+	return nil, ErrNoToken
+}
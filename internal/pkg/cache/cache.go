@@ -1,58 +1,387 @@
 package cache
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"bws-cache/internal/pkg/metrics"
+	"bws-cache/internal/pkg/redact"
+	"bws-cache/internal/pkg/secmem"
+
 	"github.com/jellydator/ttlcache/v3"
 )
 
+// Names of the caches, as used in metrics.
+const (
+	Keymap   = "keymap"
+	Secrets  = "secret"
+	Projects = "project"
+	Negative = "negative"
+)
+
+// Results of a lookup, as used in metrics.
+const (
+	Hit         = "hit"
+	Miss        = "miss"
+	NegativeHit = "negative_hit"
+)
+
+// NegativeTTL is how long a lookup of something that doesn't exist upstream
+// is remembered by default, short so new secrets are found soon after they
+// are created.
+const NegativeTTL = time.Minute
+
+var evictionReasons = map[ttlcache.EvictionReason]string{
+	ttlcache.EvictionReasonDeleted:         "deleted",
+	ttlcache.EvictionReasonCapacityReached: "capacity",
+	ttlcache.EvictionReasonExpired:         "expired",
+}
+
 type Cache struct {
-	KeyToID    *ttlcache.Cache[string, string]
-	IDtoSecret *ttlcache.Cache[string, string]
+	// KeyToID maps keys to IDs per token that listed them, see keymapKey.
+	KeyToID *ttlcache.Cache[string, KeyEntry]
+	// IDtoSecret holds secrets per token that read them, see secretKey,
+	// encrypted under that token, see SetSecret, in locked memory that is
+	// zeroed when the entry is evicted.
+	IDtoSecret *ttlcache.Cache[string, *Entry]
+	// IDtoProject maps project IDs to names, for policies on project names.
+	IDtoProject *ttlcache.Cache[string, string]
+	// Missing remembers keys and IDs that weren't found upstream, per
+	// token, see SetMissing.
+	Missing *ttlcache.Cache[string, struct{}]
+	Metrics *metrics.BwsMetrics
+	ttls    atomic.Pointer[TTLs]
+	// onChange is called with every entry evicted because it changed
+	// upstream.
+	onChange atomic.Pointer[func(Change)]
+	// keys and secrets track entries to evict when over their Limits.
+	keys    *lru
+	secrets *lru
+	// keymapMu serializes setting keys with evicting them for capacity.
+	keymapMu sync.Mutex
+	// listings holds when the keys listed per token and org expire, see
+	// HasKeymap. Guarded by keymapMu.
+	listings map[string]time.Time
+	// secretMu serializes replacing secrets so every replaced buffer is
+	// freed.
+	secretMu sync.Mutex
 }
 
-func New(ttl time.Duration) *Cache {
+// New returns a cache with ttl, recording measurements to metrics if it
+// isn't nil. Negative entries are kept for ttl or NegativeTTL, whichever is
+// shorter, until changed with SetTTLs.
+func New(ttl time.Duration, metrics *metrics.BwsMetrics) *Cache {
 	slog.Debug(fmt.Sprintf("Setting default ttl for cache to: %s", ttl))
-	cache := Cache{}
-	cache.KeyToID = ttlcache.New[string, string](ttlcache.WithTTL[string, string](ttl))
-	cache.IDtoSecret = ttlcache.New[string, string](ttlcache.WithTTL[string, string](ttl))
+	cache := Cache{Metrics: metrics, keys: newLRU(), secrets: newLRU(), listings: make(map[string]time.Time)}
+	cache.ttls.Store(&TTLs{Keymap: ttl, Secrets: ttl, Negative: min(ttl, NegativeTTL)})
+	cache.KeyToID = ttlcache.New[string, KeyEntry](ttlcache.WithTTL[string, KeyEntry](ttl))
+	cache.IDtoSecret = ttlcache.New[string, *Entry](ttlcache.WithTTL[string, *Entry](ttl))
+	// Eviction callbacks run in their own goroutine, after the entry has
+	// been removed.
+	cache.IDtoSecret.OnEviction(func(ctx context.Context, reason ttlcache.EvictionReason, item *ttlcache.Item[string, *Entry]) {
+		entry := item.Value()
+		entry.free()
+		cache.secrets.remove(entry.tracked)
+		cache.evicted(Secrets, evictionReason(reason, entry.tracked))
+	})
+	cache.IDtoProject = ttlcache.New[string, string](ttlcache.WithTTL[string, string](ttl))
+	cache.Missing = ttlcache.New[string, struct{}](ttlcache.WithTTL[string, struct{}](ttl))
+	cache.KeyToID.OnEviction(func(ctx context.Context, reason ttlcache.EvictionReason, item *ttlcache.Item[string, KeyEntry]) {
+		cache.keys.remove(item.Value().tracked)
+		cache.evicted(Keymap, evictionReason(reason, item.Value().tracked))
+	})
+	cache.IDtoProject.OnEviction(func(ctx context.Context, reason ttlcache.EvictionReason, item *ttlcache.Item[string, string]) {
+		cache.evicted(Projects, reason)
+	})
+	cache.Missing.OnEviction(func(ctx context.Context, reason ttlcache.EvictionReason, item *ttlcache.Item[string, struct{}]) {
+		cache.evicted(Negative, reason)
+	})
 	go cache.KeyToID.Start()
 	go cache.IDtoSecret.Start()
+	go cache.IDtoProject.Start()
+	go cache.Missing.Start()
 	return &cache
 }
 
-func (cache *Cache) GetID(key string) string {
-	if cache.KeyToID.Has(key) {
+// evictionReason reports entries deleted to make room for others as
+// evicted for capacity.
+func evictionReason(reason ttlcache.EvictionReason, t *tracked) ttlcache.EvictionReason {
+	if t != nil && t.capacity.Load() {
+		return ttlcache.EvictionReasonCapacityReached
+	}
+	return reason
+}
+
+func (cache *Cache) lookup(name string, result string) {
+	cache.Metrics.Counter("cache_lookups", map[string]string{"cache": name, "result": result})
+}
+
+func (cache *Cache) evicted(name string, reason ttlcache.EvictionReason) {
+	cache.Metrics.Counter("cache_evictions", map[string]string{"cache": name, "reason": evictionReasons[reason]})
+}
+
+// RecordGauges records the number of entries in each cache, and the bytes
+// taken up by those with limits. It is called periodically rather than on
+// every change.
+func (cache *Cache) RecordGauges() {
+	if cache.Metrics == nil {
+		return
+	}
+	cache.Metrics.Gauge("cache_bytes", map[string]string{"cache": Keymap}, float64(cache.keys.size().bytes))
+	cache.Metrics.Gauge("cache_bytes", map[string]string{"cache": Secrets}, float64(cache.secrets.size().bytes))
+	for name, size := range map[string]int{
+		Keymap:   cache.KeyToID.Len(),
+		Secrets:  cache.IDtoSecret.Len(),
+		Projects: cache.IDtoProject.Len(),
+		Negative: cache.Missing.Len(),
+	} {
+		cache.Metrics.Gauge("cache_entries", map[string]string{"cache": name}, float64(size))
+	}
+}
+
+// SetTTLs changes the TTLs given to new entries. Entries already in the
+// cache keep the TTL they were created with.
+func (cache *Cache) SetTTLs(ttls TTLs) {
+	slog.Debug(fmt.Sprintf("Setting ttls for new cache entries to: keymap %s, secrets %s, negative %s, stale %s, jitter %g, %d overrides",
+		ttls.Keymap, ttls.Secrets, ttls.Negative, ttls.Stale, ttls.Jitter, len(ttls.Overrides)))
+	cache.ttls.Store(&ttls)
+}
+
+func (cache *Cache) TTLs() TTLs {
+	return *cache.ttls.Load()
+}
+
+// keymapKey is the key in KeyToID of key as listed with the token with
+// tokenFingerprint.
+func keymapKey(tokenFingerprint string, key string) string {
+	return tokenFingerprint + ":" + key
+}
+
+// secretKey is the key in IDtoSecret of the secret with id as read with the
+// token with tokenFingerprint, so every token caches its own copy.
+func secretKey(tokenFingerprint string, id string) string {
+	return tokenFingerprint + ":" + id
+}
+
+// GetID returns the ID of the secret with key, if key was listed with
+// token.
+func (cache *Cache) GetID(key string, token string) string {
+	if item := cache.KeyToID.Get(keymapKey(Fingerprint(token), key), ttlcache.WithDisableTouchOnHit[string, KeyEntry]()); item != nil && time.Now().Before(item.Value().Expires) {
 		slog.Debug(fmt.Sprintf("Found ID for %s", key))
-		return cache.KeyToID.Get(key, ttlcache.WithDisableTouchOnHit[string, string]()).Value()
+		cache.keys.touch(item.Value().tracked)
+		cache.lookup(Keymap, Hit)
+		return item.Value().ID
 	}
 	slog.Debug(fmt.Sprintf("Cache miss for %s", key))
+	cache.lookup(Keymap, Miss)
+	return ""
+}
+
+// GetStaleID is GetID for a key that may have expired up to TTLs.Stale ago.
+func (cache *Cache) GetStaleID(key string, token string) string {
+	if item := cache.KeyToID.Get(keymapKey(Fingerprint(token), key), ttlcache.WithDisableTouchOnHit[string, KeyEntry]()); item != nil {
+		return item.Value().ID
+	}
 	return ""
 }
 
-func (cache *Cache) GetSecret(id string) string {
-	if cache.IDtoSecret.Has(id) {
+// GetSecret returns the secret cached for id if it was cached with the same
+// token. A secret only cached with another token is a miss.
+func (cache *Cache) GetSecret(id string, token string) string {
+	value, _ := cache.GetSecretEntry(id, token)
+	return value
+}
+
+// GetSecretEntry is GetSecret, also returning when the secret was cached.
+func (cache *Cache) GetSecretEntry(id string, token string) (string, time.Time) {
+	return cache.getSecret(id, token, false)
+}
+
+// GetStaleSecret is GetSecretEntry for a secret that may have expired up to
+// TTLs.Stale ago.
+func (cache *Cache) GetStaleSecret(id string, token string) (string, time.Time) {
+	return cache.getSecret(id, token, true)
+}
+
+func (cache *Cache) getSecret(id string, token string, stale bool) (string, time.Time) {
+	if item := cache.IDtoSecret.Get(secretKey(Fingerprint(token), id), ttlcache.WithDisableTouchOnHit[string, *Entry]()); item != nil && (stale || time.Now().Before(item.Value().Expires)) {
+		var value string
+		var err error
+		if !item.Value().sealed.Use(func(sealed []byte) {
+			value, err = open(token, id, sealed)
+		}) {
+			slog.Debug(fmt.Sprintf("Secret for %s was evicted while reading", id))
+			cache.lookup(Secrets, Miss)
+			return "", time.Time{}
+		}
+		if err != nil {
+			slog.Debug(fmt.Sprintf("Unable to decrypt secret for %s: %v", id, err))
+			cache.lookup(Secrets, Miss)
+			return "", time.Time{}
+		}
 		slog.Debug(fmt.Sprintf("Found secret for %s", id))
-		return cache.IDtoSecret.Get(id, ttlcache.WithDisableTouchOnHit[string, string]()).Value()
+		item.Value().hits.Add(1)
+		cache.secrets.touch(item.Value().tracked)
+		cache.lookup(Secrets, Hit)
+		return value, item.Value().Created
 	}
 	slog.Debug(fmt.Sprintf("Cache miss for %s", id))
+	cache.lookup(Secrets, Miss)
+	return "", time.Time{}
+}
+
+func (cache *Cache) GetProject(id string) string {
+	if item := cache.IDtoProject.Get(id, ttlcache.WithDisableTouchOnHit[string, string]()); item != nil {
+		slog.Debug(fmt.Sprintf("Found project name for %s", id))
+		cache.lookup(Projects, Hit)
+		return item.Value()
+	}
+	slog.Debug(fmt.Sprintf("Cache miss for project %s", id))
+	cache.lookup(Projects, Miss)
 	return ""
 }
 
-func (cache *Cache) SetID(key string, value string) {
+func (cache *Cache) SetProject(id string, name string) {
+	slog.Debug(fmt.Sprintf("Setting project name for id: %s", id))
+	ttls := cache.ttls.Load()
+	cache.IDtoProject.Set(id, name, ttls.jitter(ttls.Keymap))
+}
+
+// SetID maps key to the ID of a secret in org, as listed with token.
+func (cache *Cache) SetID(key string, id string, orgID string, token string) {
 	slog.Debug(fmt.Sprintf("Setting ID for key: %s", key))
-	cache.KeyToID.Set(key, value, 0)
+	ttls := cache.ttls.Load()
+	ttl := ttls.jitter(ttls.Keymap)
+	entry := KeyEntry{Key: key, ID: id, OrgID: orgID, Token: Fingerprint(token), Created: time.Now()}
+	entry.Expires = entry.Created.Add(ttl)
+	mapKey := keymapKey(entry.Token, key)
+	cache.keymapMu.Lock()
+	defer cache.keymapMu.Unlock()
+	var victims []*tracked
+	entry.tracked, victims = cache.keys.add(mapKey, entry.Token, entry.size(mapKey))
+	cache.KeyToID.Set(mapKey, entry, ttl+ttls.Stale)
+	cache.evictKeysLocked(victims)
+}
+
+// SetSecret caches value encrypted with AES-GCM under a key derived from
+// token, so only requests with the same token can read it back. Other
+// tokens keep their own copies. meta is kept in the clear to describe the
+// entry and pick its TTL. The sensitive parts of value, such as the secret
+// value in it, are masked in logs for as long as it is cached.
+func (cache *Cache) SetSecret(id string, value string, token string, meta Metadata, sensitive ...string) {
+	slog.Debug(fmt.Sprintf("Setting secret for id: %s", id))
+	sealed, err := seal(token, id, value)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Unable to encrypt secret for id %s, not caching: %v", id, err))
+		return
+	}
+	ttls := cache.ttls.Load()
+	ttl := ttls.jitter(ttls.secret(meta))
+	entry := &Entry{
+		Metadata: meta,
+		ID:       id,
+		Token:    Fingerprint(token),
+		Created:  time.Now(),
+		sealed:   secmem.Alloc(sealed),
+		release:  redact.Hold(sensitive...),
+	}
+	entry.Expires = entry.Created.Add(ttl)
+	secmem.Zero(sealed)
+	key := secretKey(entry.Token, id)
+
+	cache.secretMu.Lock()
+	defer cache.secretMu.Unlock()
+	// Overwriting an entry doesn't evict it, so free the old buffer here.
+	// The item is updated in place, so take its old value first.
+	var old *Entry
+	if item := cache.IDtoSecret.Get(key, ttlcache.WithDisableTouchOnHit[string, *Entry]()); item != nil {
+		old = item.Value()
+	}
+	var victims []*tracked
+	entry.tracked, victims = cache.secrets.add(key, entry.Token, entry.size(key))
+	cache.IDtoSecret.Set(key, entry, ttl+ttls.Stale)
+	if old != nil {
+		old.free()
+	}
+	cache.evictSecretsLocked(victims)
 }
 
-func (cache *Cache) SetSecret(key string, value string) {
-	slog.Debug(fmt.Sprintf("Setting secret for id: %s", key))
-	cache.IDtoSecret.Set(key, value, 0)
+// SetLimits changes the capacity limits, evicting entries to get under
+// them.
+func (cache *Cache) SetLimits(limits Limits) {
+	slog.Debug(fmt.Sprintf("Setting cache limits to: %+v", limits))
+	cache.keymapMu.Lock()
+	cache.evictKeysLocked(cache.keys.setLimits(limits.Keymap, limits.KeymapTenant))
+	cache.keymapMu.Unlock()
+	cache.secretMu.Lock()
+	cache.evictSecretsLocked(cache.secrets.setLimits(limits.Secrets, limits.Tenant))
+	cache.secretMu.Unlock()
+}
+
+// evictKeysLocked deletes the keys picked to make room for others.
+func (cache *Cache) evictKeysLocked(victims []*tracked) {
+	for _, victim := range victims {
+		item := cache.KeyToID.Get(victim.key, ttlcache.WithDisableTouchOnHit[string, KeyEntry]())
+		if item == nil || item.Value().tracked != victim {
+			continue
+		}
+		slog.Debug(fmt.Sprintf("Evicting ID for key %s, keymap is full", item.Value().Key))
+		victim.capacity.Store(true)
+		delete(cache.listings, keymapScope(item.Value().Token, item.Value().OrgID))
+		cache.KeyToID.Delete(victim.key)
+	}
+}
+
+// evictSecretsLocked deletes the secrets picked to make room for others,
+// zeroing their buffers before returning.
+func (cache *Cache) evictSecretsLocked(victims []*tracked) {
+	for _, victim := range victims {
+		item := cache.IDtoSecret.Get(victim.key, ttlcache.WithDisableTouchOnHit[string, *Entry]())
+		if item == nil || item.Value().tracked != victim {
+			continue
+		}
+		slog.Debug(fmt.Sprintf("Evicting secret for id %s, cache is full", item.Value().ID))
+		victim.capacity.Store(true)
+		cache.IDtoSecret.Delete(victim.key)
+		item.Value().free()
+	}
 }
 
 func (cache *Cache) Reset() {
 	slog.Debug("Resetting cache")
+	cache.keymapMu.Lock()
 	cache.KeyToID.DeleteAll()
+	cache.keys.reset()
+	clear(cache.listings)
+	cache.keymapMu.Unlock()
+	cache.wipeSecrets()
+	cache.IDtoProject.DeleteAll()
+	cache.Missing.DeleteAll()
+}
+
+// wipeSecrets removes every secret, zeroing their buffers before returning
+// rather than waiting for the eviction callbacks.
+func (cache *Cache) wipeSecrets() {
+	cache.secretMu.Lock()
+	defer cache.secretMu.Unlock()
+	items := cache.IDtoSecret.Items()
 	cache.IDtoSecret.DeleteAll()
+	cache.secrets.reset()
+	for _, item := range items {
+		item.Value().free()
+	}
+}
+
+// Stop stops expiring entries and wipes the cached secrets.
+func (cache *Cache) Stop() {
+	slog.Debug("Stopping cache expiration")
+	cache.KeyToID.Stop()
+	cache.IDtoSecret.Stop()
+	cache.IDtoProject.Stop()
+	cache.Missing.Stop()
+	cache.wipeSecrets()
 }
@@ -0,0 +1,199 @@
+package cache
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+)
+
+// Kinds of Change.
+const (
+	Removed = "removed"
+	Renamed = "renamed"
+	Revised = "revised"
+)
+
+// Change describes entries evicted, or replaced, because the secret changed
+// upstream.
+type Change struct {
+	Kind string
+	Key  string
+	ID   string
+	// NewKey is the key a renamed secret is now listed under.
+	NewKey string
+}
+
+func (change Change) String() string {
+	switch change.Kind {
+	case Renamed:
+		return fmt.Sprintf("secret %s was renamed from %s to %s upstream", change.ID, change.Key, change.NewKey)
+	case Revised:
+		return fmt.Sprintf("secret %s (%s) was revised upstream", change.ID, change.Key)
+	}
+	return fmt.Sprintf("secret %s (%s) was removed upstream", change.ID, change.Key)
+}
+
+// OnChange sets fn to be called with every change found by UpdateKeymap
+// and CheckRevision, or reported to Replaced.
+func (cache *Cache) OnChange(fn func(Change)) {
+	cache.onChange.Store(&fn)
+}
+
+func (cache *Cache) changed(change Change) {
+	slog.Info(fmt.Sprintf("Evicting cached entries, %s", change))
+	cache.notify(change)
+}
+
+func (cache *Cache) notify(change Change) {
+	cache.Metrics.Counter("cache_changes", map[string]string{"change": change.Kind})
+	if fn := cache.onChange.Load(); fn != nil {
+		(*fn)(change)
+	}
+}
+
+// UpdateKeymap sets the keys listed upstream with token in orgID, a map of
+// keys to IDs, and evicts what the list shows has changed since the keys
+// and secrets cached with token in orgID were read: a key whose ID is
+// listed under another key was renamed, and a key or secret whose ID isn't
+// listed was removed. It returns the changes.
+func (cache *Cache) UpdateKeymap(token string, orgID string, listed map[string]string) []Change {
+	tokenFingerprint := Fingerprint(token)
+	keys := make(map[string]string, len(listed))
+	for key, id := range listed {
+		keys[id] = key
+	}
+
+	var changes []Change
+	reported := make(map[string]bool)
+	for _, item := range cache.KeyToID.Items() {
+		entry := item.Value()
+		if entry.Token != tokenFingerprint || entry.OrgID != orgID || listed[entry.Key] == entry.ID {
+			continue
+		}
+		change := Change{Kind: Removed, Key: entry.Key, ID: entry.ID}
+		if newKey, ok := keys[entry.ID]; ok {
+			change.Kind = Renamed
+			change.NewKey = newKey
+		}
+		changes = append(changes, change)
+		reported[entry.ID] = true
+	}
+	for _, item := range cache.IDtoSecret.Items() {
+		entry := item.Value()
+		if entry.Token != tokenFingerprint || entry.OrgID != orgID || reported[entry.ID] {
+			continue
+		}
+		if _, ok := keys[entry.ID]; !ok {
+			changes = append(changes, Change{Kind: Removed, Key: entry.Key, ID: entry.ID})
+		}
+	}
+
+	for _, change := range changes {
+		// A key listed again with another ID is replaced below.
+		if _, ok := listed[change.Key]; !ok {
+			cache.deleteKey(tokenFingerprint, change.Key, change.ID)
+		}
+		// The cached value of a renamed secret holds its old key.
+		cache.deleteSecret(tokenFingerprint, change.ID)
+		cache.changed(change)
+	}
+	for key, id := range listed {
+		cache.SetID(key, id, orgID, token)
+	}
+	// Jitter can expire keys early, so the listing is only trusted for the
+	// shortest TTL they could have been given.
+	ttls := cache.ttls.Load()
+	cache.keymapMu.Lock()
+	cache.listings[keymapScope(tokenFingerprint, orgID)] = time.Now().Add(time.Duration(float64(ttls.Keymap) * (1 - max(ttls.Jitter, 0))))
+	cache.keymapMu.Unlock()
+	return changes
+}
+
+// keymapScope identifies the keys listed with the token with
+// tokenFingerprint in orgID.
+func keymapScope(tokenFingerprint string, orgID string) string {
+	return tokenFingerprint + ":" + orgID
+}
+
+// HasKeymap reports whether every key listed with token in orgID is still
+// cached, so a key that isn't in the keymap wasn't listed.
+func (cache *Cache) HasKeymap(token string, orgID string) bool {
+	cache.keymapMu.Lock()
+	defer cache.keymapMu.Unlock()
+	return time.Now().Before(cache.listings[keymapScope(Fingerprint(token), orgID)])
+}
+
+// deleteKey removes key as listed with the token with tokenFingerprint from
+// the keymap if it still maps to id.
+func (cache *Cache) deleteKey(tokenFingerprint string, key string, id string) {
+	cache.keymapMu.Lock()
+	defer cache.keymapMu.Unlock()
+	mapKey := keymapKey(tokenFingerprint, key)
+	item := cache.KeyToID.Get(mapKey, ttlcache.WithDisableTouchOnHit[string, KeyEntry]())
+	if item != nil && item.Value().ID == id {
+		cache.KeyToID.Delete(mapKey)
+	}
+}
+
+// CachedIDs returns the IDs of the secrets cached with token in orgID.
+func (cache *Cache) CachedIDs(token string, orgID string) []string {
+	tokenFingerprint := Fingerprint(token)
+	var ids []string
+	for _, item := range cache.IDtoSecret.Items() {
+		if entry := item.Value(); entry.Token == tokenFingerprint && entry.OrgID == orgID {
+			ids = append(ids, entry.ID)
+		}
+	}
+	return ids
+}
+
+// CachedRevision returns the revision the secret with id was cached at with
+// token and whether it was cached as a list, see Metadata. ok is false if
+// it isn't cached with token.
+func (cache *Cache) CachedRevision(id string, token string) (revisionDate string, list bool, ok bool) {
+	item := cache.IDtoSecret.Get(secretKey(Fingerprint(token), id), ttlcache.WithDisableTouchOnHit[string, *Entry]())
+	if item == nil {
+		return "", false, false
+	}
+	return item.Value().RevisionDate, item.Value().List, true
+}
+
+// Replaced reports that the secret with key and id was cached again at the
+// revision read upstream, in place of an older one.
+func (cache *Cache) Replaced(key string, id string) {
+	change := Change{Kind: Revised, Key: key, ID: id}
+	slog.Info(fmt.Sprintf("Replacing cached entry, %s", change))
+	cache.notify(change)
+}
+
+// Renamed reports that the secret with id, listed with token in orgID under
+// key, was read upstream under newKey. key is removed from the keymap, which
+// has to be listed again to find what key is now.
+func (cache *Cache) Renamed(key string, id string, newKey string, orgID string, token string) {
+	tokenFingerprint := Fingerprint(token)
+	cache.deleteKey(tokenFingerprint, key, id)
+	cache.keymapMu.Lock()
+	delete(cache.listings, keymapScope(tokenFingerprint, orgID))
+	cache.keymapMu.Unlock()
+	cache.changed(Change{Kind: Renamed, Key: key, ID: id, NewKey: newKey})
+}
+
+// CheckRevision evicts the copies of the secret with id that were cached at
+// a revision other than revisionDate, reporting whether there were any.
+func (cache *Cache) CheckRevision(id string, revisionDate string) bool {
+	var revised *Entry
+	cache.secretMu.Lock()
+	for key, item := range cache.IDtoSecret.Items() {
+		if entry := item.Value(); entry.ID == id && entry.RevisionDate != revisionDate && cache.deleteSecretLocked(key) {
+			revised = entry
+		}
+	}
+	cache.secretMu.Unlock()
+	if revised == nil {
+		return false
+	}
+	cache.changed(Change{Kind: Revised, Key: revised.Key, ID: id})
+	return true
+}
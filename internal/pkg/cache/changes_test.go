@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHasKeymap(t *testing.T) {
+	cache := New(time.Minute, nil)
+	defer cache.Stop()
+
+	if cache.HasKeymap("token", "org") {
+		t.Fatal("keymap cached before listing")
+	}
+	cache.UpdateKeymap("token", "org", map[string]string{"a": "1", "b": "2"})
+	if !cache.HasKeymap("token", "org") {
+		t.Fatal("keymap not cached after listing")
+	}
+	if cache.HasKeymap("other", "org") || cache.HasKeymap("token", "other") {
+		t.Fatal("keymap cached for another token or org")
+	}
+	cache.DeleteKey("a")
+	if cache.HasKeymap("token", "org") {
+		t.Fatal("keymap cached after deleting a key")
+	}
+}
+
+func TestKeymapPerToken(t *testing.T) {
+	cache := New(time.Minute, nil)
+	defer cache.Stop()
+
+	cache.UpdateKeymap("token", "org", map[string]string{"a": "1"})
+	cache.UpdateKeymap("other", "org", map[string]string{"a": "2", "b": "3"})
+	tests := []struct {
+		key   string
+		token string
+		id    string
+	}{
+		{"a", "token", "1"},
+		{"a", "other", "2"},
+		{"b", "token", ""},
+		{"b", "other", "3"},
+		{"a", "unknown", ""},
+	}
+	for _, test := range tests {
+		if id := cache.GetID(test.key, test.token); id != test.id {
+			t.Errorf("%s with %s: got ID %q, want %q", test.key, test.token, id, test.id)
+		}
+	}
+	if changes := cache.UpdateKeymap("token", "org", map[string]string{"a": "1"}); len(changes) != 0 {
+		t.Errorf("listing with another token reported changes: %v", changes)
+	}
+	if keys := cache.Keys(); len(keys) != 3 || keys[0].Key != "a" || keys[2].Key != "b" {
+		t.Errorf("got keys %+v", keys)
+	}
+
+	if !cache.DeleteKey("a") {
+		t.Fatal("key not deleted")
+	}
+	if cache.GetID("a", "token") != "" || cache.GetID("a", "other") != "" {
+		t.Error("key still cached for a token")
+	}
+	if cache.GetID("b", "other") != "3" {
+		t.Error("other key deleted")
+	}
+}
+
+func TestKeymapTenantLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		big    int
+		small  int
+	}{
+		{"unlimited", Limits{}, 3, 1},
+		{"keymap full", Limits{Keymap: Limit{MaxEntries: 3}}, 2, 1},
+		{"tenant full", Limits{KeymapTenant: Limit{MaxEntries: 2}}, 2, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := New(time.Minute, nil)
+			defer cache.Stop()
+			cache.SetLimits(test.limits)
+
+			cache.UpdateKeymap("small", "org", map[string]string{"d": "4"})
+			cache.UpdateKeymap("big", "org", map[string]string{"a": "1", "b": "2", "c": "3"})
+			keys := make(map[string]int)
+			for _, entry := range cache.Keys() {
+				keys[entry.Token]++
+			}
+			if keys[Fingerprint("big")] != test.big || keys[Fingerprint("small")] != test.small {
+				t.Errorf("got %d keys for big and %d for small, want %d and %d",
+					keys[Fingerprint("big")], keys[Fingerprint("small")], test.big, test.small)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"bws-cache/internal/pkg/secmem"
+
+	"github.com/jellydator/ttlcache/v3"
+)
+
+// entryOverhead estimates the bytes an entry takes up besides its key and
+// value, in the cache's map, expiry queue and item.
+const entryOverhead = 200
+
+// KeyEntry maps a secret key to its ID.
+type KeyEntry struct {
+	Key   string
+	ID    string
+	OrgID string
+	// Token is the fingerprint of the access token the key was listed
+	// with.
+	Token   string
+	Created time.Time
+	// Expires is when the key stops being served, it is kept for
+	// TTLs.Stale longer.
+	Expires time.Time
+	tracked *tracked
+}
+
+// Metadata describes a cached secret without revealing its value.
+type Metadata struct {
+	Key          string
+	OrgID        string
+	ProjectID    string
+	RevisionDate string
+	// TTL is set by the secret itself, 0 if it doesn't set one.
+	TTL time.Duration
+	// List is set when the value is a list of secrets, as served by ID
+	// rather than by key.
+	List bool
+}
+
+// Entry is a cached secret.
+type Entry struct {
+	Metadata
+	ID string
+	// Token is the fingerprint of the access token the secret was read
+	// with, and so the only one that can read it from the cache.
+	Token   string
+	Created time.Time
+	// Expires is when the secret stops being served, it is kept for
+	// TTLs.Stale longer.
+	Expires time.Time
+	sealed  *secmem.Buffer
+	// release stops masking the value in logs, see redact.Hold.
+	release func()
+	hits    atomic.Int64
+	tracked *tracked
+}
+
+// free zeroes the value and stops masking it in logs. It may be called more
+// than once.
+func (entry *Entry) free() {
+	entry.sealed.Free()
+	entry.release()
+}
+
+// Fingerprint matches auth.Fingerprint, so entries can be matched with the
+// audit log.
+func Fingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// KeyInfo describes a keymap entry.
+type KeyInfo struct {
+	Key       string    `json:"key"`
+	ID        string    `json:"id"`
+	OrgID     string    `json:"org_id"`
+	ProjectID string    `json:"project_id,omitempty"`
+	Token     string    `json:"token_fingerprint"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+}
+
+// SecretInfo describes a cached secret, without its value.
+type SecretInfo struct {
+	ID           string    `json:"id"`
+	Key          string    `json:"key"`
+	OrgID        string    `json:"org_id"`
+	ProjectID    string    `json:"project_id,omitempty"`
+	RevisionDate string    `json:"revision_date"`
+	Token        string    `json:"token_fingerprint"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+	Hits         int64     `json:"hits"`
+	Bytes        int       `json:"bytes"`
+}
+
+// Count is the number of entries in a cache and an estimate of the memory
+// they take up.
+type Count struct {
+	Entries int `json:"entries"`
+	Bytes   int `json:"bytes"`
+}
+
+// Stats summarizes the contents of a cache.
+type Stats struct {
+	Keymap   Count `json:"keymap"`
+	Secrets  Count `json:"secrets"`
+	Projects Count `json:"projects"`
+	Negative Count `json:"negative"`
+	// Hits is the number of reads served by the secrets in the cache.
+	Hits int64 `json:"hits"`
+	// LockedBytes is the locked memory holding the encrypted secrets.
+	LockedBytes int `json:"locked_bytes"`
+}
+
+// Keys lists the keymap, sorted by key then token. The project of a key is
+// only known while its secret is cached.
+func (cache *Cache) Keys() []KeyInfo {
+	secrets := cache.IDtoSecret.Items()
+	keys := make([]KeyInfo, 0, cache.KeyToID.Len())
+	for _, item := range cache.KeyToID.Items() {
+		entry := item.Value()
+		info := KeyInfo{
+			Key:     entry.Key,
+			ID:      entry.ID,
+			OrgID:   entry.OrgID,
+			Token:   entry.Token,
+			Created: entry.Created,
+			Expires: entry.Expires,
+		}
+		if secret, ok := secrets[secretKey(entry.Token, entry.ID)]; ok {
+			info.ProjectID = secret.Value().ProjectID
+		}
+		keys = append(keys, info)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Key != keys[j].Key {
+			return keys[i].Key < keys[j].Key
+		}
+		return keys[i].Token < keys[j].Token
+	})
+	return keys
+}
+
+// Secrets lists the cached secrets, sorted by key, ID then token.
+func (cache *Cache) Secrets() []SecretInfo {
+	secrets := make([]SecretInfo, 0, cache.IDtoSecret.Len())
+	for secretKey, item := range cache.IDtoSecret.Items() {
+		entry := item.Value()
+		secrets = append(secrets, SecretInfo{
+			ID:           entry.ID,
+			Key:          entry.Key,
+			OrgID:        entry.OrgID,
+			ProjectID:    entry.ProjectID,
+			RevisionDate: entry.RevisionDate,
+			Token:        entry.Token,
+			Created:      entry.Created,
+			Expires:      entry.Expires,
+			Hits:         entry.hits.Load(),
+			Bytes:        entry.size(secretKey),
+		})
+	}
+	sort.Slice(secrets, func(i, j int) bool {
+		if secrets[i].Key != secrets[j].Key {
+			return secrets[i].Key < secrets[j].Key
+		}
+		if secrets[i].ID != secrets[j].ID {
+			return secrets[i].ID < secrets[j].ID
+		}
+		return secrets[i].Token < secrets[j].Token
+	})
+	return secrets
+}
+
+func (entry KeyEntry) size(key string) int {
+	return entryOverhead + len(key) + len(entry.Key) + len(entry.ID) + len(entry.OrgID) + len(entry.Token)
+}
+
+func (entry *Entry) size(key string) int {
+	return entryOverhead + len(key) + entry.sealed.Size() + len(entry.Key) + len(entry.OrgID) +
+		len(entry.ProjectID) + len(entry.RevisionDate) + len(entry.Token)
+}
+
+// Stats counts the entries in each part of the cache.
+func (cache *Cache) Stats() Stats {
+	var stats Stats
+	for key, item := range cache.KeyToID.Items() {
+		entry := item.Value()
+		stats.Keymap.Entries++
+		stats.Keymap.Bytes += entry.size(key)
+	}
+	for key, item := range cache.IDtoSecret.Items() {
+		entry := item.Value()
+		stats.Secrets.Entries++
+		stats.Secrets.Bytes += entry.size(key)
+		stats.LockedBytes += entry.sealed.Size()
+		stats.Hits += entry.hits.Load()
+	}
+	for id, item := range cache.IDtoProject.Items() {
+		stats.Projects.Entries++
+		stats.Projects.Bytes += entryOverhead + len(id) + len(item.Value())
+	}
+	for key := range cache.Missing.Items() {
+		stats.Negative.Entries++
+		stats.Negative.Bytes += entryOverhead + len(key)
+	}
+	return stats
+}
+
+// Delete removes the secret with id as cached with every token, reporting
+// whether it was cached.
+func (cache *Cache) Delete(id string) bool {
+	cache.secretMu.Lock()
+	defer cache.secretMu.Unlock()
+	deleted := false
+	for key, item := range cache.IDtoSecret.Items() {
+		if item.Value().ID == id {
+			deleted = cache.deleteSecretLocked(key) || deleted
+		}
+	}
+	return deleted
+}
+
+// deleteSecret removes the secret with id as cached with the token with
+// tokenFingerprint, reporting whether it was cached.
+func (cache *Cache) deleteSecret(tokenFingerprint string, id string) bool {
+	cache.secretMu.Lock()
+	defer cache.secretMu.Unlock()
+	return cache.deleteSecretLocked(secretKey(tokenFingerprint, id))
+}
+
+func (cache *Cache) deleteSecretLocked(key string) bool {
+	item := cache.IDtoSecret.Get(key, ttlcache.WithDisableTouchOnHit[string, *Entry]())
+	if item == nil {
+		return false
+	}
+	slog.Debug(fmt.Sprintf("Deleting secret for id: %s", item.Value().ID))
+	cache.IDtoSecret.Delete(key)
+	item.Value().free()
+	return true
+}
+
+// DeleteKey removes key from the keymap of every token along with the
+// secret each of them cached, reporting whether it was cached.
+func (cache *Cache) DeleteKey(key string) bool {
+	var deleted []KeyEntry
+	cache.keymapMu.Lock()
+	for mapKey, item := range cache.KeyToID.Items() {
+		entry := item.Value()
+		if entry.Key != key {
+			continue
+		}
+		slog.Debug(fmt.Sprintf("Deleting ID for key: %s", key))
+		cache.KeyToID.Delete(mapKey)
+		delete(cache.listings, keymapScope(entry.Token, entry.OrgID))
+		deleted = append(deleted, entry)
+	}
+	cache.keymapMu.Unlock()
+	for _, entry := range deleted {
+		cache.deleteSecret(entry.Token, entry.ID)
+	}
+	return len(deleted) > 0
+}
+
+// DueForRefresh returns the secrets cached with token that expire within
+// window and were read at least minHits times, by ID.
+func (cache *Cache) DueForRefresh(token string, window time.Duration, minHits int64) map[string]Metadata {
+	tokenFingerprint := Fingerprint(token)
+	deadline := time.Now().Add(window)
+	due := make(map[string]Metadata)
+	for _, item := range cache.IDtoSecret.Items() {
+		entry := item.Value()
+		if entry.Token == tokenFingerprint && entry.Expires.Before(deadline) && entry.hits.Load() >= minHits {
+			due[entry.ID] = entry.Metadata
+		}
+	}
+	return due
+}
+
+// KeyExpires returns when key listed with token expires from the keymap, or
+// the zero time if it isn't in the keymap.
+func (cache *Cache) KeyExpires(key string, token string) time.Time {
+	item := cache.KeyToID.Get(keymapKey(Fingerprint(token), key), ttlcache.WithDisableTouchOnHit[string, KeyEntry]())
+	if item == nil {
+		return time.Time{}
+	}
+	return item.Value().Expires
+}
@@ -0,0 +1,206 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// Limit caps the entries in a cache and the bytes they take up. Zero is
+// unlimited.
+type Limit struct {
+	MaxEntries int
+	MaxBytes   int
+}
+
+// Limits are the capacity limits of a Cache.
+type Limits struct {
+	Keymap  Limit
+	Secrets Limit
+	// Tenant limits the secrets cached for each access token.
+	Tenant Limit
+	// KeymapTenant limits the keys listed with each access token.
+	KeymapTenant Limit
+}
+
+type usage struct {
+	entries int
+	bytes   int
+}
+
+func (u usage) exceeds(limit Limit) bool {
+	return (limit.MaxEntries > 0 && u.entries > limit.MaxEntries) ||
+		(limit.MaxBytes > 0 && u.bytes > limit.MaxBytes)
+}
+
+// tracked is an entry as seen by an lru.
+type tracked struct {
+	key        string
+	tenant     string
+	size       int
+	elem       *list.Element
+	tenantElem *list.Element
+	// capacity is set when the entry is evicted to make room for others.
+	capacity atomic.Bool
+}
+
+type tenantUsage struct {
+	order *list.List
+	usage
+}
+
+// lru tracks how recently entries were used and the space they take up, to
+// pick the entries to evict when a limit is exceeded. Entries are grouped
+// by tenant: a tenant over its own limit evicts its own entries, and when
+// the whole cache is over its limit the tenant using the most space is
+// evicted from first, so one tenant can't push out the others.
+type lru struct {
+	mu      sync.Mutex
+	order   *list.List
+	tenants map[string]*tenantUsage
+	items   map[string]*tracked
+	usage
+	limit       Limit
+	tenantLimit Limit
+}
+
+func newLRU() *lru {
+	return &lru{
+		order:   list.New(),
+		tenants: make(map[string]*tenantUsage),
+		items:   make(map[string]*tracked),
+	}
+}
+
+// add tracks a new entry for key, replacing any current one, and returns
+// the entries to evict to get back under the limits.
+func (l *lru) add(key string, tenant string, size int) (*tracked, []*tracked) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if old, ok := l.items[key]; ok {
+		l.removeLocked(old)
+	}
+	t := &tracked{key: key, tenant: tenant, size: size}
+	tu, ok := l.tenants[tenant]
+	if !ok {
+		tu = &tenantUsage{order: list.New()}
+		l.tenants[tenant] = tu
+	}
+	t.elem = l.order.PushFront(t)
+	t.tenantElem = tu.order.PushFront(t)
+	tu.entries++
+	tu.bytes += size
+	l.entries++
+	l.bytes += size
+	l.items[key] = t
+	return t, l.victimsLocked(tenant)
+}
+
+// touch marks t as just used.
+func (l *lru) touch(t *tracked) {
+	if t == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.items[t.key] != t {
+		return
+	}
+	l.order.MoveToFront(t.elem)
+	l.tenants[t.tenant].order.MoveToFront(t.tenantElem)
+}
+
+// remove stops tracking t, if it is still tracked.
+func (l *lru) remove(t *tracked) {
+	if t == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.removeLocked(t)
+}
+
+func (l *lru) removeLocked(t *tracked) {
+	if l.items[t.key] != t {
+		return
+	}
+	delete(l.items, t.key)
+	l.order.Remove(t.elem)
+	tu := l.tenants[t.tenant]
+	tu.order.Remove(t.tenantElem)
+	tu.entries--
+	tu.bytes -= t.size
+	if tu.entries == 0 {
+		delete(l.tenants, t.tenant)
+	}
+	l.entries--
+	l.bytes -= t.size
+}
+
+// setLimits changes the limits and returns the entries to evict to get
+// under them.
+func (l *lru) setLimits(limit Limit, tenantLimit Limit) []*tracked {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	l.tenantLimit = tenantLimit
+	var victims []*tracked
+	for tenant := range l.tenants {
+		victims = append(victims, l.victimsLocked(tenant)...)
+	}
+	return append(victims, l.victimsLocked("")...)
+}
+
+// victimsLocked removes and returns the least recently used entries of
+// tenant while it is over the tenant limit, then those of the largest
+// tenants while the cache is over its limit.
+func (l *lru) victimsLocked(tenant string) []*tracked {
+	var victims []*tracked
+	for {
+		tu, ok := l.tenants[tenant]
+		if !ok || !tu.exceeds(l.tenantLimit) {
+			break
+		}
+		victims = append(victims, l.evictLocked(tu))
+	}
+	for l.exceeds(l.limit) {
+		victims = append(victims, l.evictLocked(l.largestLocked()))
+	}
+	return victims
+}
+
+func (l *lru) evictLocked(tu *tenantUsage) *tracked {
+	t := tu.order.Back().Value.(*tracked)
+	l.removeLocked(t)
+	return t
+}
+
+// largestLocked returns the tenant using the most of whatever limit is
+// exceeded.
+func (l *lru) largestLocked() *tenantUsage {
+	byBytes := l.limit.MaxBytes > 0 && l.bytes > l.limit.MaxBytes
+	var largest *tenantUsage
+	for _, tu := range l.tenants {
+		if largest == nil || (byBytes && tu.bytes > largest.bytes) || (!byBytes && tu.entries > largest.entries) {
+			largest = tu
+		}
+	}
+	return largest
+}
+
+// reset stops tracking every entry.
+func (l *lru) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.order.Init()
+	l.tenants = make(map[string]*tenantUsage)
+	l.items = make(map[string]*tracked)
+	l.usage = usage{}
+}
+
+// size returns the entries tracked and the space they take up.
+func (l *lru) size() usage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.usage
+}
@@ -0,0 +1,135 @@
+package cache
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func keys(victims []*tracked) []string {
+	var keys []string
+	for _, victim := range victims {
+		keys = append(keys, victim.key)
+	}
+	return keys
+}
+
+func TestLRU(t *testing.T) {
+	type add struct {
+		key, tenant string
+		size        int
+		victims     []string
+	}
+	tests := []struct {
+		name        string
+		limit       Limit
+		tenantLimit Limit
+		touch       string
+		adds        []add
+	}{
+		{"unlimited", Limit{}, Limit{}, "", []add{
+			{"a", "t1", 10, nil},
+			{"b", "t1", 10, nil},
+			{"c", "t2", 10, nil},
+		}},
+		{"entries", Limit{MaxEntries: 2}, Limit{}, "", []add{
+			{"a", "t1", 10, nil},
+			{"b", "t1", 10, nil},
+			{"c", "t1", 10, []string{"a"}},
+		}},
+		{"bytes", Limit{MaxBytes: 25}, Limit{}, "", []add{
+			{"a", "t1", 10, nil},
+			{"b", "t1", 10, nil},
+			{"c", "t1", 20, []string{"a", "b"}},
+		}},
+		{"touched entries are kept", Limit{MaxEntries: 2}, Limit{}, "a", []add{
+			{"a", "t1", 10, nil},
+			{"b", "t1", 10, nil},
+			{"c", "t1", 10, []string{"b"}},
+		}},
+		{"largest tenant evicts first", Limit{MaxEntries: 3}, Limit{}, "", []add{
+			{"a", "t1", 10, nil},
+			{"b", "t1", 10, nil},
+			{"c", "t1", 10, nil},
+			{"d", "t2", 10, []string{"a"}},
+		}},
+		{"tenant limit", Limit{}, Limit{MaxEntries: 1}, "", []add{
+			{"a", "t1", 10, nil},
+			{"b", "t2", 10, nil},
+			{"c", "t1", 10, []string{"a"}},
+		}},
+		{"replacing an entry", Limit{MaxEntries: 2}, Limit{}, "", []add{
+			{"a", "t1", 10, nil},
+			{"b", "t1", 10, nil},
+			{"a", "t1", 10, nil},
+			{"c", "t1", 10, []string{"b"}},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := newLRU()
+			l.setLimits(test.limit, test.tenantLimit)
+			entries := make(map[string]*tracked)
+			for i, add := range test.adds {
+				if i == 2 && test.touch != "" {
+					l.touch(entries[test.touch])
+				}
+				var victims []*tracked
+				entries[add.key], victims = l.add(add.key, add.tenant, add.size)
+				if got := keys(victims); !slices.Equal(got, add.victims) {
+					t.Fatalf("adding %s: evicted %v, want %v", add.key, got, add.victims)
+				}
+			}
+		})
+	}
+}
+
+func TestLRUSetLimits(t *testing.T) {
+	l := newLRU()
+	l.add("a", "t1", 10)
+	l.add("b", "t1", 10)
+	l.add("c", "t2", 10)
+	if got := keys(l.setLimits(Limit{MaxEntries: 1}, Limit{})); len(got) != 2 {
+		t.Errorf("evicted %v, want 2 entries", got)
+	}
+	if size := l.size(); size.entries != 1 || size.bytes != 10 {
+		t.Errorf("got size %+v", size)
+	}
+}
+
+func TestLRURemove(t *testing.T) {
+	l := newLRU()
+	old, _ := l.add("a", "t1", 10)
+	l.add("a", "t1", 20)
+	// Removing an entry that was replaced leaves the new one.
+	l.remove(old)
+	if size := l.size(); size.entries != 1 || size.bytes != 20 {
+		t.Errorf("got size %+v", size)
+	}
+	l.reset()
+	if size := l.size(); size.entries != 0 || len(l.tenants) != 0 {
+		t.Errorf("got size %+v after reset", size)
+	}
+}
+
+func TestSecretsPerToken(t *testing.T) {
+	cache := New(time.Minute, nil)
+	defer cache.Stop()
+	cache.SetLimits(Limits{Tenant: Limit{MaxEntries: 1}})
+
+	cache.SetSecret("id-1", "first", "token", Metadata{Key: "key"})
+	cache.SetSecret("id-1", "second", "other", Metadata{Key: "key"})
+	if value := cache.GetSecret("id-1", "token"); value != "first" {
+		t.Errorf("got %q with token, want its own copy", value)
+	}
+	if value := cache.GetSecret("id-1", "other"); value != "second" {
+		t.Errorf("got %q with other, want its own copy", value)
+	}
+	cache.SetSecret("id-2", "third", "other", Metadata{Key: "key2"})
+	if cache.GetSecret("id-1", "token") == "" || cache.GetSecret("id-1", "other") != "" {
+		t.Error("a token evicted the secret of another")
+	}
+	if !cache.Delete("id-1") || cache.GetSecret("id-1", "token") != "" {
+		t.Error("secret not deleted")
+	}
+}
@@ -0,0 +1,35 @@
+package cache
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/jellydator/ttlcache/v3"
+)
+
+// missingKey scopes a negative entry to the token it was looked up with,
+// since tokens can see different secrets.
+func missingKey(name string, key string, token string) string {
+	return name + ":" + Fingerprint(token) + ":" + key
+}
+
+// SetMissing remembers that key wasn't found in the keymap or secret cache
+// named name when looked up upstream with token.
+func (cache *Cache) SetMissing(name string, key string, token string) {
+	ttls := cache.ttls.Load()
+	if ttls.Negative <= 0 {
+		return
+	}
+	slog.Debug(fmt.Sprintf("Setting missing %s: %s", name, key))
+	cache.Missing.Set(missingKey(name, key, token), struct{}{}, ttls.jitter(ttls.Negative))
+}
+
+// IsMissing reports whether key was recently not found upstream.
+func (cache *Cache) IsMissing(name string, key string, token string) bool {
+	if cache.Missing.Get(missingKey(name, key, token), ttlcache.WithDisableTouchOnHit[string, struct{}]()) == nil {
+		return false
+	}
+	slog.Debug(fmt.Sprintf("%s %s is known to be missing", name, key))
+	cache.lookup(name, NegativeHit)
+	return true
+}
@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+
+	"bws-cache/internal/pkg/secmem"
+)
+
+// salt is mixed into every key so that keys derived in one process are
+// useless in any other.
+var salt = func() *secmem.Buffer {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	defer secmem.Zero(salt)
+	return secmem.Alloc(salt)
+}()
+
+var errOpen = errors.New("unable to decrypt cached secret")
+
+// deriveKey returns the AES-256 key for values cached on behalf of token.
+func deriveKey(token string) []byte {
+	var key []byte
+	salt.Use(func(salt []byte) {
+		mac := hmac.New(sha256.New, salt)
+		mac.Write([]byte(token))
+		key = mac.Sum(nil)
+	})
+	return key
+}
+
+func newAEAD(token string) (cipher.AEAD, error) {
+	key := deriveKey(token)
+	defer secmem.Zero(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts value under token, binding it to id so that a ciphertext
+// can't be moved to another entry. The nonce is prepended to the result.
+func seal(token string, id string, value string) ([]byte, error) {
+	aead, err := newAEAD(token)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(value)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	plaintext := []byte(value)
+	defer secmem.Zero(plaintext)
+	return aead.Seal(nonce, nonce, plaintext, []byte(id)), nil
+}
+
+// open decrypts a value sealed by seal, failing if it was sealed under a
+// different token or id.
+func open(token string, id string, sealed []byte) (string, error) {
+	aead, err := newAEAD(token)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errOpen
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	value, err := aead.Open(nil, nonce, ciphertext, []byte(id))
+	if err != nil {
+		return "", errOpen
+	}
+	defer secmem.Zero(value)
+	return string(value), nil
+}
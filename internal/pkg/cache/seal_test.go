@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"bws-cache/internal/pkg/redact"
+)
+
+const token = "0.6b3a4a8e-7c0e-4a1b-9a57-2f1f0a4d3c21.client:secret"
+
+func TestSeal(t *testing.T) {
+	sealed, err := seal(token, "id-1", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		token string
+		id    string
+		valid bool
+	}{
+		{"same token and id", token, "id-1", true},
+		{"other token", "other", "id-1", false},
+		{"other id", token, "id-2", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, err := open(test.token, test.id, sealed)
+			if (err == nil) != test.valid || (test.valid && value != "hunter2") {
+				t.Errorf("got %q, %v, want valid %t", value, err, test.valid)
+			}
+		})
+	}
+	if _, err := open(token, "id-1", sealed[:4]); err == nil {
+		t.Error("opened a truncated value")
+	}
+}
+
+func TestCachedSecretsAreRedacted(t *testing.T) {
+	cache := New(time.Hour, nil)
+	defer cache.Stop()
+	cache.SetSecret("id-1", `{"value":"cached-secret-value"}`, token, Metadata{Key: "key"}, "cached-secret-value")
+	// More tokens than the redactor remembers don't push out the secret.
+	for i := range 10001 {
+		redact.AddToken(fmt.Sprintf("client-token-%d", i))
+	}
+	if got := redact.String("cached-secret-value"); got != redact.Mask {
+		t.Errorf("cached secret not redacted: %q", got)
+	}
+	cache.Delete("id-1")
+	if got := redact.String("cached-secret-value"); got != "cached-secret-value" {
+		t.Errorf("deleted secret still redacted: %q", got)
+	}
+}
+
+// value is the size of a typical secret, such as a password or API key.
+var value = strings.Repeat("x", 64)
+
+func BenchmarkSeal(b *testing.B) {
+	b.ReportAllocs()
+	for range b.N {
+		if _, err := seal(token, "id-1", value); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkOpen(b *testing.B) {
+	sealed, err := seal(token, "id-1", value)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		if _, err := open(token, "id-1", sealed); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkGetSecret measures a cache hit, which opens the sealed value.
+func BenchmarkGetSecret(b *testing.B) {
+	cache := New(time.Hour, nil)
+	defer cache.Stop()
+	cache.SetSecret("id-1", value, token, Metadata{Key: "key"})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		if cache.GetSecret("id-1", token) == "" {
+			b.Fatal("miss")
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"math/rand/v2"
+	"path"
+	"time"
+)
+
+// TTLs are how long entries are cached for.
+type TTLs struct {
+	// Keymap is the TTL of the keymap and of project names.
+	Keymap  time.Duration
+	Secrets time.Duration
+	// Negative is the TTL of lookups that weren't found upstream, 0 doesn't
+	// remember them.
+	Negative time.Duration
+	// Jitter shortens every TTL by a random fraction of up to Jitter, so
+	// entries cached at the same moment don't all expire together.
+	Jitter float64
+	// Overrides set the TTL of the secrets they match, the first match
+	// wins. They take precedence over a TTL set by the secret itself, see
+	// Metadata.
+	Overrides []Override
+	// NoteMax caps the TTL a secret sets itself, 0 caps it at Secrets.
+	NoteMax time.Duration
+	// Stale is how long keys and secrets are kept once they expire, to be
+	// served when they can't be read again from Bitwarden, see GetStaleID
+	// and GetStaleSecret.
+	Stale time.Duration
+}
+
+// Override is the TTL of secrets whose key matches the glob Key and that
+// are in Project. An empty Key or Project matches any secret.
+type Override struct {
+	Key     string
+	Project string
+	TTL     time.Duration
+}
+
+func (override Override) matches(meta Metadata) bool {
+	if override.Project != "" && override.Project != meta.ProjectID {
+		return false
+	}
+	if override.Key == "" {
+		return true
+	}
+	ok, _ := path.Match(override.Key, meta.Key)
+	return ok
+}
+
+// secret returns the TTL of the secret described by meta.
+func (ttls *TTLs) secret(meta Metadata) time.Duration {
+	for _, override := range ttls.Overrides {
+		if override.matches(meta) {
+			return override.TTL
+		}
+	}
+	if meta.TTL > 0 {
+		noteMax := ttls.NoteMax
+		if noteMax == 0 {
+			noteMax = ttls.Secrets
+		}
+		return min(meta.TTL, noteMax)
+	}
+	return ttls.Secrets
+}
+
+// jitter shortens ttl by a random fraction of up to Jitter.
+func (ttls *TTLs) jitter(ttl time.Duration) time.Duration {
+	if ttls.Jitter <= 0 {
+		return ttl
+	}
+	return ttl - time.Duration(rand.Float64()*ttls.Jitter*float64(ttl))
+}
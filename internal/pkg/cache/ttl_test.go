@@ -0,0 +1,37 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSecretTTL(t *testing.T) {
+	overrides := []Override{
+		{Key: "db_*", TTL: time.Minute},
+		{Project: "project-1", TTL: 4 * time.Hour},
+	}
+	tests := []struct {
+		name    string
+		noteMax time.Duration
+		meta    Metadata
+		ttl     time.Duration
+	}{
+		{"default", 0, Metadata{Key: "api_key"}, 15 * time.Minute},
+		{"key override", 0, Metadata{Key: "db_password"}, time.Minute},
+		{"project override", 0, Metadata{Key: "api_key", ProjectID: "project-1"}, 4 * time.Hour},
+		{"first override wins", 0, Metadata{Key: "db_password", ProjectID: "project-1"}, time.Minute},
+		{"shorter note", 0, Metadata{Key: "api_key", TTL: 5 * time.Minute}, 5 * time.Minute},
+		{"note capped at secret ttl", 0, Metadata{Key: "api_key", TTL: 24 * time.Hour}, 15 * time.Minute},
+		{"note capped at max", time.Hour, Metadata{Key: "api_key", TTL: 24 * time.Hour}, time.Hour},
+		{"note under max", time.Hour, Metadata{Key: "api_key", TTL: 30 * time.Minute}, 30 * time.Minute},
+		{"override wins over note", time.Hour, Metadata{Key: "db_password", TTL: 30 * time.Minute}, time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ttls := TTLs{Secrets: 15 * time.Minute, Overrides: overrides, NoteMax: test.noteMax}
+			if ttl := ttls.secret(test.meta); ttl != test.ttl {
+				t.Errorf("got %s, want %s", ttl, test.ttl)
+			}
+		})
+	}
+}
@@ -5,118 +5,425 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
-	"sync"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"bws-cache/internal/pkg/cache"
+	"bws-cache/internal/pkg/metrics"
+	"bws-cache/internal/pkg/redact"
+	"bws-cache/internal/pkg/trace"
 
 	sdk "github.com/bitwarden/sdk-go"
 	"github.com/google/uuid"
 )
 
+type Endpoints struct {
+	APIURL      string
+	IdentityURL string
+}
+
+// Regions are the Bitwarden cloud regions that can be selected by name.
+var Regions = map[string]Endpoints{
+	"us": {
+		APIURL:      "https://api.bitwarden.com",
+		IdentityURL: "https://identity.bitwarden.com",
+	},
+	"eu": {
+		APIURL:      "https://api.bitwarden.eu",
+		IdentityURL: "https://identity.bitwarden.eu",
+	},
+}
+
+// SelfHosted returns the endpoints of a self-hosted server at serverURL.
+func SelfHosted(serverURL string) Endpoints {
+	serverURL = strings.TrimSuffix(serverURL, "/")
+	return Endpoints{
+		APIURL:      serverURL + "/api",
+		IdentityURL: serverURL + "/identity",
+	}
+}
+
+// TokenStateDir is where AccessTokenLogin writes its state files.
+var TokenStateDir = "/tmp"
+
+// NewSDKClient creates the SDK clients that call Bitwarden.
+var NewSDKClient = sdk.NewBitwardenClient
+
 type Bitwarden struct {
 	Client    sdk.BitwardenClientInterface
 	Cache     *cache.Cache
+	Endpoints Endpoints
+	Metrics   *metrics.BwsMetrics
 	tokenPath string
-	mu        sync.Mutex
+	mu        priorityLock
+	// inFlight counts calls to Bitwarden waiting for or holding mu.
+	inFlight atomic.Int64
+	// sessions counts open SDK clients.
+	sessions atomic.Int64
+	// refreshOnMiss lists the keymap again when a key isn't in it, see
+	// SetRefreshOnMiss.
+	refreshOnMiss atomic.Bool
 }
 
-func New(ttl time.Duration) *Bitwarden {
-	bw := Bitwarden{}
+// New returns a client for endpoints with a cache of ttl, recording
+// measurements to metrics if it isn't nil.
+func New(ttl time.Duration, endpoints Endpoints, metrics *metrics.BwsMetrics) *Bitwarden {
+	bw := Bitwarden{Endpoints: endpoints, Metrics: metrics}
 	slog.Debug("Setting up cache")
-	bw.Cache = cache.New(ttl)
-	bw.tokenPath = fmt.Sprintf("/tmp/%s", uuid.New())
+	bw.Cache = cache.New(ttl, metrics)
+	bw.tokenPath = filepath.Join(TokenStateDir, uuid.New().String())
+	bw.refreshOnMiss.Store(true)
 	return &bw
 }
 
-func (b *Bitwarden) connect(token string) error {
-	slog.Debug("Creating new bitwarden client connection")
-	return b.newClient(token)
+// SetRefreshOnMiss sets whether GetByKey lists the keymap again when a key
+// isn't in it. If not, the keymap is only listed once it has expired.
+func (b *Bitwarden) SetRefreshOnMiss(refresh bool) {
+	b.refreshOnMiss.Store(refresh)
+}
+
+func (b *Bitwarden) connect(ctx context.Context, token string) error {
+	slog.DebugContext(ctx, "Creating new bitwarden client connection")
+	return b.newClient(ctx, token)
 }
 
-func (b *Bitwarden) newClient(token string) error {
-	b.Client, _ = sdk.NewBitwardenClient(nil, nil)
-	return b.Client.AccessTokenLogin(token, &b.tokenPath)
+func (b *Bitwarden) newClient(ctx context.Context, token string) error {
+	b.Client, _ = NewSDKClient(&b.Endpoints.APIURL, &b.Endpoints.IdentityURL)
+	b.Metrics.Gauge("sdk_sessions", nil, float64(b.sessions.Add(1)))
+	done := b.call(ctx, "login")
+	err := b.Client.AccessTokenLogin(token, &b.tokenPath)
+	done(err)
+	if err == nil {
+		redact.AddToken(token)
+	}
+	return err
 }
 
 func (b *Bitwarden) close() {
 	slog.Debug("Closing bitwarden client connection")
 	b.Client.Close()
+	b.Metrics.Gauge("sdk_sessions", nil, float64(b.sessions.Add(-1)))
+}
+
+// call starts timing an SDK operation. The returned func records its
+// duration and outcome in a span and the upstream_call histogram.
+func (b *Bitwarden) call(ctx context.Context, operation string) func(error) {
+	start := time.Now()
+	_, span := trace.StartKind(ctx, "sdk."+operation, trace.Client)
+	return func(err error) {
+		span.SetError(err)
+		span.Finish()
+		outcome := "success"
+		if err != nil {
+			outcome = "error"
+		}
+		b.Metrics.Duration("upstream_call", map[string]string{"operation": operation, "outcome": outcome}, start)
+	}
+}
+
+// lock locks mu, timing the wait for other calls to Bitwarden in a span.
+// Background calls wait until no request is waiting.
+func (b *Bitwarden) lock(ctx context.Context) {
+	_, span := trace.Start(ctx, "client.lock_wait")
+	if background(ctx) {
+		span.SetAttribute("background", true)
+		b.mu.LockBackground()
+	} else {
+		b.mu.Lock()
+	}
+	span.Finish()
+}
+
+// lookup reads from the cache in a span.
+func lookup(ctx context.Context, name string, get func() string) string {
+	_, span := trace.Start(ctx, "cache."+name)
+	value := get()
+	span.SetAttribute("cache.hit", value != "")
+	span.Finish()
+	return value
+}
+
+// fetching tracks a call to Bitwarden from before it waits for mu until
+// done is called.
+func (b *Bitwarden) fetching() (done func()) {
+	b.Metrics.Gauge("upstream_in_flight", nil, float64(b.inFlight.Add(1)))
+	return func() {
+		b.Metrics.Gauge("upstream_in_flight", nil, float64(b.inFlight.Add(-1)))
+	}
 }
 
-func (b *Bitwarden) GetByID(ctx context.Context, id string, clientToken string) (string, error) {
+// Shutdown waits for any in-flight upstream call to finish, then stops the
+// cache and removes the token state file left behind by AccessTokenLogin.
+func (b *Bitwarden) Shutdown() {
+	slog.Debug("Shutdown: Locking client")
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.Cache.Stop()
+	err := os.Remove(b.tokenPath)
+	if err != nil && !os.IsNotExist(err) {
+		slog.Error(fmt.Sprintf("Unable to remove token state file: %v", err))
+	}
+}
+
+// GetByID returns the secret with id, from the cache if it is as fresh as
+// the request accepts, see WithFreshness.
+func (b *Bitwarden) GetByID(ctx context.Context, id string, clientToken string) (Result, error) {
 	slog.DebugContext(ctx, fmt.Sprintf("Getting secret by ID: %s", id))
-	value := b.Cache.GetSecret(id)
-	if value != "" {
-		slog.Debug(fmt.Sprintf("%s ID found in cache", id))
-		return value, nil
+	fresh := freshness(ctx)
+	cached := b.cached(ctx, id, clientToken)
+	if fresh.accepts(cached) {
+		slog.DebugContext(ctx, fmt.Sprintf("%s ID found in cache", id))
+		return cached, nil
 	}
 
-	slog.Debug(fmt.Sprintf("%s not found in cache, populating", id))
+	if !fresh.NoCache && b.Cache.IsMissing(cache.Secrets, id, clientToken) {
+		return Result{}, fmt.Errorf("unable to find secret: %s", id)
+	}
+	if fresh.OnlyIfCached {
+		return Result{}, ErrNotCached
+	}
+	slog.DebugContext(ctx, fmt.Sprintf("%s not found in cache, populating", id))
 
-	secret, err := b.getSecretByIDs(ctx, id, clientToken)
-	if secret == nil {
-		return "", fmt.Errorf("unable to find secret: %s", id)
+	if err := guard(ctx); err != nil {
+		return Result{}, err
 	}
+	secret, err := b.getSecretsByIDs(ctx, []string{id}, clientToken)
 	if err != nil {
-		return "", err
+		return b.stale(ctx, id, clientToken, err)
 	}
-
-	secretJson, _ := json.Marshal(secret)
-	b.Cache.SetSecret(id, string(secretJson))
-	return string(secretJson), nil
+	if secret == nil {
+		return Result{}, fmt.Errorf("unable to find secret: %s", id)
+	}
+	if len(secret.Data) == 0 {
+		b.Cache.SetMissing(cache.Secrets, id, clientToken)
+		return Result{}, fmt.Errorf("unable to find secret: %s", id)
+	}
+	return Result{Value: b.store(secret.Data[0], clientToken, true)}, nil
 }
 
-func (b *Bitwarden) GetByKey(ctx context.Context, key string, orgID string, clientToken string) (string, error) {
-	secret := ""
-	id := b.Cache.GetID(key)
+// GetByKey returns the secret with key, from the cache if it is as fresh as
+// the request accepts, see WithFreshness. The keymap is used as long as it
+// is cached, a secret read again that is now under another key lists it
+// again.
+func (b *Bitwarden) GetByKey(ctx context.Context, key string, orgID string, clientToken string) (Result, error) {
+	fresh := freshness(ctx)
+	hit := true
+	id := lookup(ctx, "get_id", func() string { return b.Cache.GetID(key, clientToken) })
+	if id == "" && !fresh.NoCache && b.Cache.IsMissing(cache.Keymap, key, clientToken) {
+		return Result{}, fmt.Errorf("unable to find secret: %s", key)
+	}
+	if id == "" && !fresh.NoCache && !b.refreshOnMiss.Load() && b.Cache.HasKeymap(clientToken, orgID) {
+		slog.DebugContext(ctx, fmt.Sprintf("%s not found in keymap, not refreshing it", key))
+		return Result{}, fmt.Errorf("unable to find secret: %s", key)
+	}
 	if id == "" {
+		if fresh.OnlyIfCached {
+			return Result{}, ErrNotCached
+		}
 		slog.DebugContext(ctx, fmt.Sprintf("%s not found in cache, populating", key))
+		hit = false
 
-		keyList, err := b.getSecretList(ctx, orgID, clientToken)
+		if err := guard(ctx); err != nil {
+			return Result{}, err
+		}
+		var err error
+		id, err = b.refreshKeymap(ctx, key, orgID, clientToken)
 		if err != nil {
-			return "", err
+			return b.stale(ctx, b.Cache.GetStaleID(key, clientToken), clientToken, err)
 		}
-		found := false
-		for _, keyPair := range keyList.Data {
-			b.Cache.SetID(keyPair.Key, keyPair.ID)
-			// To avoid running into throttling from Bitwarden only
-			// cache the secret value for what was asked for rather
-			// than caching every secret returned. The key/id mapping
-			// will still expire at the same time necessating another
-			// query, but it returns all of them with a single query anyway
-			if keyPair.Key == key {
-				found = true
-			}
+		if id == "" {
+			b.Cache.SetMissing(cache.Keymap, key, clientToken)
+			return Result{}, fmt.Errorf("unable to find secret: %s", key)
 		}
-		if !found {
-			return "", fmt.Errorf("unable to find secret: %s", key)
+	}
+	cached := b.cached(ctx, id, clientToken)
+	if fresh.accepts(cached) {
+		cached.Hit = hit
+		return cached, nil
+	}
+	if fresh.OnlyIfCached {
+		return Result{}, ErrNotCached
+	}
+	slog.DebugContext(ctx, fmt.Sprintf("%s not found in cache, populating", key))
+	if err := guard(ctx); err != nil {
+		return Result{}, err
+	}
+	bwsSecret, err := b.getSecret(ctx, id, clientToken)
+	if err != nil {
+		return b.stale(ctx, id, clientToken, err)
+	}
+	if hit && bwsSecret.Key != key {
+		b.Cache.Renamed(key, id, bwsSecret.Key, orgID, clientToken)
+		b.Cache.SetID(bwsSecret.Key, id, orgID, clientToken)
+		b.store(*bwsSecret, clientToken, false)
+		return b.GetByKey(ctx, key, orgID, clientToken)
+	}
+	return Result{Value: b.store(*bwsSecret, clientToken, false)}, nil
+}
+
+// store caches secret read with clientToken and returns it as served by
+// GetByID if list is set, or by GetByKey otherwise. Replacing a cached
+// value at another revision is reported as a change.
+func (b *Bitwarden) store(secret sdk.SecretResponse, clientToken string, list bool) string {
+	var value []byte
+	if list {
+		value, _ = json.Marshal(sdk.SecretsResponse{Data: []sdk.SecretResponse{secret}})
+	} else {
+		value, _ = json.Marshal(secret)
+	}
+	meta := metadata(secret)
+	meta.List = list
+	revision, _, cached := b.Cache.CachedRevision(secret.ID, clientToken)
+	b.Cache.SetSecret(secret.ID, string(value), clientToken, meta, secret.Value)
+	if cached && revision != secret.RevisionDate {
+		b.Cache.Replaced(secret.Key, secret.ID)
+	}
+	return string(value)
+}
+
+// metadata describes secret in the cache.
+func metadata(secret sdk.SecretResponse) cache.Metadata {
+	meta := cache.Metadata{
+		Key:          secret.Key,
+		OrgID:        secret.OrganizationID,
+		RevisionDate: secret.RevisionDate,
+		TTL:          noteTTL(secret.Key, secret.Note),
+	}
+	if secret.ProjectID != nil {
+		meta.ProjectID = *secret.ProjectID
+	}
+	return meta
+}
+
+// NoteDirective starts a line in a secret's note with settings for
+// bws-cache, e.g. "bws-cache: ttl=1h".
+const NoteDirective = "bws-cache:"
+
+// noteTTL returns the TTL set by a directive in the note of the secret with
+// key, or 0 if it doesn't set one.
+func noteTTL(key string, note string) time.Duration {
+	for _, line := range strings.Split(note, "\n") {
+		settings, ok := strings.CutPrefix(strings.TrimSpace(line), NoteDirective)
+		if !ok {
+			continue
+		}
+		for _, setting := range strings.FieldsFunc(settings, func(r rune) bool { return r == ' ' || r == ',' }) {
+			name, value, _ := strings.Cut(setting, "=")
+			if name != "ttl" {
+				continue
+			}
+			ttl, err := time.ParseDuration(value)
+			if err != nil || ttl <= 0 {
+				slog.Warn(fmt.Sprintf("Ignoring invalid ttl %q in the note of %s", value, key))
+				continue
+			}
+			return ttl
 		}
-		// Now that the cache is populated we can get the ID and look it up
-		id = b.Cache.GetID(key)
 	}
-	secret = b.Cache.GetSecret(id)
-	if secret == "" {
-		slog.DebugContext(ctx, fmt.Sprintf("%s not found in cache, populating", key))
-		bwsSecret, err := b.getSecret(ctx, id, clientToken)
-		if err != nil {
-			return "", err
+	return 0
+}
+
+// refreshKeymap lists every secret in the org into the keymap, and returns
+// the ID of key, or "" if it isn't listed. Keys and secrets that are no
+// longer listed, or listed under another key, are evicted.
+func (b *Bitwarden) refreshKeymap(ctx context.Context, key string, orgID string, clientToken string) (string, error) {
+	ctx, span := trace.Start(ctx, "keymap.refresh")
+	defer span.Finish()
+	keyList, err := b.getSecretList(ctx, orgID, clientToken)
+	if err != nil {
+		span.SetError(err)
+		return "", err
+	}
+	// To avoid running into throttling from Bitwarden only cache the
+	// secret value for what was asked for rather than caching every
+	// secret returned. The key/id mapping will still expire at the same
+	// time necessating another query, but it returns all of them with a
+	// single query anyway
+	listed := make(map[string]string, len(keyList.Data))
+	for _, keyPair := range keyList.Data {
+		listed[keyPair.Key] = keyPair.ID
+	}
+	changes := b.Cache.UpdateKeymap(clientToken, orgID, listed)
+	span.SetAttribute("keymap.keys", len(keyList.Data))
+	span.SetAttribute("keymap.changes", len(changes))
+	return listed[key], nil
+}
+
+// replaceRevised caches secret again if it was cached with clientToken at
+// another revision, rather than evicting a value that was already read,
+// reporting whether it did.
+func (b *Bitwarden) replaceRevised(secret sdk.SecretResponse, clientToken string) bool {
+	revision, list, ok := b.Cache.CachedRevision(secret.ID, clientToken)
+	if !ok || revision == secret.RevisionDate {
+		return false
+	}
+	b.store(secret, clientToken, list)
+	return true
+}
+
+// GetProjectName returns the name of a project, listing every project in the
+// org to populate the cache on a miss.
+func (b *Bitwarden) GetProjectName(ctx context.Context, projectID string, orgID string, clientToken string) (string, error) {
+	name := lookup(ctx, "get_project", func() string { return b.Cache.GetProject(projectID) })
+	if name != "" {
+		return name, nil
+	}
+
+	slog.DebugContext(ctx, fmt.Sprintf("Project %s not found in cache, populating", projectID))
+	if err := guard(ctx); err != nil {
+		return "", err
+	}
+	projects, err := b.getProjectList(ctx, orgID, clientToken)
+	if err != nil {
+		return "", err
+	}
+	for _, project := range projects.Data {
+		b.Cache.SetProject(project.ID, project.Name)
+		if project.ID == projectID {
+			name = project.Name
 		}
-		storedSecret, _ := json.Marshal(bwsSecret)
-		b.Cache.SetSecret(id, string(storedSecret))
-		secret = string(storedSecret)
 	}
-	return secret, nil
+	if name == "" {
+		return "", fmt.Errorf("unable to find project: %s", projectID)
+	}
+	return name, nil
+}
+
+func (b *Bitwarden) getProjectList(ctx context.Context, orgID string, clientToken string) (*sdk.ProjectsResponse, error) {
+	defer b.fetching()()
+	slog.DebugContext(ctx, "getProjectList: Locking client")
+	b.lock(ctx)
+
+	slog.DebugContext(ctx, "getProjectList: Opening client")
+	b.connect(ctx, clientToken)
+
+	done := b.call(ctx, "projects_list")
+	res, err := b.Client.Projects().List(orgID)
+	done(err)
+	slog.DebugContext(ctx, "getProjectList: Closing client")
+	b.close()
+
+	slog.DebugContext(ctx, "getProjectList: Unlocking client")
+	b.mu.Unlock()
+
+	return res, err
 }
 
 func (b *Bitwarden) getSecretList(ctx context.Context, orgID string, clientToken string) (*sdk.SecretIdentifiersResponse, error) {
+	defer b.fetching()()
 	slog.DebugContext(ctx, "getSecretList: Locking client")
-	b.mu.Lock()
+	b.lock(ctx)
 
 	slog.DebugContext(ctx, "getSecretList: Opening client")
-	b.connect(clientToken)
+	b.connect(ctx, clientToken)
 
+	done := b.call(ctx, "secrets_list")
 	res, err := b.Client.Secrets().List(orgID)
+	done(err)
 	slog.DebugContext(ctx, "getSecretList: Closing client")
 	b.close()
 
@@ -127,13 +434,16 @@ func (b *Bitwarden) getSecretList(ctx context.Context, orgID string, clientToken
 }
 
 func (b *Bitwarden) getSecret(ctx context.Context, id string, clientToken string) (*sdk.SecretResponse, error) {
+	defer b.fetching()()
 	slog.DebugContext(ctx, "getSecret: Locking client")
-	b.mu.Lock()
+	b.lock(ctx)
 
 	slog.DebugContext(ctx, "getSecret: Opening client")
-	b.connect(clientToken)
+	b.connect(ctx, clientToken)
 
+	done := b.call(ctx, "secrets_get")
 	res, err := b.Client.Secrets().Get(id)
+	done(err)
 	slog.DebugContext(ctx, "getSecret: Closing Client")
 	b.close()
 
@@ -143,21 +453,22 @@ func (b *Bitwarden) getSecret(ctx context.Context, id string, clientToken string
 	return res, err
 }
 
-func (b *Bitwarden) getSecretByIDs(ctx context.Context, id string, clientToken string) (*sdk.SecretsResponse, error) {
-	slog.DebugContext(ctx, "getSecretByIDs: Locking client")
-	b.mu.Lock()
+func (b *Bitwarden) getSecretsByIDs(ctx context.Context, ids []string, clientToken string) (*sdk.SecretsResponse, error) {
+	defer b.fetching()()
+	slog.DebugContext(ctx, "getSecretsByIDs: Locking client")
+	b.lock(ctx)
 
-	slog.DebugContext(ctx, "getSecretByIDs: Opening client")
-	b.connect(clientToken)
+	slog.DebugContext(ctx, "getSecretsByIDs: Opening client")
+	b.connect(ctx, clientToken)
 
-	secretIDs := make([]string, 1)
-	secretIDs[0] = id
-	res, err := b.Client.Secrets().GetByIDS(secretIDs)
+	done := b.call(ctx, "secrets_get_by_ids")
+	res, err := b.Client.Secrets().GetByIDS(ids)
+	done(err)
 
-	slog.DebugContext(ctx, "getSecretByIDs: Closing client")
+	slog.DebugContext(ctx, "getSecretsByIDs: Closing client")
 	b.close()
 
-	slog.DebugContext(ctx, "getSecretByIDs: Unlocking client")
+	slog.DebugContext(ctx, "getSecretsByIDs: Unlocking client")
 	b.mu.Unlock()
 
 	return res, err
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// ErrNotCached is returned for a request that may only be served from the
+// cache when the cache can't serve it.
+var ErrNotCached = errors.New("secret is not cached")
+
+type freshnessKey struct{}
+
+// Freshness is what a request accepts from the cache.
+type Freshness struct {
+	// NoCache reads secrets from Bitwarden even if they are cached.
+	NoCache bool
+	// MaxAge reads secrets cached longer ago than MaxAge from Bitwarden,
+	// unless it is 0.
+	MaxAge time.Duration
+	// OnlyIfCached returns ErrNotCached rather than calling Bitwarden.
+	OnlyIfCached bool
+}
+
+func (f Freshness) accepts(cached Result) bool {
+	return cached.Value != "" && !f.NoCache && (f.MaxAge == 0 || cached.Age <= f.MaxAge)
+}
+
+// WithFreshness returns a context for requests that only accept secrets
+// from the cache as fresh as freshness.
+func WithFreshness(ctx context.Context, freshness Freshness) context.Context {
+	return context.WithValue(ctx, freshnessKey{}, freshness)
+}
+
+func freshness(ctx context.Context) Freshness {
+	freshness, _ := ctx.Value(freshnessKey{}).(Freshness)
+	return freshness
+}
+
+// Result is a secret returned by GetByID or GetByKey.
+type Result struct {
+	Value string
+	// Hit is set when the secret was served from the cache, and Stale when
+	// it had expired but couldn't be read again from Bitwarden.
+	Hit   bool
+	Stale bool
+	// Age is how long ago the secret was read from Bitwarden.
+	Age time.Duration
+}
+
+// cached looks up the secret with id in the cache.
+func (b *Bitwarden) cached(ctx context.Context, id string, clientToken string) Result {
+	var created time.Time
+	value := lookup(ctx, "get_secret", func() string {
+		var value string
+		value, created = b.Cache.GetSecretEntry(id, clientToken)
+		return value
+	})
+	if value == "" {
+		return Result{}
+	}
+	return Result{Value: value, Hit: true, Age: time.Since(created)}
+}
+
+// stale serves the secret with id as cached with clientToken, if it expired
+// less than TTLs.Stale ago, when reading it again from Bitwarden failed with
+// err. A request that asked for a fresher secret gets err.
+func (b *Bitwarden) stale(ctx context.Context, id string, clientToken string, err error) (Result, error) {
+	fresh := freshness(ctx)
+	if id == "" || fresh.NoCache || fresh.MaxAge > 0 {
+		return Result{}, err
+	}
+	value, created := b.Cache.GetStaleSecret(id, clientToken)
+	if value == "" {
+		return Result{}, err
+	}
+	slog.WarnContext(ctx, fmt.Sprintf("Serving expired secret %s after failing to read it again: %v", id, err))
+	return Result{Value: value, Hit: true, Stale: true, Age: time.Since(created)}, nil
+}
@@ -0,0 +1,149 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"bws-cache/internal/pkg/cache"
+	"bws-cache/internal/pkg/sdktest"
+)
+
+func TestNoCacheReturnsUpstreamError(t *testing.T) {
+	bw := sdktest.New(token)
+	id := bw.AddSecret(orgID, "", "db_password", "value", "")
+	b := newTestClient(t, bw)
+	ctx := context.Background()
+	if _, err := b.GetByID(ctx, id, token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.GetByKey(ctx, "db_password", orgID, token); err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := errors.New("API error: 401 Unauthorized")
+	bw.Fail(upstream)
+	ctx = WithFreshness(ctx, Freshness{NoCache: true})
+	if res, err := b.GetByID(ctx, id, token); !errors.Is(err, upstream) {
+		t.Errorf("got %+v, %v by ID, want the upstream error", res, err)
+	}
+	if res, err := b.GetByKey(ctx, "db_password", orgID, token); !errors.Is(err, upstream) {
+		t.Errorf("got %+v, %v by key, want the upstream error", res, err)
+	}
+}
+
+func TestNoCacheRefreshesKeymap(t *testing.T) {
+	bw := sdktest.New(token)
+	bw.AddSecret(orgID, "", "db_password", "value", "")
+	b := newTestClient(t, bw)
+	ctx := context.Background()
+	if _, err := b.GetByKey(ctx, "api_key", orgID, token); err == nil {
+		t.Fatal("found a key that doesn't exist")
+	}
+	bw.AddSecret(orgID, "", "api_key", "new-value", "")
+
+	if _, err := b.GetByKey(ctx, "api_key", orgID, token); err == nil {
+		t.Error("found a key cached as missing without no-cache")
+	}
+	res, err := b.GetByKey(WithFreshness(ctx, Freshness{NoCache: true}), "api_key", orgID, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Hit || !strings.Contains(res.Value, "new-value") {
+		t.Errorf("got %+v, want the new secret read from Bitwarden", res)
+	}
+}
+
+func TestStaleOnUpstreamError(t *testing.T) {
+	bw := sdktest.New(token)
+	id := bw.AddSecret(orgID, "", "db_password", "value", "")
+	b := newTestClient(t, bw)
+	b.Cache.SetTTLs(cache.TTLs{Keymap: time.Millisecond, Secrets: time.Millisecond, Stale: time.Minute})
+	ctx := context.Background()
+	if _, err := b.GetByKey(ctx, "db_password", orgID, token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.GetByID(ctx, id, token); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	upstream := errors.New("connection refused")
+	bw.Fail(upstream)
+
+	tests := []struct {
+		name      string
+		freshness Freshness
+		stale     bool
+	}{
+		{"default", Freshness{}, true},
+		{"no-cache", Freshness{NoCache: true}, false},
+		{"max-age", Freshness{MaxAge: time.Hour}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := WithFreshness(ctx, test.freshness)
+			for name, get := range map[string]func() (Result, error){
+				"id":  func() (Result, error) { return b.GetByID(ctx, id, token) },
+				"key": func() (Result, error) { return b.GetByKey(ctx, "db_password", orgID, token) },
+			} {
+				res, err := get()
+				if !test.stale {
+					if !errors.Is(err, upstream) {
+						t.Errorf("got %+v, %v by %s, want the upstream error", res, err, name)
+					}
+					continue
+				}
+				if err != nil || !res.Stale || !strings.Contains(res.Value, "value") {
+					t.Errorf("got %+v, %v by %s, want the expired secret", res, err, name)
+				}
+			}
+		})
+	}
+}
+
+func TestNoCacheReadsOnlyTheSecret(t *testing.T) {
+	bw := sdktest.New(token)
+	id := bw.AddSecret(orgID, "", "db_password", "old-value", "")
+	b := newTestClient(t, bw)
+	ctx := context.Background()
+	if _, err := b.GetByKey(ctx, "db_password", orgID, token); err != nil {
+		t.Fatal(err)
+	}
+	bw.SetValue(id, "new-value")
+
+	res, err := b.GetByKey(WithFreshness(ctx, Freshness{NoCache: true}), "db_password", orgID, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Hit || !strings.Contains(res.Value, "new-value") {
+		t.Errorf("got %+v, want the new value read from Bitwarden", res)
+	}
+	if calls := bw.Calls("secrets.list"); calls != 1 {
+		t.Errorf("got %d calls to list secrets, want 1", calls)
+	}
+}
+
+func TestNoCacheFindsRenamedKey(t *testing.T) {
+	bw := sdktest.New(token)
+	old := bw.AddSecret(orgID, "", "db_password", "old-value", "")
+	b := newTestClient(t, bw)
+	ctx := context.Background()
+	if _, err := b.GetByKey(ctx, "db_password", orgID, token); err != nil {
+		t.Fatal(err)
+	}
+	bw.SetKey(old, "db_password_old")
+	bw.AddSecret(orgID, "", "db_password", "new-value", "")
+
+	res, err := b.GetByKey(WithFreshness(ctx, Freshness{NoCache: true}), "db_password", orgID, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(res.Value, "new-value") {
+		t.Errorf("got %s, want the secret now under the key", res.Value)
+	}
+	if id := b.Cache.GetID("db_password_old", token); id != old {
+		t.Errorf("got ID %q for the new key of the renamed secret, want %s", id, old)
+	}
+}
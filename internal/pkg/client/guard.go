@@ -0,0 +1,21 @@
+package client
+
+import "context"
+
+type guardKey struct{}
+
+// Guard is called before each call to Bitwarden made for a request, and
+// stops the call when it returns an error.
+type Guard func() error
+
+// WithGuard returns a context that runs guard before calls to Bitwarden.
+func WithGuard(ctx context.Context, guard Guard) context.Context {
+	return context.WithValue(ctx, guardKey{}, guard)
+}
+
+func guard(ctx context.Context) error {
+	if guard, ok := ctx.Value(guardKey{}).(Guard); ok {
+		return guard()
+	}
+	return nil
+}
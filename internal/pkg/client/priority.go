@@ -0,0 +1,61 @@
+package client
+
+import (
+	"context"
+	"sync"
+)
+
+type backgroundKey struct{}
+
+// WithBackground returns a context for calls to Bitwarden that no request
+// is waiting on, which give way to calls made for requests.
+func WithBackground(ctx context.Context) context.Context {
+	return context.WithValue(ctx, backgroundKey{}, true)
+}
+
+func background(ctx context.Context) bool {
+	return ctx.Value(backgroundKey{}) != nil
+}
+
+// priorityLock is a mutex that is only handed to a background caller while
+// no foreground caller is waiting for it. The zero value is unlocked.
+type priorityLock struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	held bool
+	// waiting counts the foreground callers waiting for the lock.
+	waiting int
+}
+
+// Lock locks l for a foreground caller.
+func (l *priorityLock) Lock() {
+	l.lock(false)
+}
+
+// LockBackground locks l once no foreground caller is waiting for it.
+func (l *priorityLock) LockBackground() {
+	l.lock(true)
+}
+
+func (l *priorityLock) lock(background bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cond == nil {
+		l.cond = sync.NewCond(&l.mu)
+	}
+	if !background {
+		l.waiting++
+		defer func() { l.waiting-- }()
+	}
+	for l.held || (background && l.waiting > 0) {
+		l.cond.Wait()
+	}
+	l.held = true
+}
+
+func (l *priorityLock) Unlock() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.held = false
+	l.cond.Broadcast()
+}
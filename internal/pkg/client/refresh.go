@@ -0,0 +1,147 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"bws-cache/internal/pkg/trace"
+)
+
+// RefreshAhead re-reads the secrets cached with token that were read at
+// least minHits times and expire within window, so they don't expire while
+// in use. The keymap is listed again too if it holds one of their keys and
+// expires within window. It returns the number of secrets refreshed.
+func (b *Bitwarden) RefreshAhead(ctx context.Context, token string, window time.Duration, minHits int64) (int, error) {
+	due := b.Cache.DueForRefresh(token, window, minHits)
+	if len(due) == 0 {
+		return 0, nil
+	}
+	ctx, span := trace.Start(ctx, "cache.refresh_ahead")
+	defer span.Finish()
+	slog.DebugContext(ctx, fmt.Sprintf("Refreshing %d secrets ahead of expiry", len(due)))
+
+	var errs []error
+	deadline := time.Now().Add(window)
+	orgs := make(map[string]bool)
+	ids := make([]string, 0, len(due))
+	for id, meta := range due {
+		ids = append(ids, id)
+		expires := b.Cache.KeyExpires(meta.Key, token)
+		if !orgs[meta.OrgID] && !expires.IsZero() && expires.Before(deadline) {
+			orgs[meta.OrgID] = true
+			if err := guard(ctx); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if _, err := b.refreshKeymap(ctx, "", meta.OrgID, token); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	slices.Sort(ids)
+
+	if err := guard(ctx); err != nil {
+		span.SetError(err)
+		return 0, errors.Join(append(errs, err)...)
+	}
+	secrets, err := b.getSecretsByIDs(ctx, ids, token)
+	if err != nil {
+		span.SetError(err)
+		return 0, errors.Join(append(errs, err)...)
+	}
+	for _, secret := range secrets.Data {
+		b.store(secret, token, due[secret.ID].List)
+		b.Metrics.Counter("cache_refreshes", map[string]string{"reason": "refresh_ahead"})
+	}
+	span.SetAttribute("cache.refreshed", len(secrets.Data))
+	return len(secrets.Data), errors.Join(errs...)
+}
+
+// Prewarm caches the secrets with keys or ids, and every secret in
+// projects, reading them with token. It returns the number of secrets
+// cached.
+func (b *Bitwarden) Prewarm(ctx context.Context, token string, orgID string, keys []string, ids []string, projects []string) (int, error) {
+	ctx, span := trace.Start(ctx, "cache.prewarm")
+	defer span.Finish()
+
+	var errs []error
+	cached := 0
+	for _, key := range keys {
+		if _, err := b.GetByKey(ctx, key, orgID, token); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		b.Metrics.Counter("cache_refreshes", map[string]string{"reason": "prewarm"})
+		cached++
+	}
+	for _, id := range ids {
+		if _, err := b.GetByID(ctx, id, token); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		b.Metrics.Counter("cache_refreshes", map[string]string{"reason": "prewarm"})
+		cached++
+	}
+	if len(projects) > 0 {
+		n, err := b.prewarmProjects(ctx, token, orgID, projects)
+		cached += n
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	span.SetAttribute("cache.prewarmed", cached)
+	err := errors.Join(errs...)
+	span.SetError(err)
+	return cached, err
+}
+
+// prewarmBatch is how many secrets prewarming by project reads per call.
+const prewarmBatch = 100
+
+// prewarmProjects caches every secret in projects. The list of secrets
+// doesn't include their project, so every listed secret is read, in
+// batches, and the values of those in other projects are dropped straight
+// away.
+func (b *Bitwarden) prewarmProjects(ctx context.Context, token string, orgID string, projects []string) (int, error) {
+	if err := guard(ctx); err != nil {
+		return 0, err
+	}
+	keyList, err := b.getSecretList(ctx, orgID, token)
+	if err != nil {
+		return 0, err
+	}
+	listed := make(map[string]string, len(keyList.Data))
+	ids := make([]string, 0, len(keyList.Data))
+	for _, keyPair := range keyList.Data {
+		listed[keyPair.Key] = keyPair.ID
+		ids = append(ids, keyPair.ID)
+	}
+	b.Cache.UpdateKeymap(token, orgID, listed)
+
+	cached := 0
+	for start := 0; start < len(ids); start += prewarmBatch {
+		if err := guard(ctx); err != nil {
+			return cached, err
+		}
+		secrets, err := b.getSecretsByIDs(ctx, ids[start:min(start+prewarmBatch, len(ids))], token)
+		if err != nil {
+			return cached, err
+		}
+		for _, secret := range secrets.Data {
+			if secret.ProjectID == nil || !slices.Contains(projects, *secret.ProjectID) {
+				if !b.replaceRevised(secret, token) {
+					b.Cache.CheckRevision(secret.ID, secret.RevisionDate)
+				}
+				continue
+			}
+			b.store(secret, token, false)
+			b.Metrics.Counter("cache_refreshes", map[string]string{"reason": "prewarm"})
+			cached++
+		}
+	}
+	return cached, nil
+}
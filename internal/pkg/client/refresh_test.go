@@ -0,0 +1,95 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"bws-cache/internal/pkg/cache"
+	"bws-cache/internal/pkg/sdktest"
+)
+
+const (
+	orgID = "7f3a3c5e-2a0b-4e8e-9d43-1c1f3f0b9a11"
+	token = "server-token-0001"
+)
+
+// newTestClient returns a client reading from bw.
+func newTestClient(t *testing.T, bw *sdktest.Bitwarden) *Bitwarden {
+	t.Helper()
+	newSDKClient, tokenStateDir := NewSDKClient, TokenStateDir
+	NewSDKClient, TokenStateDir = bw.NewClient, t.TempDir()
+	t.Cleanup(func() { NewSDKClient, TokenStateDir = newSDKClient, tokenStateDir })
+	b := New(time.Minute, Endpoints{}, nil)
+	t.Cleanup(b.Shutdown)
+	return b
+}
+
+func TestPrewarmProjects(t *testing.T) {
+	bw := sdktest.New(token)
+	billing := bw.AddProject(orgID, "Billing")
+	web := bw.AddProject(orgID, "Web")
+	var want []string
+	for i := 0; i < prewarmBatch+1; i++ {
+		want = append(want, bw.AddSecret(orgID, billing, fmt.Sprintf("billing_%03d", i), "value", ""))
+	}
+	other := bw.AddSecret(orgID, web, "web_db", "web-value", "")
+	b := newTestClient(t, bw)
+
+	cached, err := b.Prewarm(context.Background(), token, orgID, nil, nil, []string{billing})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached != len(want) {
+		t.Errorf("cached %d secrets, want %d", cached, len(want))
+	}
+	ids := b.Cache.CachedIDs(token, orgID)
+	slices.Sort(ids)
+	slices.Sort(want)
+	if !slices.Equal(ids, want) || slices.Contains(ids, other) {
+		t.Errorf("got cached IDs %v, want those of the project", ids)
+	}
+	if calls := bw.Calls("secrets.get_by_ids"); calls != 2 {
+		t.Errorf("got %d calls to get secrets by IDs, want 2 batches", calls)
+	}
+	if calls := bw.Calls("secrets.sync"); calls != 0 {
+		t.Errorf("got %d calls to sync secrets, want 0", calls)
+	}
+}
+
+func TestRefreshKeymapKeepsCachedSecrets(t *testing.T) {
+	bw := sdktest.New(token)
+	id := bw.AddSecret(orgID, "", "db_password", "old-value", "")
+	b := newTestClient(t, bw)
+	var changes []cache.Change
+	b.Cache.OnChange(func(change cache.Change) { changes = append(changes, change) })
+
+	ctx := context.Background()
+	if _, err := b.GetByKey(ctx, "db_password", orgID, token); err != nil {
+		t.Fatal(err)
+	}
+	bw.SetValue(id, "new-value")
+	// A key that isn't listed lists the keymap again, which doesn't read
+	// the cached secrets again.
+	if _, err := b.GetByKey(ctx, "missing", orgID, token); err == nil {
+		t.Fatal("found a key that doesn't exist")
+	}
+	if calls := bw.Calls("secrets.get") + bw.Calls("secrets.get_by_ids"); calls != 1 {
+		t.Errorf("got %d calls to get secrets, want 1", calls)
+	}
+
+	// Reading it again finds the new revision.
+	res, err := b.GetByKey(WithFreshness(ctx, Freshness{NoCache: true}), "db_password", orgID, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(res.Value, "new-value") {
+		t.Errorf("got %s, want the revised value", res.Value)
+	}
+	if len(changes) != 1 || changes[0].Kind != cache.Revised || changes[0].ID != id {
+		t.Errorf("got changes %v, want %s revised", changes, id)
+	}
+}
@@ -1,23 +1,301 @@
 package config
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
 	_ "embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"bws-cache/internal/pkg/client"
 
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Port          int           `mapstructure:"port"`
-	LogLevel      string        `mapstructure:"log_level"`
-	OrgID         string        `mapstructure:"org_id"`
-	SecretTTL     time.Duration `mapstructure:"secret_ttl"`
-	WebTTL        time.Duration `mapstructure:"web_ttl"`
-	RefreshKeyMap bool          `mapstructure:"refresh_keymap_on_miss"`
-	Connection    client.Bitwarden
+	Port     int    `mapstructure:"port"`
+	LogLevel string `mapstructure:"log_level"`
+	// DebugKey signs tokens that enable debug logging of a single request.
+	DebugKey string `mapstructure:"debug_key" redact:"true"`
+	// LogFormat is json or text.
+	LogFormat string `mapstructure:"log_format"`
+	// LogRedactPatterns are regular expressions masked in logs, in
+	// addition to tokens and secret values.
+	LogRedactPatterns []string `mapstructure:"log_redact_patterns"`
+	Upstream          `mapstructure:",squash"`
+	SecretTTL         time.Duration `mapstructure:"secret_ttl"`
+	WebTTL            time.Duration `mapstructure:"web_ttl"`
+	RefreshKeyMap     bool          `mapstructure:"refresh_keymap_on_miss"`
+	ShutdownTimeout   time.Duration `mapstructure:"shutdown_timeout"`
+	// KeymapTTL is the TTL of the keymap and project names, 0 uses
+	// SecretTTL.
+	KeymapTTL time.Duration `mapstructure:"keymap_ttl"`
+	// NegativeTTL is how long secrets that weren't found are remembered, 0
+	// doesn't remember them.
+	NegativeTTL time.Duration `mapstructure:"negative_ttl"`
+	// TTLJitter shortens each TTL by a random fraction of up to TTLJitter.
+	TTLJitter float64 `mapstructure:"ttl_jitter"`
+	// TTLOverrides set the TTL of matching secrets in place of SecretTTL,
+	// the first match wins.
+	TTLOverrides []TTLOverride `mapstructure:"ttl_overrides"`
+	// NoteTTLMax caps the TTL a secret sets in its note, 0 uses SecretTTL.
+	NoteTTLMax time.Duration `mapstructure:"note_ttl_max"`
+	// StaleTTL is how long expired keys and secrets are kept to serve when
+	// they can't be read again from Bitwarden, 0 doesn't keep them.
+	StaleTTL time.Duration `mapstructure:"stale_ttl"`
+	// Profiles are additional named upstreams, selected per request with
+	// the X-BWS-Profile header or a /profile/<name> path prefix.
+	Profiles map[string]Upstream `mapstructure:"profiles"`
+	// Tokens are BWS access tokens held by the server, by name.
+	Tokens map[string]string `mapstructure:"tokens" redact:"true"`
+	// TokensFile is a YAML file of more named tokens, merged into Tokens.
+	TokensFile string   `mapstructure:"tokens_file"`
+	APIKeys    []APIKey `mapstructure:"api_keys"`
+	JWT        JWT      `mapstructure:"jwt"`
+	// AllowClientTokens lets clients send their own BWS access token
+	// instead of a local API key.
+	AllowClientTokens bool `mapstructure:"allow_client_tokens"`
+	// PolicyFile holds access policy rules, see the policy package.
+	PolicyFile string `mapstructure:"policy_file"`
+	// PolicyDryRun logs policy decisions without enforcing them.
+	PolicyDryRun bool   `mapstructure:"policy_dry_run"`
+	TLS          TLS    `mapstructure:"tls"`
+	Socket       Socket `mapstructure:"socket"`
+	// Peers map local processes connecting over Socket to a token.
+	Peers   []Peer  `mapstructure:"peers"`
+	Audit   Audit   `mapstructure:"audit"`
+	Tracing Tracing `mapstructure:"tracing"`
+	// TrustedProxies are the addresses of proxies whose X-Forwarded-For
+	// and X-Real-IP headers are honored.
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+	SecretAccess   CIDRList `mapstructure:"secret_access"`
+	AdminAccess    CIDRList `mapstructure:"admin_access"`
+	// AdminKeys authenticate callers of the admin endpoints. Without any,
+	// those are only served on the Unix socket and to the addresses in
+	// AdminAccess.Allow.
+	AdminKeys []AdminKey `mapstructure:"admin_keys"`
+	RateLimit RateLimit  `mapstructure:"rate_limit"`
+	Cache     Cache      `mapstructure:"cache"`
+	// RefreshAhead refreshes secrets read with Tokens before they expire.
+	RefreshAhead RefreshAhead `mapstructure:"refresh_ahead"`
+	// Prewarm lists secrets to cache at startup.
+	Prewarm []Prewarm `mapstructure:"prewarm"`
+}
+
+// RefreshAhead re-reads secrets that are in use before they expire.
+type RefreshAhead struct {
+	// Window is how long before they expire secrets are refreshed, 0
+	// disables refreshing.
+	Window time.Duration `mapstructure:"window"`
+	// MinHits is how many times a secret must have been read since it was
+	// cached to be refreshed.
+	MinHits int `mapstructure:"min_hits"`
+}
+
+// Prewarm caches secrets with one of Tokens at startup.
+type Prewarm struct {
+	Token string `mapstructure:"token"`
+	// Profile is the upstream to read from, the default one if empty.
+	Profile  string   `mapstructure:"profile"`
+	Keys     []string `mapstructure:"keys"`
+	IDs      []string `mapstructure:"ids"`
+	Projects []string `mapstructure:"projects"`
+}
+
+// TTLOverride matches secrets by a glob pattern of their key, by project
+// ID, or both.
+type TTLOverride struct {
+	Key     string        `mapstructure:"key"`
+	Project string        `mapstructure:"project"`
+	TTL     time.Duration `mapstructure:"ttl"`
+}
+
+// Cache limits the size of each client's cache. Least recently used
+// entries are evicted to make room for new ones.
+type Cache struct {
+	Keymap  Limit `mapstructure:"keymap"`
+	Secrets Limit `mapstructure:"secrets"`
+	// Tenant limits the secrets cached per access token, so one token
+	// can't evict the secrets of the others.
+	Tenant Limit `mapstructure:"tenant"`
+	// KeymapTenant limits the keys listed per access token.
+	KeymapTenant Limit `mapstructure:"keymap_tenant"`
+}
+
+// Limit caps the entries in a cache and the bytes they take up, 0 is
+// unlimited.
+type Limit struct {
+	MaxEntries int `mapstructure:"max_entries"`
+	MaxBytes   int `mapstructure:"max_bytes"`
+}
+
+// RateLimit limits requests per client identity and per upstream token,
+// with separate budgets for requests served from the cache and for calls
+// to Bitwarden.
+type RateLimit struct {
+	Client Budget `mapstructure:"client"`
+	Token  Budget `mapstructure:"token"`
+	// DailyQuota limits the calls to Bitwarden per upstream token per UTC
+	// day, 0 is unlimited.
+	DailyQuota int `mapstructure:"daily_quota"`
+}
+
+type Budget struct {
+	Hits   Bucket `mapstructure:"hits"`
+	Misses Bucket `mapstructure:"misses"`
+}
+
+// Bucket is a token bucket refilled at Rate per second up to Burst. A Rate
+// of 0 is unlimited.
+type Bucket struct {
+	Rate  float64 `mapstructure:"rate"`
+	Burst int     `mapstructure:"burst"`
+}
+
+// CIDRList restricts the client addresses allowed to reach a set of
+// endpoints. An address in Deny is refused, and so is one not in Allow
+// unless Allow is empty.
+type CIDRList struct {
+	Allow []string `mapstructure:"allow"`
+	Deny  []string `mapstructure:"deny"`
+}
+
+// Audit records every secret access as JSON lines.
+type Audit struct {
+	// Output is stdout, syslog or a file path. Empty disables auditing.
+	Output string `mapstructure:"output"`
+	// MaxSize in megabytes rotates a file output, 0 never rotates.
+	MaxSize int `mapstructure:"max_size"`
+	// MaxBackups is how many rotated files to keep, 0 keeps them all.
+	MaxBackups int `mapstructure:"max_backups"`
+	// HashChain includes the hash of the previous entry in each entry.
+	HashChain bool `mapstructure:"hash_chain"`
+}
+
+// Tracing exports a span per request, with child spans for the cache and
+// calls to Bitwarden.
+type Tracing struct {
+	// Exporter is stdout, file or otlp. Empty disables tracing.
+	Exporter string `mapstructure:"exporter"`
+	// Endpoint is the base URL of an OTLP/HTTP collector.
+	Endpoint string `mapstructure:"endpoint"`
+	// File is appended to by the file exporter.
+	File    string            `mapstructure:"file"`
+	Headers map[string]string `mapstructure:"headers" redact:"true"`
+	// SampleRatio of new traces to record. Traces continued from a sampled
+	// parent forwarded by a trusted proxy are always recorded.
+	SampleRatio float64 `mapstructure:"sample_ratio"`
+}
+
+// Socket additionally serves plain http on a Unix domain socket when Path
+// is set. Setting Port to 0 serves on the socket only.
+type Socket struct {
+	Path string `mapstructure:"path"`
+	// Mode is the octal file mode of the socket.
+	Mode string `mapstructure:"mode"`
+	// Owner is the user, or user:group, to chown the socket to.
+	Owner string `mapstructure:"owner"`
+}
+
+// Peer identifies processes connecting over the Unix socket by their
+// credentials. Every non-empty list must match the peer.
+type Peer struct {
+	Name  string   `mapstructure:"name"`
+	UIDs  []uint32 `mapstructure:"uids"`
+	GIDs  []uint32 `mapstructure:"gids"`
+	Token string   `mapstructure:"token"`
+	Scope `mapstructure:",squash"`
+}
+
+// TLS serves https when CertFile and KeyFile are set. Certificates are
+// reloaded when the files change.
+type TLS struct {
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// ClientCAFile is a bundle of CAs client certificates are verified
+	// against.
+	ClientCAFile string `mapstructure:"client_ca_file"`
+	// ClientAuth is none, request (verify a certificate if one is sent)
+	// or require. Defaults to require when ClientCAFile is set.
+	ClientAuth string `mapstructure:"client_auth"`
+	MinVersion string `mapstructure:"min_version"`
+}
+
+// APIKey is a locally issued credential that maps to one of Tokens and may
+// only read what its Scope permits.
+type APIKey struct {
+	Name string `mapstructure:"name"`
+	// Key is the API key itself, or KeySHA256 its hex encoded SHA-256.
+	Key       string `mapstructure:"key" redact:"true"`
+	KeySHA256 string `mapstructure:"key_sha256"`
+	Token     string `mapstructure:"token"`
+	Scope     `mapstructure:",squash"`
+}
+
+// AdminKey is a locally issued credential for the admin endpoints.
+type AdminKey struct {
+	Name string `mapstructure:"name"`
+	// Key is the admin key itself, or KeySHA256 its hex encoded SHA-256.
+	Key       string `mapstructure:"key" redact:"true"`
+	KeySHA256 string `mapstructure:"key_sha256"`
+}
+
+// Scope is an allowlist of what a client may read. An empty list allows
+// everything.
+type Scope struct {
+	// Keys are glob patterns of secret keys.
+	Keys     []string `mapstructure:"keys"`
+	Projects []string `mapstructure:"projects"`
+	// Methods are the endpoints the client may call: id and key.
+	Methods []string `mapstructure:"methods"`
+}
+
+// JWT configures accepting signed JWTs, such as Kubernetes service account
+// tokens, in place of a BWS access token.
+type JWT struct {
+	// JWKSFile or JWKSURL provide the keys JWTs are verified against.
+	JWKSFile    string        `mapstructure:"jwks_file"`
+	JWKSURL     string        `mapstructure:"jwks_url"`
+	JWKSRefresh time.Duration `mapstructure:"jwks_refresh"`
+	Issuer      string        `mapstructure:"issuer"`
+	Audiences   []string      `mapstructure:"audiences"`
+	// Mappings are checked in order, the first whose claims all match
+	// decides the token and scope of the caller.
+	Mappings []JWTMapping `mapstructure:"mappings"`
+}
+
+type JWTMapping struct {
+	Name string `mapstructure:"name"`
+	// Claims maps claim paths, with nested claims separated by /, to glob
+	// patterns their value must match.
+	Claims map[string]string `mapstructure:"claims"`
+	Token  string            `mapstructure:"token"`
+	Scope  `mapstructure:",squash"`
+}
+
+// Upstream is a Bitwarden server and the organization to read secrets from.
+type Upstream struct {
+	OrgID string `mapstructure:"org_id"`
+	// Region selects a Bitwarden cloud region, ignored if ServerURL is set.
+	Region string `mapstructure:"region"`
+	// ServerURL is the base URL of a self-hosted server.
+	ServerURL string `mapstructure:"server_url"`
+	// APIURL and IdentityURL override the endpoints picked by Region or
+	// ServerURL.
+	APIURL      string `mapstructure:"api_url"`
+	IdentityURL string `mapstructure:"identity_url"`
 }
 
 //go:generate sh -c "printf %s $(git rev-parse HEAD) > commit.txt"
@@ -28,18 +306,613 @@ var Commit string
 //go:embed version.txt
 var Version string
 
-func LoadConfig(config *Config) {
-	v := viper.New()
+type option struct {
+	key   string
+	value any
+	usage string
+}
+
+// options lists every setting along with its default. Each one can be set
+// from a flag, a BWS_CACHE_ environment variable or the config file.
+var options = []option{
+	{"port", 8080, "port to listen on"},
+	{"log_level", "info", "log level (debug, info, warn, error)"},
+	{"log_format", "json", "log format (json, text)"},
+	{"debug_key", "", "key to sign X-BWS-Debug tokens with, enables per-request debug logging"},
+	{"org_id", "", "bitwarden organization ID"},
+	{"region", "us", "bitwarden cloud region (us, eu)"},
+	{"server_url", "", "base URL of a self-hosted bitwarden server"},
+	{"api_url", "", "bitwarden API URL, overrides region and server-url"},
+	{"identity_url", "", "bitwarden identity URL, overrides region and server-url"},
+	{"secret_ttl", 15 * time.Minute, "TTL of cached secrets, and of the keymap unless keymap-ttl is set"},
+	{"keymap_ttl", time.Duration(0), "TTL of the keymap and project names, 0 uses secret-ttl"},
+	{"negative_ttl", time.Minute, "how long secrets that weren't found are remembered, 0 disables"},
+	{"note_ttl_max", time.Duration(0), "longest TTL a secret may set in its note, 0 uses secret-ttl"},
+	{"stale_ttl", 5 * time.Minute, "how long expired secrets are served when bitwarden can't be reached, 0 disables"},
+	{"ttl_jitter", 0.0, "shorten each TTL by a random fraction of up to this, from 0 to 1"},
+	{"web_ttl", 5 * time.Second, "timeout for http requests"},
+	{"refresh_keymap_on_miss", true, "refresh the keymap when a key is not found"},
+	{"shutdown_timeout", 30 * time.Second, "how long to wait for in-flight requests to drain on shutdown"},
+	{"tokens_file", "", "YAML file of named BWS access tokens"},
+	{"allow_client_tokens", true, "accept BWS access tokens from clients as well as local API keys, false by default when tokens or api_keys are set"},
+	{"policy_file", "", "YAML file of access policy rules"},
+	{"policy_dry_run", false, "log access policy decisions without enforcing them"},
+	{"socket::path", "", "unix socket to listen on"},
+	{"socket::mode", "0660", "file mode of the unix socket"},
+	{"socket::owner", "", "user[:group] to own the unix socket"},
+	{"audit::output", "", "audit log destination (stdout, syslog or a file path)"},
+	{"audit::max_size", 100, "size in megabytes to rotate the audit log file at"},
+	{"audit::max_backups", 10, "number of rotated audit log files to keep"},
+	{"audit::hash_chain", false, "chain audit log entries together by hash"},
+	{"tracing::exporter", "", "trace exporter (stdout, file, otlp), empty disables tracing"},
+	{"tracing::endpoint", "http://localhost:4318", "base URL of the OTLP/HTTP collector"},
+	{"tracing::file", "traces.jsonl", "file the file trace exporter appends to"},
+	{"tracing::sample_ratio", 1.0, "ratio of new traces to record"},
+	{"refresh_ahead::window", time.Duration(0), "refresh secrets in use this long before they expire, 0 disables"},
+	{"refresh_ahead::min_hits", 3, "reads since a secret was cached for it to be refreshed ahead of expiry"},
+	{"cache::keymap::max_entries", 0, "maximum keys in the keymap, 0 is unlimited"},
+	{"cache::keymap::max_bytes", 0, "maximum bytes taken up by the keymap, 0 is unlimited"},
+	{"cache::secrets::max_entries", 0, "maximum cached secrets, 0 is unlimited"},
+	{"cache::secrets::max_bytes", 0, "maximum bytes taken up by cached secrets, 0 is unlimited"},
+	{"cache::tenant::max_entries", 0, "maximum cached secrets per access token, 0 is unlimited"},
+	{"cache::tenant::max_bytes", 0, "maximum bytes of cached secrets per access token, 0 is unlimited"},
+	{"cache::keymap_tenant::max_entries", 0, "maximum keys in the keymap per access token, 0 is unlimited"},
+	{"cache::keymap_tenant::max_bytes", 0, "maximum bytes of the keymap per access token, 0 is unlimited"},
+	{"tls::cert_file", "", "TLS certificate file, enables https"},
+	{"tls::key_file", "", "TLS private key file"},
+	{"tls::client_ca_file", "", "CA bundle to verify client certificates against"},
+	{"tls::client_auth", "", "client certificate mode (none, request, require)"},
+	{"tls::min_version", "1.2", "minimum TLS version (1.2, 1.3)"},
+}
+
+// SearchPaths are checked in order for a bws-cache.{yaml,yml,toml,json}
+// file when no config file is given explicitly.
+var SearchPaths = []string{
+	".",
+	filepath.Join("$HOME", ".config", "bws-cache"),
+	"/etc/bws-cache",
+}
+
+// Flags registers a flag for every option, plus --config, on flags.
+func Flags(flags *pflag.FlagSet) {
+	flags.String("config", "", "path to a YAML, TOML or JSON config file (env: BWS_CACHE_CONFIG)")
+	for _, opt := range options {
+		name := flagName(opt.key)
+		switch value := opt.value.(type) {
+		case int:
+			flags.Int(name, value, opt.usage)
+		case bool:
+			flags.Bool(name, value, opt.usage)
+		case float64:
+			flags.Float64(name, value, opt.usage)
+		case time.Duration:
+			flags.Duration(name, value, opt.usage)
+		default:
+			flags.String(name, fmt.Sprint(value), opt.usage)
+		}
+	}
+}
+
+// LoadConfig populates config from, in order of precedence, flags,
+// environment variables, the config file and defaults. flags may be nil, or
+// a flag set previously passed to Flags.
+func LoadConfig(config *Config, flags *pflag.FlagSet) error {
+	v, err := newViper(flags)
+	if err != nil {
+		return err
+	}
+
+	if err := v.UnmarshalExact(config); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	if err := config.loadTokensFile(); err != nil {
+		return err
+	}
+	// A server with its own tokens or API keys only accepts client tokens
+	// when told to, so they can't be used to get around its keys.
+	if (len(config.Tokens) > 0 || len(config.APIKeys) > 0) && !isSet(v, flags, "allow_client_tokens") {
+		config.AllowClientTokens = false
+	}
+	return config.Validate()
+}
+
+// isSet reports whether key was set by a flag, an environment variable or
+// the config file rather than left at its default.
+func isSet(v *viper.Viper, flags *pflag.FlagSet, key string) bool {
+	if flags != nil {
+		if flag := flags.Lookup(flagName(key)); flag != nil && flag.Changed {
+			return true
+		}
+	}
+	if _, ok := os.LookupEnv("BWS_CACHE_" + strings.ToUpper(strings.ReplaceAll(key, "::", "_"))); ok {
+		return true
+	}
+	return v.InConfig(key)
+}
+
+func (config *Config) loadTokensFile() error {
+	if config.TokensFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(config.TokensFile)
+	if err != nil {
+		return fmt.Errorf("unable to read tokens file: %w", err)
+	}
+	tokens := make(map[string]string)
+	if err := yaml.Unmarshal(data, &tokens); err != nil {
+		return fmt.Errorf("unable to parse tokens file: %w", err)
+	}
+	if config.Tokens == nil {
+		config.Tokens = make(map[string]string)
+	}
+	for name, token := range tokens {
+		config.Tokens[name] = token
+	}
+	return nil
+}
+
+func newViper(flags *pflag.FlagSet) (*viper.Viper, error) {
+	// Map keys such as JWT claim names can contain dots, so don't let viper
+	// treat them as nested keys.
+	v := viper.NewWithOptions(viper.KeyDelimiter("::"))
 	v.SetEnvPrefix("bws_cache")
-	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-
-	v.SetDefault("port", 8080)
-	v.SetDefault("log_level", "info")
-	v.SetDefault("org_id", "")
-	v.SetDefault("secret_ttl", "15m")
-	v.SetDefault("web_ttl", "5s")
-	v.SetDefault("refresh_keymap_on_miss", true)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "::", "_"))
+
+	for _, opt := range options {
+		v.SetDefault(opt.key, opt.value)
+		if flags == nil {
+			continue
+		}
+		if flag := flags.Lookup(flagName(opt.key)); flag != nil {
+			if err := v.BindPFlag(opt.key, flag); err != nil {
+				return nil, err
+			}
+		}
+	}
 	v.AutomaticEnv()
 
-	v.Unmarshal(config)
+	return v, readConfigFile(v, flags)
+}
+
+func readConfigFile(v *viper.Viper, flags *pflag.FlagSet) error {
+	path := os.Getenv("BWS_CACHE_CONFIG")
+	if flags != nil {
+		if flag := flags.Lookup("config"); flag != nil && flag.Changed {
+			path = flag.Value.String()
+		}
+	}
+
+	if path != "" {
+		v.SetConfigFile(path)
+	} else {
+		v.SetConfigName("bws-cache")
+		for _, searchPath := range SearchPaths {
+			v.AddConfigPath(searchPath)
+		}
+	}
+
+	err := v.ReadInConfig()
+	if errors.As(err, &viper.ConfigFileNotFoundError{}) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read config file: %w", err)
+	}
+	return nil
+}
+
+// Validate rejects settings that would otherwise silently fall back to zero
+// values.
+func (config *Config) Validate() error {
+	if err := config.Upstream.Validate(); err != nil {
+		return err
+	}
+	for name, profile := range config.Profiles {
+		if name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("invalid profile name %q", name)
+		}
+		if name == "default" {
+			return errors.New(`profile name "default" is reserved for the default upstream`)
+		}
+		if err := profile.Validate(); err != nil {
+			return fmt.Errorf("profile %s: %w", name, err)
+		}
+	}
+	if config.LogFormat != "json" && config.LogFormat != "text" {
+		return fmt.Errorf("unknown log_format %q", config.LogFormat)
+	}
+	for _, pattern := range config.LogRedactPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid log_redact_patterns %q: %w", pattern, err)
+		}
+	}
+	if config.Port < 0 || config.Port > 65535 {
+		return fmt.Errorf("port must be between 0 and 65535, got %d", config.Port)
+	}
+	if config.Port == 0 && config.Socket.Path == "" {
+		return errors.New("port 0 requires socket path to be set")
+	}
+	names := make(map[string]bool)
+	for _, key := range config.APIKeys {
+		if err := key.Validate(config.Tokens); err != nil {
+			return fmt.Errorf("api key %s: %w", key.Name, err)
+		}
+		if names[key.Name] {
+			return fmt.Errorf("api key %s: duplicate name", key.Name)
+		}
+		names[key.Name] = true
+	}
+	if err := config.JWT.Validate(config.Tokens); err != nil {
+		return fmt.Errorf("jwt: %w", err)
+	}
+	if err := config.TLS.Validate(); err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	if _, err := ParsePrefixes(config.TrustedProxies); err != nil {
+		return fmt.Errorf("trusted_proxies: %w", err)
+	}
+	if err := config.SecretAccess.Validate(); err != nil {
+		return fmt.Errorf("secret_access: %w", err)
+	}
+	if err := config.AdminAccess.Validate(); err != nil {
+		return fmt.Errorf("admin_access: %w", err)
+	}
+	names = make(map[string]bool)
+	for _, key := range config.AdminKeys {
+		if err := key.Validate(); err != nil {
+			return fmt.Errorf("admin key %s: %w", key.Name, err)
+		}
+		if names[key.Name] {
+			return fmt.Errorf("admin key %s: duplicate name", key.Name)
+		}
+		names[key.Name] = true
+	}
+	for name, bucket := range map[string]Bucket{
+		"client.hits":   config.RateLimit.Client.Hits,
+		"client.misses": config.RateLimit.Client.Misses,
+		"token.hits":    config.RateLimit.Token.Hits,
+		"token.misses":  config.RateLimit.Token.Misses,
+	} {
+		if bucket.Rate < 0 || bucket.Burst < 0 {
+			return fmt.Errorf("rate_limit: %s rate and burst must not be negative", name)
+		}
+	}
+	if config.RateLimit.DailyQuota < 0 {
+		return errors.New("rate_limit: daily_quota must not be negative")
+	}
+	for name, limit := range map[string]Limit{
+		"keymap":        config.Cache.Keymap,
+		"secrets":       config.Cache.Secrets,
+		"tenant":        config.Cache.Tenant,
+		"keymap_tenant": config.Cache.KeymapTenant,
+	} {
+		if limit.MaxEntries < 0 || limit.MaxBytes < 0 {
+			return fmt.Errorf("cache: %s max_entries and max_bytes must not be negative", name)
+		}
+	}
+	if err := config.Socket.Validate(); err != nil {
+		return fmt.Errorf("socket: %w", err)
+	}
+	switch config.Tracing.Exporter {
+	case "", "stdout", "file", "otlp":
+	default:
+		return fmt.Errorf("tracing: unknown exporter %q, expected stdout, file or otlp", config.Tracing.Exporter)
+	}
+	if config.Tracing.SampleRatio < 0 || config.Tracing.SampleRatio > 1 {
+		return errors.New("tracing: sample_ratio must be between 0 and 1")
+	}
+	if config.Audit.MaxSize < 0 || config.Audit.MaxBackups < 0 {
+		return errors.New("audit: max_size and max_backups must not be negative")
+	}
+	names = make(map[string]bool)
+	for _, peer := range config.Peers {
+		if err := peer.Validate(config.Tokens); err != nil {
+			return fmt.Errorf("peer %s: %w", peer.Name, err)
+		}
+		if names[peer.Name] {
+			return fmt.Errorf("peer %s: duplicate name", peer.Name)
+		}
+		names[peer.Name] = true
+	}
+	if config.RefreshAhead.Window < 0 || config.RefreshAhead.MinHits < 0 {
+		return errors.New("refresh_ahead: window and min_hits must not be negative")
+	}
+	if err := config.validateRefreshWindow(); err != nil {
+		return fmt.Errorf("refresh_ahead: %w", err)
+	}
+	for i, prewarm := range config.Prewarm {
+		if err := prewarm.Validate(config.Tokens, config.Profiles); err != nil {
+			return fmt.Errorf("prewarm[%d]: %w", i, err)
+		}
+	}
+	for i, override := range config.TTLOverrides {
+		if err := override.Validate(); err != nil {
+			return fmt.Errorf("ttl_overrides[%d]: %w", i, err)
+		}
+	}
+	if config.KeymapTTL < 0 || config.NegativeTTL < 0 || config.NoteTTLMax < 0 || config.StaleTTL < 0 {
+		return errors.New("keymap_ttl, negative_ttl, note_ttl_max and stale_ttl must not be negative")
+	}
+	if config.TTLJitter < 0 || config.TTLJitter >= 1 {
+		return errors.New("ttl_jitter must be at least 0 and less than 1")
+	}
+	durations := map[string]time.Duration{
+		"secret_ttl":       config.SecretTTL,
+		"web_ttl":          config.WebTTL,
+		"shutdown_timeout": config.ShutdownTimeout,
+	}
+	for key, value := range durations {
+		if value <= 0 {
+			return fmt.Errorf("%s must be a positive duration, got %s", key, value)
+		}
+	}
+	return nil
+}
+
+// validateRefreshWindow rejects a refresh window as long as a TTL, which
+// would refresh entries as soon as they are cached.
+func (config *Config) validateRefreshWindow() error {
+	window := config.RefreshAhead.Window
+	if window == 0 {
+		return nil
+	}
+	keymapTTL := config.KeymapTTL
+	if keymapTTL == 0 {
+		keymapTTL = config.SecretTTL
+	}
+	if window >= config.SecretTTL || window >= keymapTTL {
+		return fmt.Errorf("window %s must be shorter than secret_ttl and keymap_ttl", window)
+	}
+	for i, override := range config.TTLOverrides {
+		if window >= override.TTL {
+			return fmt.Errorf("window %s must be shorter than the ttl of ttl_overrides[%d]", window, i)
+		}
+	}
+	return nil
+}
+
+func (key *APIKey) Validate(tokens map[string]string) error {
+	if err := validateKey(key.Name, key.Key, key.KeySHA256); err != nil {
+		return err
+	}
+	if _, ok := tokens[key.Token]; !ok {
+		return fmt.Errorf("unknown token %q", key.Token)
+	}
+	return key.Scope.Validate()
+}
+
+func (key *AdminKey) Validate() error {
+	return validateKey(key.Name, key.Key, key.KeySHA256)
+}
+
+// validateKey checks the name of a local key and that it is given either
+// as is or by a well-formed hash.
+func validateKey(name string, key string, keySHA256 string) error {
+	if name == "" {
+		return errors.New("name must be specified")
+	}
+	if (key == "") == (keySHA256 == "") {
+		return errors.New("exactly one of key or key_sha256 must be specified")
+	}
+	if keySHA256 != "" {
+		if decoded, err := hex.DecodeString(keySHA256); err != nil || len(decoded) != sha256.Size {
+			return errors.New("key_sha256 must be a hex encoded SHA-256")
+		}
+	}
+	return nil
+}
+
+func (list *CIDRList) Validate() error {
+	if _, err := ParsePrefixes(list.Allow); err != nil {
+		return fmt.Errorf("allow: %w", err)
+	}
+	if _, err := ParsePrefixes(list.Deny); err != nil {
+		return fmt.Errorf("deny: %w", err)
+	}
+	return nil
+}
+
+// ParsePrefixes parses CIDRs, or single addresses.
+func ParsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if addr, err := netip.ParseAddr(cidr); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func (socket *Socket) Validate() error {
+	if _, err := socket.FileMode(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// FileMode parses Mode.
+func (socket *Socket) FileMode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(socket.Mode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid mode %q", socket.Mode)
+	}
+	return os.FileMode(mode), nil
+}
+
+func (peer *Peer) Validate(tokens map[string]string) error {
+	if peer.Name == "" {
+		return errors.New("name must be specified")
+	}
+	if len(peer.UIDs) == 0 && len(peer.GIDs) == 0 {
+		return errors.New("at least one of uids or gids must be specified")
+	}
+	if _, ok := tokens[peer.Token]; !ok {
+		return fmt.Errorf("unknown token %q", peer.Token)
+	}
+	return peer.Scope.Validate()
+}
+
+func (prewarm *Prewarm) Validate(tokens map[string]string, profiles map[string]Upstream) error {
+	if _, ok := tokens[prewarm.Token]; !ok {
+		return fmt.Errorf("unknown token %q", prewarm.Token)
+	}
+	if _, ok := profiles[prewarm.Profile]; prewarm.Profile != "" && !ok {
+		return fmt.Errorf("unknown profile %q", prewarm.Profile)
+	}
+	return nil
+}
+
+func (override *TTLOverride) Validate() error {
+	if override.Key == "" && override.Project == "" {
+		return errors.New("at least one of key or project must be specified")
+	}
+	if _, err := path.Match(override.Key, ""); err != nil {
+		return fmt.Errorf("invalid key pattern %q", override.Key)
+	}
+	if override.TTL <= 0 {
+		return fmt.Errorf("ttl must be a positive duration, got %s", override.TTL)
+	}
+	return nil
+}
+
+func (scope *Scope) Validate() error {
+	for _, pattern := range scope.Keys {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid key pattern %q", pattern)
+		}
+	}
+	for _, method := range scope.Methods {
+		if method != "id" && method != "key" {
+			return fmt.Errorf("unknown method %q", method)
+		}
+	}
+	return nil
+}
+
+// TLSVersions are the accepted values of min_version.
+var TLSVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Enabled reports whether https is configured.
+func (t *TLS) Enabled() bool {
+	return t.CertFile != ""
+}
+
+func (t *TLS) Validate() error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return errors.New("cert_file and key_file must be specified together")
+	}
+	if !t.Enabled() && t.ClientCAFile != "" {
+		return errors.New("client_ca_file requires cert_file and key_file")
+	}
+	if _, ok := TLSVersions[t.MinVersion]; !ok {
+		return fmt.Errorf("unsupported min_version %q", t.MinVersion)
+	}
+	switch t.ClientAuth {
+	case "", "none":
+	case "request", "require":
+		if t.ClientCAFile == "" {
+			return fmt.Errorf("client_auth %s requires client_ca_file", t.ClientAuth)
+		}
+	default:
+		return fmt.Errorf("unknown client_auth %q", t.ClientAuth)
+	}
+	return nil
+}
+
+// Enabled reports whether JWT authentication is configured.
+func (jwt *JWT) Enabled() bool {
+	return jwt.JWKSFile != "" || jwt.JWKSURL != ""
+}
+
+func (jwt *JWT) Validate(tokens map[string]string) error {
+	if !jwt.Enabled() {
+		if len(jwt.Mappings) > 0 {
+			return errors.New("jwks_file or jwks_url must be specified")
+		}
+		return nil
+	}
+	if jwt.JWKSFile != "" && jwt.JWKSURL != "" {
+		return errors.New("only one of jwks_file or jwks_url can be specified")
+	}
+	if jwt.Issuer == "" {
+		return errors.New("issuer must be specified")
+	}
+	if len(jwt.Audiences) == 0 {
+		return errors.New("audiences must be specified")
+	}
+	if jwt.JWKSRefresh < 0 {
+		return fmt.Errorf("jwks_refresh must be a positive duration, got %s", jwt.JWKSRefresh)
+	}
+	for _, mapping := range jwt.Mappings {
+		if mapping.Name == "" {
+			return errors.New("mapping name must be specified")
+		}
+		if len(mapping.Claims) == 0 {
+			return fmt.Errorf("mapping %s: claims must be specified", mapping.Name)
+		}
+		for claim, pattern := range mapping.Claims {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("mapping %s: invalid pattern %q for claim %s", mapping.Name, pattern, claim)
+			}
+		}
+		if _, ok := tokens[mapping.Token]; !ok {
+			return fmt.Errorf("mapping %s: unknown token %q", mapping.Name, mapping.Token)
+		}
+		if err := mapping.Scope.Validate(); err != nil {
+			return fmt.Errorf("mapping %s: %w", mapping.Name, err)
+		}
+	}
+	return nil
+}
+
+func (upstream *Upstream) Validate() error {
+	if upstream.OrgID == "" {
+		return errors.New("org_id must be specified")
+	}
+	_, err := upstream.Endpoints()
+	return err
+}
+
+// Endpoints resolves the API and identity URLs of the upstream.
+func (upstream *Upstream) Endpoints() (client.Endpoints, error) {
+	var endpoints client.Endpoints
+	if upstream.ServerURL != "" {
+		endpoints = client.SelfHosted(upstream.ServerURL)
+	} else {
+		region := strings.ToLower(upstream.Region)
+		if region == "" {
+			region = "us"
+		}
+		var ok bool
+		if endpoints, ok = client.Regions[region]; !ok {
+			return endpoints, fmt.Errorf("unknown region %q", upstream.Region)
+		}
+	}
+	if upstream.APIURL != "" {
+		endpoints.APIURL = upstream.APIURL
+	}
+	if upstream.IdentityURL != "" {
+		endpoints.IdentityURL = upstream.IdentityURL
+	}
+
+	for _, endpoint := range []string{endpoints.APIURL, endpoints.IdentityURL} {
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return endpoints, fmt.Errorf("invalid bitwarden url %q", endpoint)
+		}
+	}
+	return endpoints, nil
+}
+
+func flagName(key string) string {
+	return strings.NewReplacer("_", "-", "::", "-").Replace(key)
 }
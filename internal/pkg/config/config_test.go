@@ -0,0 +1,157 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// loadTestConfig loads the defaults with an organization and a token, which
+// is valid.
+func loadTestConfig(t *testing.T) *Config {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "bws-cache.yml")
+	yaml := "org_id: 00000000-0000-0000-0000-000000000001\ntokens:\n  server: server-token\n"
+	if err := os.WriteFile(file, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BWS_CACHE_CONFIG", file)
+	config := Config{}
+	if err := LoadConfig(&config, nil); err != nil {
+		t.Fatal(err)
+	}
+	return &config
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(config *Config)
+		valid  bool
+	}{
+		{"defaults", func(config *Config) {}, true},
+		{"no org", func(config *Config) { config.OrgID = "" }, false},
+		{"unknown region", func(config *Config) { config.Region = "mars" }, false},
+		{"reserved profile", func(config *Config) { config.Profiles = map[string]Upstream{"default": config.Upstream} }, false},
+		{"log format", func(config *Config) { config.LogFormat = "xml" }, false},
+		{"redact pattern", func(config *Config) { config.LogRedactPatterns = []string{"("} }, false},
+		{"port range", func(config *Config) { config.Port = 65536 }, false},
+		{"socket only", func(config *Config) { config.Port, config.Socket.Path = 0, "/run/bws-cache.sock" }, true},
+		{"no listener", func(config *Config) { config.Port = 0 }, false},
+		{"socket mode", func(config *Config) { config.Socket.Mode = "0999" }, false},
+		{"api key", func(config *Config) {
+			config.APIKeys = []APIKey{{Name: "ci", Key: "ci-key", Token: "server"}}
+		}, true},
+		{"api key without key", func(config *Config) {
+			config.APIKeys = []APIKey{{Name: "ci", Token: "server"}}
+		}, false},
+		{"api key and hash", func(config *Config) {
+			config.APIKeys = []APIKey{{Name: "ci", Key: "ci-key", KeySHA256: "00", Token: "server"}}
+		}, false},
+		{"api key unknown token", func(config *Config) {
+			config.APIKeys = []APIKey{{Name: "ci", Key: "ci-key", Token: "other"}}
+		}, false},
+		{"api key duplicate", func(config *Config) {
+			key := APIKey{Name: "ci", Key: "ci-key", Token: "server"}
+			config.APIKeys = []APIKey{key, key}
+		}, false},
+		{"api key method", func(config *Config) {
+			config.APIKeys = []APIKey{{Name: "ci", Key: "ci-key", Token: "server", Scope: Scope{Methods: []string{"list"}}}}
+		}, false},
+		{"admin key", func(config *Config) { config.AdminKeys = []AdminKey{{Name: "ops", Key: "ops-key"}} }, true},
+		{"admin key without name", func(config *Config) { config.AdminKeys = []AdminKey{{Key: "ops-key"}} }, false},
+		{"admin key hash", func(config *Config) { config.AdminKeys = []AdminKey{{Name: "ops", KeySHA256: "ab"}} }, false},
+		{"admin key duplicate", func(config *Config) {
+			key := AdminKey{Name: "ops", Key: "ops-key"}
+			config.AdminKeys = []AdminKey{key, key}
+		}, false},
+		{"jwt without keys", func(config *Config) {
+			config.JWT.Mappings = []JWTMapping{{Name: "ci", Claims: map[string]string{"sub": "*"}, Token: "server"}}
+		}, false},
+		{"jwt without audience", func(config *Config) {
+			config.JWT.JWKSURL, config.JWT.Issuer = "https://issuer/jwks", "https://issuer"
+		}, false},
+		{"tls without key", func(config *Config) { config.TLS.CertFile = "tls.crt" }, false},
+		{"tls client auth", func(config *Config) {
+			config.TLS.CertFile, config.TLS.KeyFile, config.TLS.ClientAuth = "tls.crt", "tls.key", "require"
+		}, false},
+		{"tls version", func(config *Config) { config.TLS.MinVersion = "1.1" }, false},
+		{"trusted proxy", func(config *Config) { config.TrustedProxies = []string{"10.0.0.0/33"} }, false},
+		{"admin access", func(config *Config) { config.AdminAccess.Allow = []string{"localhost"} }, false},
+		{"rate limit", func(config *Config) { config.RateLimit.Token.Misses.Rate = -1 }, false},
+		{"daily quota", func(config *Config) { config.RateLimit.DailyQuota = -1 }, false},
+		{"cache limit", func(config *Config) { config.Cache.Tenant.MaxEntries = -1 }, false},
+		{"keymap tenant limit", func(config *Config) { config.Cache.KeymapTenant.MaxBytes = -1 }, false},
+		{"trace exporter", func(config *Config) { config.Tracing.Exporter = "jaeger" }, false},
+		{"sample ratio", func(config *Config) { config.Tracing.SampleRatio = 1.5 }, false},
+		{"audit size", func(config *Config) { config.Audit.MaxSize = -1 }, false},
+		{"peer without ids", func(config *Config) { config.Peers = []Peer{{Name: "app", Token: "server"}} }, false},
+		{"refresh window", func(config *Config) { config.RefreshAhead.Window = time.Minute }, true},
+		{"negative refresh window", func(config *Config) { config.RefreshAhead.Window = -time.Second }, false},
+		{"refresh window over secret ttl", func(config *Config) { config.RefreshAhead.Window = config.SecretTTL }, false},
+		{"refresh window over keymap ttl", func(config *Config) {
+			config.RefreshAhead.Window, config.KeymapTTL = time.Minute, time.Minute
+		}, false},
+		{"refresh window over override", func(config *Config) {
+			config.RefreshAhead.Window = time.Minute
+			config.TTLOverrides = []TTLOverride{{Key: "db_*", TTL: 30 * time.Second}}
+		}, false},
+		{"prewarm token", func(config *Config) { config.Prewarm = []Prewarm{{Token: "other"}} }, false},
+		{"prewarm profile", func(config *Config) { config.Prewarm = []Prewarm{{Token: "server", Profile: "eu"}} }, false},
+		{"override", func(config *Config) { config.TTLOverrides = []TTLOverride{{Key: "db_*", TTL: time.Minute}} }, true},
+		{"override without ttl", func(config *Config) { config.TTLOverrides = []TTLOverride{{Key: "db_*"}} }, false},
+		{"override without match", func(config *Config) { config.TTLOverrides = []TTLOverride{{TTL: time.Minute}} }, false},
+		{"negative ttl", func(config *Config) { config.NegativeTTL = -time.Second }, false},
+		{"note ttl max", func(config *Config) { config.NoteTTLMax = -time.Second }, false},
+		{"stale ttl", func(config *Config) { config.StaleTTL = -time.Second }, false},
+		{"jitter", func(config *Config) { config.TTLJitter = 1 }, false},
+		{"secret ttl", func(config *Config) { config.SecretTTL = 0 }, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := loadTestConfig(t)
+			test.modify(config)
+			err := config.Validate()
+			if (err == nil) != test.valid {
+				t.Errorf("got error %v, want valid %t", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestAllowClientTokensDefault(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		env  string
+		want bool
+	}{
+		{"no tokens", "", "", true},
+		{"tokens", "tokens:\n  server: server-token\n", "", false},
+		{"api keys", "tokens:\n  server: server-token\napi_keys:\n  - name: web\n    key: web-api-key-0001\n    token: server\n", "", false},
+		{"enabled in the file", "tokens:\n  server: server-token\nallow_client_tokens: true\n", "", true},
+		{"enabled in the environment", "tokens:\n  server: server-token\n", "true", true},
+		{"disabled", "allow_client_tokens: false\n", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "bws-cache.yml")
+			yaml := "org_id: 00000000-0000-0000-0000-000000000001\n" + test.yaml
+			if err := os.WriteFile(file, []byte(yaml), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("BWS_CACHE_CONFIG", file)
+			if test.env != "" {
+				t.Setenv("BWS_CACHE_ALLOW_CLIENT_TOKENS", test.env)
+			}
+			config := Config{}
+			if err := LoadConfig(&config, nil); err != nil {
+				t.Fatal(err)
+			}
+			if config.AllowClientTokens != test.want {
+				t.Errorf("got allow_client_tokens %t, want %t", config.AllowClientTokens, test.want)
+			}
+		})
+	}
+}
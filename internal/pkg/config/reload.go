@@ -0,0 +1,184 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/pflag"
+)
+
+// Reloadable lists the settings a running server applies without a restart.
+var Reloadable = map[string]bool{
+	"log_level":              true,
+	"debug_key":              true,
+	"log_redact_patterns":    true,
+	"org_id":                 true,
+	"secret_ttl":             true,
+	"keymap_ttl":             true,
+	"negative_ttl":           true,
+	"ttl_jitter":             true,
+	"ttl_overrides":          true,
+	"note_ttl_max":           true,
+	"stale_ttl":              true,
+	"refresh_keymap_on_miss": true,
+	"shutdown_timeout":       true,
+	"tokens":                 true,
+	"tokens_file":            true,
+	"api_keys":               true,
+	"jwt":                    true,
+	"allow_client_tokens":    true,
+	"policy_file":            true,
+	"policy_dry_run":         true,
+	"peers":                  true,
+	"trusted_proxies":        true,
+	"secret_access":          true,
+	"admin_access":           true,
+	"admin_keys":             true,
+	"rate_limit":             true,
+	"cache":                  true,
+	"refresh_ahead":          true,
+}
+
+const redacted = "REDACTED"
+
+// Watch calls onChange whenever the config file in use is written to. It
+// does nothing if no config file was found.
+func Watch(flags *pflag.FlagSet, onChange func()) error {
+	v, err := newViper(flags)
+	if err != nil {
+		return err
+	}
+	if v.ConfigFileUsed() == "" {
+		slog.Debug("No config file in use, not watching for changes")
+		return nil
+	}
+
+	slog.Info(fmt.Sprintf("Watching %s for changes", v.ConfigFileUsed()))
+	v.OnConfigChange(func(e fsnotify.Event) {
+		slog.Debug(fmt.Sprintf("Config file event: %s", e))
+		onChange()
+	})
+	v.WatchConfig()
+	return nil
+}
+
+// Reload works out the configuration a running server should switch to
+// when next is loaded. Reloadable settings are taken from next and the rest
+// are kept from config, since they only take effect on restart. The names of
+// the settings that changed are returned split the same way.
+func (config *Config) Reload(next *Config) (active *Config, applied []string, restart []string) {
+	active = &Config{}
+	*active = *next
+
+	current := fields(reflect.ValueOf(config).Elem())
+	result := fields(reflect.ValueOf(active).Elem())
+	for i, field := range current {
+		if reflect.DeepEqual(field.value.Interface(), result[i].value.Interface()) {
+			continue
+		}
+		if Reloadable[field.key] {
+			applied = append(applied, field.key)
+			continue
+		}
+		restart = append(restart, field.key)
+		result[i].value.Set(field.value)
+	}
+	return active, applied, restart
+}
+
+// Redacted returns the settings keyed by their config file name with every
+// field tagged `redact:"true"` masked, suitable for displaying.
+func (config *Config) Redacted() map[string]any {
+	return settings(reflect.ValueOf(config).Elem(), true)
+}
+
+type field struct {
+	key    string
+	value  reflect.Value
+	redact bool
+}
+
+// fields lists the settings in a struct, including those of embedded structs
+// squashed into it.
+func fields(value reflect.Value) []field {
+	var result []field
+	for i := 0; i < value.NumField(); i++ {
+		structField := value.Type().Field(i)
+		key, opts, _ := strings.Cut(structField.Tag.Get("mapstructure"), ",")
+		if opts == "squash" {
+			result = append(result, fields(value.Field(i))...)
+			continue
+		}
+		if key == "" || !structField.IsExported() {
+			continue
+		}
+		result = append(result, field{
+			key:    key,
+			value:  value.Field(i),
+			redact: structField.Tag.Get("redact") == "true",
+		})
+	}
+	return result
+}
+
+func settings(value reflect.Value, redact bool) map[string]any {
+	result := make(map[string]any)
+	for _, field := range fields(value) {
+		result[field.key] = settingValue(field.value, redact && field.redact, redact)
+	}
+	return result
+}
+
+func settingValue(value reflect.Value, mask bool, redact bool) any {
+	if mask {
+		if value.Kind() == reflect.Map {
+			items := make(map[string]any, value.Len())
+			for _, key := range value.MapKeys() {
+				items[fmt.Sprint(key.Interface())] = redacted
+			}
+			return items
+		}
+		if value.IsZero() {
+			return ""
+		}
+		return redacted
+	}
+	if duration, ok := value.Interface().(time.Duration); ok {
+		return duration.String()
+	}
+
+	switch value.Kind() {
+	case reflect.Struct:
+		return settings(value, redact)
+	case reflect.Pointer:
+		if value.IsNil() {
+			return nil
+		}
+		return settingValue(value.Elem(), mask, redact)
+	case reflect.Slice:
+		if value.IsNil() {
+			return nil
+		}
+		items := make([]any, value.Len())
+		for i := range items {
+			items[i] = settingValue(value.Index(i), false, redact)
+		}
+		return items
+	case reflect.Map:
+		if value.IsNil() {
+			return nil
+		}
+		items := make(map[string]any, value.Len())
+		iter := value.MapRange()
+		for iter.Next() {
+			items[fmt.Sprint(iter.Key().Interface())] = settingValue(iter.Value(), false, redact)
+		}
+		return items
+	default:
+		return value.Interface()
+	}
+}
@@ -0,0 +1,231 @@
+package doctor
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"bws-cache/internal/pkg/cache"
+	"bws-cache/internal/pkg/client"
+	c "bws-cache/internal/pkg/config"
+
+	"github.com/google/uuid"
+)
+
+type Status string
+
+const (
+	Pass Status = "pass"
+	Fail Status = "fail"
+	Skip Status = "skip"
+)
+
+const dialTimeout = 5 * time.Second
+
+type Check struct {
+	Name   string `json:"name"`
+	Status Status `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type Report struct {
+	Passed bool    `json:"passed"`
+	Checks []Check `json:"checks"`
+}
+
+type doctor struct {
+	config    *c.Config
+	configErr error
+	token     string
+	report    Report
+}
+
+// Run diagnoses a deployment using config, which failed to load with
+// configErr if not nil, and token as the access token. Checks that depend on
+// an earlier failed check are skipped.
+func Run(config *c.Config, configErr error, token string) *Report {
+	d := doctor{config: config, configErr: configErr, token: token}
+	d.report.Passed = true
+
+	configOK := d.checkConfig()
+	endpoints, err := config.Endpoints()
+	endpointsOK := err == nil
+	if endpointsOK {
+		for _, endpoint := range []string{endpoints.APIURL, endpoints.IdentityURL} {
+			endpointsOK = d.checkEndpoint(endpoint) && endpointsOK
+		}
+	}
+	d.checkStateDir()
+	d.checkCache()
+
+	if d.token == "" {
+		d.add("login", Fail, "no access token provided")
+		return &d.report
+	}
+	if !endpointsOK {
+		d.add("login", Skip, "bitwarden endpoints invalid or unreachable")
+		return &d.report
+	}
+	d.checkAccess(configOK, endpoints)
+	return &d.report
+}
+
+func (d *doctor) add(name string, status Status, format string, args ...any) bool {
+	d.report.Checks = append(d.report.Checks, Check{
+		Name:   name,
+		Status: status,
+		Detail: fmt.Sprintf(format, args...),
+	})
+	if status == Fail {
+		d.report.Passed = false
+	}
+	return status == Pass
+}
+
+func (d *doctor) checkConfig() bool {
+	if d.configErr != nil {
+		return d.add("config", Fail, "%v", d.configErr)
+	}
+	if _, err := uuid.Parse(d.config.OrgID); err != nil {
+		return d.add("config", Fail, "org_id %q is not a valid UUID", d.config.OrgID)
+	}
+	return d.add("config", Pass, "org_id %s", d.config.OrgID)
+}
+
+func (d *doctor) checkEndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return d.add("dns", Fail, "invalid url %s: %v", endpoint, err)
+	}
+	host := u.Hostname()
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return d.add("dns "+host, Fail, "%v", err)
+	}
+	d.add("dns "+host, Pass, "%s", strings.Join(addrs, ", "))
+
+	if u.Scheme == "http" {
+		return d.add("tls "+host, Skip, "plain http endpoint")
+	}
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, port), &tls.Config{ServerName: host})
+	if err != nil {
+		return d.add("tls "+host, Fail, "%v", err)
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	cert := state.PeerCertificates[0]
+	return d.add("tls "+host, Pass, "%s, certificate for %s expires %s",
+		tls.VersionName(state.Version), cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339))
+}
+
+func (d *doctor) checkStateDir() bool {
+	f, err := os.CreateTemp(client.TokenStateDir, "bws-cache-doctor-")
+	if err != nil {
+		return d.add("token state dir", Fail, "%s is not writable: %v", client.TokenStateDir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return d.add("token state dir", Pass, "%s is writable", client.TokenStateDir)
+}
+
+func (d *doctor) checkCache() bool {
+	ttl := time.Minute
+	if d.config != nil && d.config.SecretTTL > 0 {
+		ttl = d.config.SecretTTL
+	}
+	store := cache.New(ttl, nil)
+	defer store.Stop()
+
+	id := uuid.New().String()
+	value := uuid.New().String()
+	store.SetID("doctor", id, "", d.token)
+	store.SetSecret(id, value, d.token, cache.Metadata{Key: "doctor"})
+	if store.GetID("doctor", d.token) != id || store.GetSecret(id, d.token) != value {
+		return d.add("cache", Fail, "value read back did not match value written")
+	}
+	return d.add("cache", Pass, "encrypted round trip with ttl %s", ttl)
+}
+
+func (d *doctor) checkAccess(configOK bool, endpoints client.Endpoints) {
+	bw, err := client.NewSDKClient(&endpoints.APIURL, &endpoints.IdentityURL)
+	if err != nil {
+		d.add("login", Fail, "unable to create client: %v", err)
+		return
+	}
+	defer bw.Close()
+
+	statePath := filepath.Join(client.TokenStateDir, uuid.New().String())
+	defer os.Remove(statePath)
+	if err := bw.AccessTokenLogin(d.token, &statePath); err != nil {
+		d.add("login", Fail, "%v", err)
+		return
+	}
+	d.add("login", Pass, "access token accepted")
+
+	if !configOK {
+		d.add("projects", Skip, "config is invalid")
+		return
+	}
+
+	projects, err := bw.Projects().List(d.config.OrgID)
+	if err != nil {
+		d.add("projects", Fail, "%v", err)
+		return
+	}
+	if len(projects.Data) == 0 {
+		d.add("projects", Fail, "token has no access to any project in org %s", d.config.OrgID)
+		return
+	}
+	names := make([]string, len(projects.Data))
+	for i, project := range projects.Data {
+		names[i] = project.Name
+	}
+	sort.Strings(names)
+	d.add("projects", Pass, "%d accessible (%s)", len(projects.Data), strings.Join(names, ", "))
+
+	identifiers, err := bw.Secrets().List(d.config.OrgID)
+	if err != nil {
+		d.add("secrets", Fail, "%v", err)
+		return
+	}
+	if len(identifiers.Data) == 0 {
+		d.add("secrets", Fail, "token has no access to any secret in org %s", d.config.OrgID)
+		return
+	}
+	// The list doesn't include values, so counting doesn't read any.
+	d.add("secrets", Pass, "%d accessible", len(identifiers.Data))
+}
+
+func (r *Report) WriteText(w io.Writer) {
+	for _, check := range r.Checks {
+		fmt.Fprintf(w, "[%s] %s: %s\n", strings.ToUpper(string(check.Status)), check.Name, check.Detail)
+	}
+	if r.Passed {
+		fmt.Fprintln(w, "All checks passed")
+	} else {
+		fmt.Fprintln(w, "Some checks failed")
+	}
+}
+
+func (r *Report) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
@@ -0,0 +1,54 @@
+package doctor
+
+import (
+	"testing"
+
+	"bws-cache/internal/pkg/client"
+	c "bws-cache/internal/pkg/config"
+	"bws-cache/internal/pkg/sdktest"
+)
+
+const orgID = "7f3a3c5e-2a0b-4e8e-9d43-1c1f3f0b9a11"
+
+func TestCheckCache(t *testing.T) {
+	d := doctor{config: &c.Config{}, token: "token"}
+	if !d.checkCache() {
+		t.Fatalf("cache round trip failed: %+v", d.report.Checks)
+	}
+}
+
+func TestCheckAccess(t *testing.T) {
+	bw := sdktest.New("token")
+	project := bw.AddProject(orgID, "Billing")
+	bw.AddSecret(orgID, project, "db_password", "hunter2", "")
+	bw.AddSecret(orgID, "", "api_key", "abc123", "")
+	newSDKClient := client.NewSDKClient
+	client.NewSDKClient = bw.NewClient
+	t.Cleanup(func() { client.NewSDKClient = newSDKClient })
+
+	tests := []struct {
+		name   string
+		token  string
+		checks map[string]Status
+	}{
+		{"valid token", "token", map[string]Status{"login": Pass, "projects": Pass, "secrets": Pass}},
+		{"invalid token", "other", map[string]Status{"login": Fail}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := doctor{config: &c.Config{Upstream: c.Upstream{OrgID: orgID}}, token: test.token}
+			d.checkAccess(true, client.Endpoints{})
+			if len(d.report.Checks) != len(test.checks) {
+				t.Fatalf("got checks %+v, want %v", d.report.Checks, test.checks)
+			}
+			for _, check := range d.report.Checks {
+				if check.Status != test.checks[check.Name] {
+					t.Errorf("%s: got %s (%s), want %s", check.Name, check.Status, check.Detail, test.checks[check.Name])
+				}
+			}
+		})
+	}
+	if calls := bw.Calls("secrets.get_by_ids") + bw.Calls("secrets.get") + bw.Calls("secrets.sync"); calls != 0 {
+		t.Errorf("read secret values %d times", calls)
+	}
+}
@@ -4,36 +4,136 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"sync"
 
 	"bws-cache/internal/pkg/api"
 	"bws-cache/internal/pkg/config"
 )
 
-func Start(ctx context.Context, config *config.Config) (chan error, *http.Server) {
+type Server struct {
+	*http.Server
+	API   *api.API
+	certs *certificates
+}
+
+func Start(ctx context.Context, config *config.Config) (chan error, *Server, error) {
 	slog.Debug("Starting http handler")
-	httpHandler := api.New(config)
+	httpHandler, err := api.New(config)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	server := http.Server{
-		Addr:    fmt.Sprintf(":%d", config.Port),
-		Handler: httpHandler,
+	server := Server{
+		Server: &http.Server{
+			Addr:        fmt.Sprintf(":%d", config.Port),
+			Handler:     httpHandler,
+			ConnContext: connContext,
+		},
+		API: httpHandler,
+	}
+	if config.TLS.Enabled() {
+		server.certs, err = newCertificates(config.TLS)
+		if err != nil {
+			httpHandler.Shutdown()
+			return nil, nil, err
+		}
+		server.TLSConfig = server.certs.tlsConfig()
+		slog.Info("Serving https")
 	}
-	slog.Info(fmt.Sprintf("Server started on port: %d", config.Port))
 
-	errCh := make(chan error)
+	var serve []func() error
+	var listeners []net.Listener
+	if config.Port != 0 {
+		listener, err := net.Listen("tcp", server.Addr)
+		if err != nil {
+			server.Shutdown(ctx)
+			return nil, nil, err
+		}
+		listeners = append(listeners, listener)
+		serve = append(serve, func() error {
+			if server.certs != nil {
+				return server.ServeTLS(listener, "", "")
+			}
+			return server.Serve(listener)
+		})
+		slog.Info(fmt.Sprintf("Server started on port: %d", config.Port))
+	}
+	if config.Socket.Path != "" {
+		listener, err := listenSocket(config.Socket)
+		if err != nil {
+			// Listeners not yet being served aren't closed by Shutdown.
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			server.Shutdown(ctx)
+			return nil, nil, fmt.Errorf("unable to listen on socket: %w", err)
+		}
+		serve = append(serve, func() error {
+			return server.Serve(listener)
+		})
+		slog.Info(fmt.Sprintf("Server started on socket: %s", config.Socket.Path))
+	}
 
+	errCh := make(chan error)
+	var wg sync.WaitGroup
+	for _, fn := range serve {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := fn()
+			if err == http.ErrServerClosed {
+				return
+			}
+			select {
+			case errCh <- err:
+			case <-ctx.Done():
+			}
+		}()
+	}
 	go func() {
-		defer close(errCh)
+		wg.Wait()
+		close(errCh)
+	}()
 
-		err := server.ListenAndServe()
-		if err == http.ErrServerClosed {
-			return
-		}
-		select {
-		case errCh <- err:
-		case <-ctx.Done():
-		}
+	return errCh, &server, nil
+}
+
+// Reload applies the live-reloadable settings from config and reloads the
+// TLS certificate.
+func (s *Server) Reload(config *config.Config) {
+	s.API.Reload(config)
+	if s.certs != nil {
+		s.certs.reload()
+	}
+}
+
+// Shutdown stops accepting new connections and waits for in-flight requests
+// to drain before releasing the API. If ctx expires first the remaining
+// connections are closed and the context error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	slog.Info("Draining http connections")
+	err := s.Server.Shutdown(ctx)
+	if err != nil {
+		s.Server.Close()
+	}
+	if s.certs != nil {
+		s.certs.stop()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.API.Shutdown()
 	}()
 
-	return errCh, &server
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	return err
 }
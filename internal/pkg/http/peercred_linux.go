@@ -0,0 +1,27 @@
+package http
+
+import (
+	"net"
+	"syscall"
+
+	"bws-cache/internal/pkg/auth"
+)
+
+func peerCredentials(conn *net.UnixConn) (*auth.Peer, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+	return &auth.Peer{UID: cred.Uid, GID: cred.Gid, PID: cred.Pid}, nil
+}
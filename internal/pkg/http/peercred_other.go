@@ -0,0 +1,14 @@
+//go:build !linux
+
+package http
+
+import (
+	"errors"
+	"net"
+
+	"bws-cache/internal/pkg/auth"
+)
+
+func peerCredentials(conn *net.UnixConn) (*auth.Peer, error) {
+	return nil, errors.New("peer credentials are only supported on linux")
+}
@@ -0,0 +1,97 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"bws-cache/internal/pkg/auth"
+	"bws-cache/internal/pkg/config"
+)
+
+// listenSocket listens on the Unix socket at config.Path, replacing a stale
+// socket left behind by an earlier run. A socket another process still
+// accepts connections on is left alone.
+func listenSocket(config config.Socket) (net.Listener, error) {
+	if info, err := os.Lstat(config.Path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		conn, err := net.Dial("unix", config.Path)
+		switch {
+		case err == nil:
+			conn.Close()
+			return nil, fmt.Errorf("socket %s is in use", config.Path)
+		case errors.Is(err, syscall.ECONNREFUSED):
+			slog.Debug(fmt.Sprintf("Removing stale socket %s", config.Path))
+			os.Remove(config.Path)
+		}
+	}
+	listener, err := net.Listen("unix", config.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	mode, _ := config.FileMode()
+	if err := os.Chmod(config.Path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if config.Owner != "" {
+		uid, gid, err := lookupOwner(config.Owner)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		if err := os.Chown(config.Path, uid, gid); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+// lookupOwner resolves user[:group], by name or number. The group is left
+// unchanged if not given.
+func lookupOwner(owner string) (int, int, error) {
+	userName, groupName, _ := strings.Cut(owner, ":")
+	uid, err := strconv.Atoi(userName)
+	if err != nil {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			return 0, 0, err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if groupName == "" {
+		return uid, -1, nil
+	}
+	gid, err := strconv.Atoi(groupName)
+	if err != nil {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return 0, 0, err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return uid, gid, nil
+}
+
+// connContext stores the peer credentials of Unix socket connections in the
+// context of their requests.
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	peer, err := peerCredentials(unixConn)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Unable to read peer credentials: %v", err))
+		return ctx
+	}
+	return auth.WithPeer(ctx, peer)
+}
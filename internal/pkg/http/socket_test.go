@@ -0,0 +1,53 @@
+package http
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bws-cache/internal/pkg/config"
+)
+
+func TestListenSocket(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, path string)
+		valid bool
+	}{
+		{"new", func(t *testing.T, path string) {}, true},
+		{"stale", func(t *testing.T, path string) {
+			listener, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			listener.(*net.UnixListener).SetUnlinkOnClose(false)
+			listener.Close()
+		}, true},
+		{"in use", func(t *testing.T, path string) {
+			listener, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { listener.Close() })
+		}, false},
+		{"regular file", func(t *testing.T, path string) {
+			if err := os.WriteFile(path, nil, 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "bws-cache.sock")
+			test.setup(t, path)
+			listener, err := listenSocket(config.Socket{Path: path, Mode: "0600"})
+			if (err == nil) != test.valid {
+				t.Fatalf("got error %v, want valid %t", err, test.valid)
+			}
+			if listener != nil {
+				listener.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"bws-cache/internal/pkg/config"
+	"bws-cache/internal/pkg/watch"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// certificates holds the server certificate and client CA pool, reloading
+// them when the files change so that rotated certificates are served to new
+// connections without a restart.
+type certificates struct {
+	config    config.TLS
+	cert      atomic.Pointer[tls.Certificate]
+	clientCAs atomic.Pointer[x509.CertPool]
+	mu        sync.Mutex
+	watchers  []*fsnotify.Watcher
+}
+
+func newCertificates(config config.TLS) (*certificates, error) {
+	certs := &certificates{config: config}
+	if err := certs.load(); err != nil {
+		return nil, err
+	}
+	for _, file := range []string{config.CertFile, config.KeyFile, config.ClientCAFile} {
+		if file == "" {
+			continue
+		}
+		watcher, err := watch.File(file, func() { go certs.reload() })
+		if err != nil {
+			certs.stop()
+			return nil, fmt.Errorf("unable to watch %s: %w", file, err)
+		}
+		certs.watchers = append(certs.watchers, watcher)
+	}
+	return certs, nil
+}
+
+func (c *certificates) load() error {
+	cert, err := tls.LoadX509KeyPair(c.config.CertFile, c.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load certificate: %w", err)
+	}
+	if c.config.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.config.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("unable to read client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", c.config.ClientCAFile)
+		}
+		c.clientCAs.Store(pool)
+	}
+	c.cert.Store(&cert)
+	return nil
+}
+
+// reload keeps serving the current certificate if the new one can't be
+// loaded, such as when only one of the cert and key has been replaced yet.
+func (c *certificates) reload() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.load(); err != nil {
+		slog.Error(fmt.Sprintf("Keeping current certificate: %v", err))
+		return
+	}
+	slog.Info("Reloaded TLS certificate")
+}
+
+func (c *certificates) stop() {
+	for _, watcher := range c.watchers {
+		watcher.Close()
+	}
+}
+
+func (c *certificates) tlsConfig() *tls.Config {
+	clientAuth := tls.NoClientCert
+	switch c.config.ClientAuth {
+	case "request":
+		clientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		clientAuth = tls.RequireAndVerifyClientCert
+	case "":
+		if c.config.ClientCAFile != "" {
+			clientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	minVersion := config.TLSVersions[c.config.MinVersion]
+	// The config returned per client replaces the server's, so it has to
+	// offer HTTP/2 itself.
+	nextProtos := []string{"h2", "http/1.1"}
+
+	return &tls.Config{
+		MinVersion: minVersion,
+		NextProtos: nextProtos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{
+				MinVersion:   minVersion,
+				NextProtos:   nextProtos,
+				Certificates: []tls.Certificate{*c.cert.Load()},
+				ClientAuth:   clientAuth,
+				ClientCAs:    c.clientCAs.Load(),
+			}, nil
+		},
+	}
+}
@@ -0,0 +1,228 @@
+// Package logging sets log levels at runtime, globally, per component or
+// for a single request.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Components can be given their own level. A record belongs to the
+// component named after the package it was logged from.
+var Components = []string{"api", "client", "cache"}
+
+type override struct {
+	level   slog.Level
+	expires time.Time
+	timer   *time.Timer
+}
+
+type levels struct {
+	mu   sync.RWMutex
+	base slog.Level
+	// overrides are set at runtime, "" overrides every component.
+	overrides map[string]*override
+}
+
+var std = &levels{overrides: make(map[string]*override)}
+
+// SetBase sets the level configured with log_level, used when no override
+// applies.
+func SetBase(level slog.Level) {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	std.base = level
+}
+
+// Set overrides the level of component, or of every component if it is
+// empty. A positive duration reverts the override once it has passed.
+func Set(component string, level slog.Level, duration time.Duration) error {
+	if component != "" && !slices.Contains(Components, component) {
+		return fmt.Errorf("unknown component %q, expected one of %s", component, strings.Join(Components, ", "))
+	}
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	if old, ok := std.overrides[component]; ok && old.timer != nil {
+		old.timer.Stop()
+	}
+	o := &override{level: level}
+	if duration > 0 {
+		o.expires = time.Now().Add(duration)
+		o.timer = time.AfterFunc(duration, func() {
+			std.mu.Lock()
+			expired := std.overrides[component] == o
+			if expired {
+				delete(std.overrides, component)
+			}
+			// Logging takes the lock too, so only log once it's released.
+			std.mu.Unlock()
+			if expired {
+				slog.Info(fmt.Sprintf("Log level override for %s expired", describe(component)))
+			}
+		})
+	}
+	std.overrides[component] = o
+	return nil
+}
+
+// Clear removes the override of component, or the one of every component
+// if it is empty.
+func Clear(component string) {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	if old, ok := std.overrides[component]; ok {
+		if old.timer != nil {
+			old.timer.Stop()
+		}
+		delete(std.overrides, component)
+	}
+}
+
+func describe(component string) string {
+	if component == "" {
+		return "all components"
+	}
+	return component
+}
+
+// Level returns the level in effect for component.
+func Level(component string) slog.Level {
+	std.mu.RLock()
+	defer std.mu.RUnlock()
+	return std.level(component)
+}
+
+func (l *levels) level(component string) slog.Level {
+	if o, ok := l.overrides[component]; ok && component != "" {
+		return o.level
+	}
+	if o, ok := l.overrides[""]; ok {
+		return o.level
+	}
+	return l.base
+}
+
+// min returns the lowest level in effect for any component.
+func (l *levels) min() slog.Level {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	min := l.level("")
+	for component, o := range l.overrides {
+		if component != "" && o.level < min {
+			min = o.level
+		}
+	}
+	return min
+}
+
+// Override is a level set at runtime.
+type Override struct {
+	Level   string     `json:"level"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// State is the configured level and the overrides in effect.
+type State struct {
+	Base       string              `json:"base"`
+	Level      string              `json:"level"`
+	Override   *Override           `json:"override,omitempty"`
+	Components map[string]Override `json:"components"`
+}
+
+// Current returns the levels in effect.
+func Current() State {
+	std.mu.RLock()
+	defer std.mu.RUnlock()
+	state := State{
+		Base:       std.base.String(),
+		Level:      std.level("").String(),
+		Components: make(map[string]Override),
+	}
+	for component, o := range std.overrides {
+		current := Override{Level: o.level.String()}
+		if !o.expires.IsZero() {
+			expires := o.expires
+			current.Expires = &expires
+		}
+		if component == "" {
+			state.Override = &current
+		} else {
+			state.Components[component] = current
+		}
+	}
+	return state
+}
+
+type debugKey struct{}
+
+// WithDebug returns a context whose records are logged at every level.
+func WithDebug(ctx context.Context) context.Context {
+	return context.WithValue(ctx, debugKey{}, true)
+}
+
+func debug(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	enabled, _ := ctx.Value(debugKey{}).(bool)
+	return enabled
+}
+
+var components sync.Map
+
+// component returns the component a record was logged from.
+func component(pc uintptr) string {
+	if pc == 0 {
+		return ""
+	}
+	if name, ok := components.Load(pc); ok {
+		return name.(string)
+	}
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	name := ""
+	if _, pkg, ok := strings.Cut(frame.Function, "/internal/pkg/"); ok {
+		pkg, _, _ = strings.Cut(pkg, ".")
+		if slices.Contains(Components, pkg) {
+			name = pkg
+		}
+	}
+	components.Store(pc, name)
+	return name
+}
+
+// Handler drops records below the level of their component, unless they
+// were logged for a request with debug logging enabled.
+type Handler struct {
+	next slog.Handler
+}
+
+// NewHandler returns a Handler passing records on to next, which should
+// accept every level.
+func NewHandler(next slog.Handler) *Handler {
+	return &Handler{next: next}
+}
+
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return debug(ctx) || level >= std.min()
+}
+
+func (h *Handler) Handle(ctx context.Context, record slog.Record) error {
+	if !debug(ctx) && record.Level < Level(component(record.PC)) {
+		return nil
+	}
+	return h.next.Handle(ctx, record)
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &Handler{next: h.next.WithAttrs(attrs)}
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	return &Handler{next: h.next.WithGroup(name)}
+}
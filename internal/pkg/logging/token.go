@@ -0,0 +1,47 @@
+package logging
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DebugHeader holds a DebugToken to log a single request at every level.
+const DebugHeader = "X-BWS-Debug"
+
+// DebugToken returns a token for DebugHeader signed with key that is valid
+// until expires.
+func DebugToken(key string, expires time.Time) string {
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	return expiry + "." + sign(key, expiry)
+}
+
+// VerifyDebugToken checks that token was signed with key and hasn't
+// expired.
+func VerifyDebugToken(key string, token string, now time.Time) error {
+	expiry, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return fmt.Errorf("malformed debug token")
+	}
+	if !hmac.Equal([]byte(signature), []byte(sign(key, expiry))) {
+		return fmt.Errorf("invalid debug token signature")
+	}
+	expires, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed debug token expiry")
+	}
+	if now.Unix() > expires {
+		return fmt.Errorf("debug token expired at %s", time.Unix(expires, 0).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func sign(key string, expiry string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte("bws-cache debug " + expiry))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -1,21 +1,62 @@
 package metrics
 
 import (
+	"time"
+
 	"github.com/go-chi/telemetry"
 )
 
+// BwsMetrics records measurements. A nil *BwsMetrics records nothing.
 type BwsMetrics struct {
 	*telemetry.Scope
+	// Tags are added to every measurement.
+	Tags map[string]string
+}
+
+// Tagged returns metrics that add tags to every measurement.
+func (b *BwsMetrics) Tagged(tags map[string]string) *BwsMetrics {
+	if b == nil {
+		return nil
+	}
+	return &BwsMetrics{Scope: b.Scope, Tags: b.tags(tags)}
+}
+
+func (b *BwsMetrics) tags(tags map[string]string) map[string]string {
+	if len(b.Tags) == 0 {
+		return tags
+	}
+	merged := make(map[string]string, len(b.Tags)+len(tags))
+	for k, v := range b.Tags {
+		merged[k] = v
+	}
+	for k, v := range tags {
+		merged[k] = v
+	}
+	return merged
 }
 
 func (b *BwsMetrics) Counter(metric string, tags map[string]string) {
-	b.RecordHit(metric, tags)
+	if b == nil {
+		return
+	}
+	b.RecordHit(metric, b.tags(tags))
 }
 
 func (b *BwsMetrics) Gauge(metric string, tags map[string]string, value float64) {
-	b.RecordGauge(metric, tags, value)
+	if b == nil {
+		return
+	}
+	b.RecordGauge(metric, b.tags(tags), value)
+}
+
+// Duration records the time since start in a histogram.
+func (b *BwsMetrics) Duration(metric string, tags map[string]string, start time.Time) {
+	if b == nil {
+		return
+	}
+	b.RecordDuration(metric, b.tags(tags), start, time.Now())
 }
 
 func New() *BwsMetrics {
-	return &BwsMetrics{telemetry.NewScope("bws-cache")}
+	return &BwsMetrics{Scope: telemetry.NewScope("bws-cache")}
 }
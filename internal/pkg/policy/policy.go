@@ -0,0 +1,286 @@
+package policy
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"os"
+	"path"
+	"slices"
+
+	"bws-cache/internal/pkg/auth"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+// Policy is the set of rules loaded from a policy file. A request is denied
+// if any matching rule denies it, allowed if any matching rule allows it and
+// otherwise gets the default effect.
+type Policy struct {
+	Default string `yaml:"default"`
+	Rules   []Rule `yaml:"rules"`
+}
+
+// Rule applies Effect to requests from any of Clients, or from everyone if
+// Clients is empty, for secrets matching every non-empty resource list.
+type Rule struct {
+	Name     string   `yaml:"name"`
+	Effect   string   `yaml:"effect"`
+	Clients  Clients  `yaml:"clients"`
+	Keys     []string `yaml:"keys"`
+	Projects []string `yaml:"projects"`
+	IDs      []string `yaml:"ids"`
+
+	prefixes []netip.Prefix
+}
+
+type Clients struct {
+	APIKeys []string `yaml:"api_keys"`
+	// JWT are the names of JWT mappings.
+	JWT          []string `yaml:"jwt"`
+	Fingerprints []string `yaml:"fingerprints"`
+	// Subjects are glob patterns of the caller's subject.
+	Subjects []string `yaml:"subjects"`
+	// Certificates are glob patterns of the subject or any SAN of a
+	// verified TLS client certificate.
+	Certificates []string `yaml:"certificates"`
+	CIDRs        []string `yaml:"cidrs"`
+	// Peers are the names of peer mappings, UIDs and GIDs match the
+	// credentials of any caller on the Unix socket.
+	Peers []string `yaml:"peers"`
+	UIDs  []uint32 `yaml:"uids"`
+	GIDs  []uint32 `yaml:"gids"`
+}
+
+// Request describes a secret read to be checked against the policy.
+type Request struct {
+	Identity *auth.Identity
+	Addr     netip.Addr
+	ID       string
+	Key      string
+	Project  string
+}
+
+type Decision struct {
+	Allowed bool
+	// Rule is the name of the rule that decided, empty for the default.
+	Rule string
+}
+
+// Load reads and validates a policy file.
+func Load(file string) (*Policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read policy file: %w", err)
+	}
+	policy := Policy{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&policy); err != nil {
+		return nil, fmt.Errorf("unable to parse policy file: %w", err)
+	}
+	if err := policy.compile(); err != nil {
+		return nil, fmt.Errorf("invalid policy file: %w", err)
+	}
+	return &policy, nil
+}
+
+func (p *Policy) compile() error {
+	if p.Default == "" {
+		p.Default = Deny
+	}
+	if p.Default != Allow && p.Default != Deny {
+		return fmt.Errorf("default must be %s or %s", Allow, Deny)
+	}
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if rule.Effect != Allow && rule.Effect != Deny {
+			return fmt.Errorf("%s: effect must be %s or %s", rule.Name, Allow, Deny)
+		}
+		for _, pattern := range rule.Keys {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%s: invalid key pattern %q", rule.Name, pattern)
+			}
+		}
+		for _, pattern := range rule.Clients.Subjects {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%s: invalid subject pattern %q", rule.Name, pattern)
+			}
+		}
+		for _, pattern := range rule.Clients.Certificates {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%s: invalid certificate pattern %q", rule.Name, pattern)
+			}
+		}
+		for _, cidr := range rule.Clients.CIDRs {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return fmt.Errorf("%s: %w", rule.Name, err)
+			}
+			rule.prefixes = append(rule.prefixes, prefix.Masked())
+		}
+	}
+	return nil
+}
+
+// UsesProjects reports whether any rule matches on project names, which
+// have to be looked up separately from the secret.
+func (p *Policy) UsesProjects() bool {
+	return slices.ContainsFunc(p.Rules, func(rule Rule) bool {
+		return len(rule.Projects) > 0
+	})
+}
+
+func (p *Policy) Evaluate(req Request) Decision {
+	allowedBy := ""
+	for _, rule := range p.Rules {
+		if !rule.matchClient(req) || !rule.matchSecret(req) {
+			continue
+		}
+		if rule.Effect == Deny {
+			return Decision{Allowed: false, Rule: rule.Name}
+		}
+		if allowedBy == "" {
+			allowedBy = rule.Name
+		}
+	}
+	if allowedBy != "" {
+		return Decision{Allowed: true, Rule: allowedBy}
+	}
+	return Decision{Allowed: p.Default == Allow}
+}
+
+func (r *Rule) matchClient(req Request) bool {
+	clients := r.Clients
+	if len(clients.APIKeys) == 0 && len(clients.JWT) == 0 && len(clients.Fingerprints) == 0 &&
+		len(clients.Subjects) == 0 && len(clients.Certificates) == 0 && len(r.prefixes) == 0 &&
+		len(clients.Peers) == 0 && len(clients.UIDs) == 0 && len(clients.GIDs) == 0 {
+		return true
+	}
+	if identity := req.Identity; identity != nil {
+		if identity.Kind == auth.KindAPIKey && slices.Contains(clients.APIKeys, identity.Name) {
+			return true
+		}
+		if identity.Kind == auth.KindJWT && slices.Contains(clients.JWT, identity.Name) {
+			return true
+		}
+		if identity.Kind == auth.KindPeer && slices.Contains(clients.Peers, identity.Name) {
+			return true
+		}
+		if peer := identity.Peer; peer != nil &&
+			(slices.Contains(clients.UIDs, peer.UID) || slices.Contains(clients.GIDs, peer.GID)) {
+			return true
+		}
+		if slices.Contains(clients.Fingerprints, identity.Fingerprint) {
+			return true
+		}
+		if identity.Subject != "" && slices.ContainsFunc(clients.Subjects, func(pattern string) bool {
+			ok, _ := path.Match(pattern, identity.Subject)
+			return ok
+		}) {
+			return true
+		}
+		for _, name := range identity.Certificate.Names() {
+			if slices.ContainsFunc(clients.Certificates, func(pattern string) bool {
+				ok, _ := path.Match(pattern, name)
+				return ok
+			}) {
+				return true
+			}
+		}
+	}
+	if req.Addr.IsValid() {
+		addr := req.Addr.Unmap()
+		for _, prefix := range r.prefixes {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Precheck decides req before the secret is read, when only its ID or only
+// its key is known and its project isn't. It reports whether the decision
+// holds whatever the rest of the secret turns out to be, otherwise the
+// request has to be evaluated once the secret is read.
+func (p *Policy) Precheck(req Request) (Decision, bool) {
+	allowedBy := ""
+	mayDeny, mayAllow := false, false
+	for _, rule := range p.Rules {
+		if !rule.matchClient(req) {
+			continue
+		}
+		match, known := rule.matchPartialSecret(req)
+		switch {
+		case !known && rule.Effect == Deny:
+			mayDeny = true
+		case !known:
+			mayAllow = true
+		case !match:
+		case rule.Effect == Deny:
+			return Decision{Allowed: false, Rule: rule.Name}, true
+		case allowedBy == "":
+			allowedBy = rule.Name
+		}
+	}
+	if mayDeny || (allowedBy == "" && mayAllow) {
+		return Decision{}, false
+	}
+	if allowedBy != "" {
+		return Decision{Allowed: true, Rule: allowedBy}, true
+	}
+	return Decision{Allowed: p.Default == Allow}, true
+}
+
+// matchPartialSecret matches the secret of a request with only its ID or
+// only its key known, reporting whether the match is known.
+func (r *Rule) matchPartialSecret(req Request) (match bool, known bool) {
+	known = true
+	if len(r.IDs) > 0 {
+		if req.ID == "" {
+			known = false
+		} else if !slices.Contains(r.IDs, req.ID) {
+			return false, true
+		}
+	}
+	if len(r.Keys) > 0 {
+		if req.Key == "" {
+			known = false
+		} else if !r.matchKey(req.Key) {
+			return false, true
+		}
+	}
+	if len(r.Projects) > 0 {
+		known = false
+	}
+	return known, known
+}
+
+func (r *Rule) matchKey(key string) bool {
+	return slices.ContainsFunc(r.Keys, func(pattern string) bool {
+		ok, _ := path.Match(pattern, key)
+		return ok
+	})
+}
+
+func (r *Rule) matchSecret(req Request) bool {
+	if len(r.IDs) > 0 && !slices.Contains(r.IDs, req.ID) {
+		return false
+	}
+	if len(r.Projects) > 0 && !slices.Contains(r.Projects, req.Project) {
+		return false
+	}
+	if len(r.Keys) > 0 && !r.matchKey(req.Key) {
+		return false
+	}
+	return true
+}
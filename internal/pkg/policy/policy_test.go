@@ -0,0 +1,132 @@
+package policy
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"bws-cache/internal/pkg/auth"
+)
+
+func testPolicy(t *testing.T) *Policy {
+	t.Helper()
+	p := &Policy{
+		Default: Deny,
+		Rules: []Rule{
+			{Name: "billing", Effect: Allow, Clients: Clients{APIKeys: []string{"billing"}}, Keys: []string{"billing_*"}},
+			{Name: "billing-project", Effect: Allow, Clients: Clients{APIKeys: []string{"billing"}}, Projects: []string{"Billing"}},
+			{Name: "office", Effect: Allow, Clients: Clients{CIDRs: []string{"10.1.0.0/16"}}, IDs: []string{"id-1"}},
+			{Name: "no-root", Effect: Deny, Keys: []string{"*_root_*"}},
+			{Name: "no-legacy", Effect: Deny, Projects: []string{"Legacy"}},
+		},
+	}
+	if err := p.compile(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+var billing = &auth.Identity{Kind: auth.KindAPIKey, Name: "billing"}
+
+func TestEvaluate(t *testing.T) {
+	p := testPolicy(t)
+	tests := []struct {
+		name    string
+		req     Request
+		allowed bool
+		rule    string
+	}{
+		{"key allowed", Request{Identity: billing, Key: "billing_db"}, true, "billing"},
+		{"project allowed", Request{Identity: billing, Key: "other", Project: "Billing"}, true, "billing-project"},
+		{"other client", Request{Identity: &auth.Identity{Kind: auth.KindAPIKey, Name: "web"}, Key: "billing_db"}, false, ""},
+		{"deny wins", Request{Identity: billing, Key: "billing_root_password"}, false, "no-root"},
+		{"denied project", Request{Identity: billing, Key: "billing_db", Project: "Legacy"}, false, "no-legacy"},
+		{"cidr", Request{Addr: netip.MustParseAddr("10.1.2.3"), ID: "id-1"}, true, "office"},
+		{"mapped cidr", Request{Addr: netip.MustParseAddr("::ffff:10.1.2.3"), ID: "id-1"}, true, "office"},
+		{"outside cidr", Request{Addr: netip.MustParseAddr("10.2.0.1"), ID: "id-1"}, false, ""},
+		{"default", Request{Key: "anything"}, false, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decision := p.Evaluate(test.req)
+			if decision.Allowed != test.allowed || decision.Rule != test.rule {
+				t.Errorf("got %+v, want allowed %t by %q", decision, test.allowed, test.rule)
+			}
+		})
+	}
+}
+
+func TestPrecheck(t *testing.T) {
+	p := testPolicy(t)
+	tests := []struct {
+		name    string
+		req     Request
+		decided bool
+		allowed bool
+	}{
+		// A deny on projects may still apply once the secret is read.
+		{"allowed key", Request{Identity: billing, Key: "billing_db"}, false, false},
+		{"denied key", Request{Identity: billing, Key: "billing_root_password"}, true, false},
+		{"unknown client", Request{Identity: &auth.Identity{Kind: auth.KindAPIKey, Name: "web"}, Key: "web_db"}, false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decision, decided := p.Precheck(test.req)
+			if decided != test.decided || (decided && decision.Allowed != test.allowed) {
+				t.Errorf("got %+v decided %t, want allowed %t decided %t", decision, decided, test.allowed, test.decided)
+			}
+		})
+	}
+
+	// Without rules on projects, rules on keys and IDs decide up front.
+	p.Rules = slices.DeleteFunc(p.Rules, func(rule Rule) bool { return len(rule.Projects) > 0 })
+	tests = []struct {
+		name    string
+		req     Request
+		decided bool
+		allowed bool
+	}{
+		{"allowed key", Request{Identity: billing, Key: "billing_db"}, true, true},
+		{"other key", Request{Identity: billing, Key: "web_db"}, true, false},
+		{"allowed id", Request{Addr: netip.MustParseAddr("10.1.2.3"), ID: "id-1"}, false, false},
+		{"other id", Request{Addr: netip.MustParseAddr("10.1.2.3"), ID: "id-2"}, false, false},
+		{"denied key", Request{Identity: billing, Key: "billing_root_password"}, true, false},
+	}
+	for _, test := range tests {
+		t.Run("no projects/"+test.name, func(t *testing.T) {
+			decision, decided := p.Precheck(test.req)
+			if decided != test.decided || (decided && decision.Allowed != test.allowed) {
+				t.Errorf("got %+v decided %t, want allowed %t decided %t", decision, decided, test.allowed, test.decided)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name  string
+		yaml  string
+		valid bool
+	}{
+		{"valid", "default: allow\nrules:\n  - effect: deny\n    keys: [\"*_root_*\"]\n", true},
+		{"bad default", "default: maybe\n", false},
+		{"bad effect", "rules:\n  - effect: permit\n", false},
+		{"bad pattern", "rules:\n  - effect: deny\n    keys: [\"[\"]\n", false},
+		{"bad cidr", "rules:\n  - effect: allow\n    clients:\n      cidrs: [\"10.0.0.0/33\"]\n", false},
+		{"unknown field", "rules:\n  - effect: allow\n    key: [\"a\"]\n", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "policy.yml")
+			if err := os.WriteFile(file, []byte(test.yaml), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := Load(file)
+			if (err == nil) != test.valid {
+				t.Errorf("got error %v, want valid %t", err, test.valid)
+			}
+		})
+	}
+}
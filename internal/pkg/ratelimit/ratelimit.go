@@ -0,0 +1,247 @@
+package ratelimit
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"sync"
+	"time"
+
+	c "bws-cache/internal/pkg/config"
+)
+
+// idle is how long a bucket goes unused before it is forgotten. A full
+// bucket is the same as a forgotten one, so this only bounds memory.
+const idle = 10 * time.Minute
+
+// Error is returned when a limit is reached.
+type Error struct {
+	// Limit names the limit that was reached.
+	Limit      string
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rate limit %s reached, retry after %s", e.Limit, e.RetryAfter.Round(time.Second))
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter is a set of token buckets, one per key, refilled at Rate tokens
+// a second up to Burst.
+type Limiter struct {
+	name    string
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+func newLimiter(name string) *Limiter {
+	return &Limiter{name: name, buckets: make(map[string]*bucket)}
+}
+
+func (l *Limiter) configure(config c.Bucket) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = config.Rate
+	l.burst = float64(config.Burst)
+	if l.burst < 1 {
+		l.burst = math.Max(1, math.Ceil(l.rate))
+	}
+}
+
+// allow takes a token from the bucket for key, or returns how long until
+// one is available. A limiter with no rate allows everything.
+func (l *Limiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return true, 0
+	}
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// refund puts back a token taken from the bucket for key by allow.
+func (l *Limiter) refund(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.buckets[key]; ok {
+		b.tokens = math.Min(l.burst, b.tokens+1)
+	}
+}
+
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > idle {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Len returns the number of keys being tracked.
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// Quota counts upstream calls per tenant per UTC day.
+type Quota struct {
+	mu    sync.Mutex
+	limit int
+	day   string
+	used  map[string]int
+}
+
+func (q *Quota) allow(tenant string, now time.Time) (bool, time.Duration, int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now = now.UTC()
+	if day := now.Format(time.DateOnly); day != q.day {
+		q.day = day
+		q.used = make(map[string]int)
+	}
+	if q.limit > 0 && q.used[tenant] >= q.limit {
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		return false, midnight.Sub(now), q.used[tenant]
+	}
+	q.used[tenant]++
+	return true, 0, q.used[tenant]
+}
+
+// usage returns the calls counted today per tenant.
+func (q *Quota) usage(now time.Time) map[string]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if now.UTC().Format(time.DateOnly) != q.day {
+		return nil
+	}
+	return maps.Clone(q.used)
+}
+
+// Limits applies the rate limits and quota of a RateLimit config.
+type Limits struct {
+	ClientHits   *Limiter
+	ClientMisses *Limiter
+	TokenHits    *Limiter
+	TokenMisses  *Limiter
+	Quota        *Quota
+	now          func() time.Time
+}
+
+func New(config c.RateLimit) *Limits {
+	limits := &Limits{
+		ClientHits:   newLimiter("client_hits"),
+		ClientMisses: newLimiter("client_misses"),
+		TokenHits:    newLimiter("token_hits"),
+		TokenMisses:  newLimiter("token_misses"),
+		Quota:        &Quota{},
+		now:          time.Now,
+	}
+	limits.Configure(config)
+	return limits
+}
+
+// Configure applies new limits, keeping the state of the buckets and the
+// quota used today.
+func (l *Limits) Configure(config c.RateLimit) {
+	l.ClientHits.configure(config.Client.Hits)
+	l.ClientMisses.configure(config.Client.Misses)
+	l.TokenHits.configure(config.Token.Hits)
+	l.TokenMisses.configure(config.Token.Misses)
+	l.Quota.mu.Lock()
+	l.Quota.limit = config.DailyQuota
+	l.Quota.mu.Unlock()
+}
+
+// Limiters returns every limiter, for reporting.
+func (l *Limits) Limiters() []*Limiter {
+	return []*Limiter{l.ClientHits, l.ClientMisses, l.TokenHits, l.TokenMisses}
+}
+
+func (l *Limiter) Name() string {
+	return l.name
+}
+
+// QuotaUsed returns the calls to Bitwarden made today per token.
+func (l *Limits) QuotaUsed() map[string]int {
+	return l.Quota.usage(l.now())
+}
+
+type charge struct {
+	limiter *Limiter
+	key     string
+}
+
+// take takes a token from every bucket, or from none of them if one of
+// them is empty.
+func take(now time.Time, charges ...charge) error {
+	for i, check := range charges {
+		if ok, wait := check.limiter.allow(check.key, now); !ok {
+			refund(charges[:i]...)
+			return &Error{Limit: check.limiter.name, RetryAfter: wait}
+		}
+	}
+	return nil
+}
+
+func refund(charges ...charge) {
+	for _, taken := range charges {
+		taken.limiter.refund(taken.key)
+	}
+}
+
+// Hit charges a request served from the cache to client and token, or to
+// neither if one of them is limited.
+func (l *Limits) Hit(client string, token string) error {
+	return take(l.now(), charge{l.ClientHits, client}, charge{l.TokenHits, token})
+}
+
+// Background charges a call to Bitwarden made in the background with token
+// to its daily quota only, so it doesn't use up the budgets of requests.
+// It returns the quota used today by token.
+func (l *Limits) Background(token string) (int, error) {
+	ok, wait, used := l.Quota.allow(token, l.now())
+	if !ok {
+		return used, &Error{Limit: "daily_quota", RetryAfter: wait}
+	}
+	return used, nil
+}
+
+// Miss charges a call to Bitwarden to client and token, and to the daily
+// quota of token, or to none of them if one is used up. It returns the quota used today by token.
+func (l *Limits) Miss(client string, token string) (int, error) {
+	now := l.now()
+	charges := []charge{{l.ClientMisses, client}, {l.TokenMisses, token}}
+	if err := take(now, charges...); err != nil {
+		return 0, err
+	}
+	ok, wait, used := l.Quota.allow(token, now)
+	if !ok {
+		refund(charges...)
+		return used, &Error{Limit: "daily_quota", RetryAfter: wait}
+	}
+	return used, nil
+}
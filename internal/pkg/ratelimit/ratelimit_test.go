@@ -0,0 +1,197 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	c "bws-cache/internal/pkg/config"
+)
+
+// clock is a time source for Limits that only moves when told to.
+type clock struct{ now time.Time }
+
+func (c *clock) advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newLimits(config c.RateLimit, start time.Time) (*Limits, *clock) {
+	clock := &clock{now: start}
+	limits := New(config)
+	limits.now = func() time.Time { return clock.now }
+	return limits, clock
+}
+
+func TestHit(t *testing.T) {
+	limits, clock := newLimits(c.RateLimit{Client: c.Budget{Hits: c.Bucket{Rate: 2, Burst: 3}}}, time.Now())
+
+	// Each step advances the clock by wait, then hits as client.
+	steps := []struct {
+		wait   time.Duration
+		client string
+		ok     bool
+	}{
+		{0, "a", true},
+		{0, "a", true},
+		{0, "a", true},
+		{0, "a", false},
+		{0, "b", true},
+		{500 * time.Millisecond, "a", true},
+		{0, "a", false},
+		{10 * time.Second, "a", true},
+		{0, "a", true},
+		{0, "a", true},
+		{0, "a", false},
+	}
+	for i, step := range steps {
+		clock.advance(step.wait)
+		err := limits.Hit(step.client, "token")
+		if (err == nil) != step.ok {
+			t.Fatalf("step %d: got %v, want ok %t", i, err, step.ok)
+		}
+		var limited *Error
+		if err != nil && (!errors.As(err, &limited) || limited.Limit != "client_hits" || limited.RetryAfter != 500*time.Millisecond) {
+			t.Fatalf("step %d: got %#v, want client_hits retry after 500ms", i, err)
+		}
+	}
+}
+
+func TestDeniedChargesNothing(t *testing.T) {
+	one := c.Bucket{Rate: 1, Burst: 1}
+	limits, _ := newLimits(c.RateLimit{
+		Client:     c.Budget{Hits: one, Misses: one},
+		Token:      c.Budget{Hits: one, Misses: one},
+		DailyQuota: 1,
+	}, time.Now())
+
+	// Use up the token buckets and quota with another client.
+	if err := limits.Hit("b", "token"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := limits.Miss("b", "token"); err != nil {
+		t.Fatal(err)
+	}
+	if err := limits.Hit("a", "token"); err == nil {
+		t.Fatal("hit allowed past the token bucket")
+	}
+	if _, err := limits.Miss("a", "token"); err == nil {
+		t.Fatal("miss allowed past the token bucket")
+	}
+	// The denied requests left the buckets of client a full.
+	if err := limits.Hit("a", "other"); err != nil {
+		t.Errorf("hit: %v", err)
+	}
+	if _, err := limits.Miss("a", "other"); err != nil {
+		t.Errorf("miss: %v", err)
+	}
+
+	// A miss denied by the quota leaves the buckets full too.
+	limits.Quota.mu.Lock()
+	limits.Quota.used["another"] = 1
+	limits.Quota.mu.Unlock()
+	if _, err := limits.Miss("c", "another"); err == nil {
+		t.Fatal("miss allowed past the quota")
+	}
+	limits.Configure(c.RateLimit{Client: c.Budget{Misses: one}, Token: c.Budget{Misses: one}})
+	if _, err := limits.Miss("c", "another"); err != nil {
+		t.Errorf("miss after the quota was lifted: %v", err)
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	limits, _ := newLimits(c.RateLimit{}, time.Now())
+	for range 1000 {
+		if err := limits.Hit("a", "token"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := limits.Miss("a", "token"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := limits.ClientHits.Len(); n != 0 {
+		t.Errorf("unlimited limiter tracks %d keys", n)
+	}
+}
+
+func TestConfigureKeepsState(t *testing.T) {
+	config := c.RateLimit{Token: c.Budget{Misses: c.Bucket{Rate: 1, Burst: 1}}}
+	limits, _ := newLimits(config, time.Now())
+	if _, err := limits.Miss("a", "token"); err != nil {
+		t.Fatal(err)
+	}
+	limits.Configure(config)
+	if _, err := limits.Miss("a", "token"); err == nil {
+		t.Error("reconfiguring refilled the bucket")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	limits, clock := newLimits(c.RateLimit{Client: c.Budget{Hits: c.Bucket{Rate: 1}}}, time.Now())
+	limits.Hit("a", "token")
+	clock.advance(idle + time.Minute)
+	limits.Hit("b", "token")
+	if n := limits.ClientHits.Len(); n != 1 {
+		t.Errorf("tracking %d keys, want the idle one forgotten", n)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	start := time.Date(2024, 5, 1, 23, 59, 0, 0, time.UTC)
+	limits, clock := newLimits(c.RateLimit{DailyQuota: 2}, start)
+
+	steps := []struct {
+		wait       time.Duration
+		background bool
+		used       int
+		retryAfter time.Duration
+	}{
+		{0, false, 1, 0},
+		{0, true, 2, 0},
+		{0, false, 2, time.Minute},
+		{30 * time.Second, true, 2, 30 * time.Second},
+		// The quota rolls over at midnight UTC.
+		{30 * time.Second, false, 1, 0},
+		{0, false, 2, 0},
+		{0, true, 2, 24 * time.Hour},
+	}
+	for i, step := range steps {
+		clock.advance(step.wait)
+		var used int
+		var err error
+		if step.background {
+			used, err = limits.Background("token")
+		} else {
+			used, err = limits.Miss("client", "token")
+		}
+		var limited *Error
+		switch {
+		case used != step.used:
+			t.Fatalf("step %d: used %d, want %d", i, used, step.used)
+		case step.retryAfter == 0 && err != nil:
+			t.Fatalf("step %d: got %v", i, err)
+		case step.retryAfter != 0 && (!errors.As(err, &limited) || limited.Limit != "daily_quota" || limited.RetryAfter != step.retryAfter):
+			t.Fatalf("step %d: got %v, want daily_quota retry after %s", i, err, step.retryAfter)
+		}
+	}
+	if used := limits.QuotaUsed(); used["token"] != 2 || len(used) != 1 {
+		t.Errorf("got quota used %v", used)
+	}
+	clock.advance(24 * time.Hour)
+	if used := limits.QuotaUsed(); len(used) != 0 {
+		t.Errorf("got quota used %v the next day", used)
+	}
+}
+
+func TestQuotaInLocalTime(t *testing.T) {
+	// Midnight UTC is mid-afternoon in UTC-10, the quota still rolls over.
+	zone := time.FixedZone("UTC-10", -10*60*60)
+	limits, clock := newLimits(c.RateLimit{DailyQuota: 1}, time.Date(2024, 5, 1, 13, 59, 0, 0, zone))
+	if _, err := limits.Background("token"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := limits.Background("token"); err == nil {
+		t.Fatal("quota not enforced")
+	}
+	clock.advance(time.Minute)
+	if _, err := limits.Background("token"); err != nil {
+		t.Errorf("quota didn't roll over at midnight UTC: %v", err)
+	}
+}
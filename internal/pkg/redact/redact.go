@@ -0,0 +1,372 @@
+package redact
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const Mask = "[REDACTED]"
+
+// MinLength is the shortest value that is redacted, masking shorter values
+// would mangle unrelated log text.
+const MinLength = 4
+
+// maxTokens bounds the tokens added with AddToken that are held, the oldest
+// are forgotten first.
+const maxTokens = 10000
+
+// Builtin patterns match credentials even before they have been seen: BWS
+// access tokens, local API keys, JWTs and bearer tokens.
+var Builtin = []string{
+	`0\.[0-9a-fA-F-]{36}\.[A-Za-z0-9]+:[A-Za-z0-9+/=]+`,
+	`bwsc_[A-Za-z0-9_-]{43}`,
+	`eyJ[A-Za-z0-9_-]*\.eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]*`,
+	`(?i)bearer\s+[^\s"]+`,
+}
+
+// delimiters separate the words of log text that are checked against the
+// known values, in addition to whitespace.
+const delimiters = `"'=,;:&?/()[]{}<>`
+
+type digest [sha256.Size]byte
+
+// known is a value that is masked as long as it was added with Add, is
+// among the latest tokens added with AddToken, or is held, see Hold.
+type known struct {
+	length    int
+	permanent bool
+	token     bool
+	holds     int
+}
+
+// Redactor masks known values and pattern matches. Known values are held
+// only as HMACs under a random key, so they are masked where they make up
+// the whole text, a quoted string or a word of it.
+type Redactor struct {
+	mu     sync.RWMutex
+	key    []byte
+	values map[digest]*known
+	// tokens are the digests of the tokens added with AddToken, oldest
+	// first.
+	tokens   []digest
+	lengths  map[int]int
+	patterns []*regexp.Regexp
+}
+
+var std = New()
+
+func New() *Redactor {
+	key := make([]byte, 32)
+	rand.Read(key)
+	r := &Redactor{key: key, values: make(map[digest]*known), lengths: make(map[int]int)}
+	r.SetPatterns(nil)
+	return r
+}
+
+// Default returns the redactor used by Handler and the package functions.
+func Default() *Redactor {
+	return std
+}
+
+// Add registers values, such as configured tokens and keys, to be masked
+// wherever they appear in logs for as long as the process runs.
+func Add(values ...string) {
+	std.Add(values...)
+}
+
+func (r *Redactor) Add(values ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, value := range values {
+		r.add(value, func(sum digest, k *known) { k.permanent = true })
+	}
+}
+
+// AddToken registers tokens presented by clients, which keep changing, to
+// be masked. Only the latest maxTokens are remembered, see Add and Hold for
+// values that must not be forgotten.
+func AddToken(tokens ...string) {
+	std.AddToken(tokens...)
+}
+
+func (r *Redactor) AddToken(tokens ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, token := range tokens {
+		r.add(token, func(sum digest, k *known) {
+			if !k.token {
+				k.token = true
+				r.tokens = append(r.tokens, sum)
+			}
+		})
+	}
+	for len(r.tokens) > maxTokens {
+		oldest := r.tokens[0]
+		r.tokens = r.tokens[1:]
+		r.values[oldest].token = false
+		r.forget(oldest)
+	}
+}
+
+// Hold registers values, such as cached secrets, to be masked until the
+// returned function is called, for every hold on them.
+func Hold(values ...string) (release func()) {
+	return std.Hold(values...)
+}
+
+func (r *Redactor) Hold(values ...string) (release func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var sums []digest
+	for _, value := range values {
+		r.add(value, func(sum digest, k *known) {
+			k.holds++
+			sums = append(sums, sum)
+		})
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			for _, sum := range sums {
+				r.values[sum].holds--
+				r.forget(sum)
+			}
+		})
+	}
+}
+
+// add calls fn with every form of value long enough to be masked, adding
+// those that aren't known yet.
+func (r *Redactor) add(value string, fn func(sum digest, k *known)) {
+	for _, form := range forms(value) {
+		if len(form) < MinLength {
+			continue
+		}
+		sum := r.sum(form)
+		k, ok := r.values[sum]
+		if !ok {
+			k = &known{length: len(form)}
+			r.values[sum] = k
+			r.lengths[k.length]++
+		}
+		fn(sum, k)
+	}
+}
+
+// forget stops masking the value with sum once nothing keeps it.
+func (r *Redactor) forget(sum digest) {
+	k := r.values[sum]
+	if k.permanent || k.token || k.holds > 0 {
+		return
+	}
+	delete(r.values, sum)
+	if r.lengths[k.length]--; r.lengths[k.length] == 0 {
+		delete(r.lengths, k.length)
+	}
+}
+
+func (r *Redactor) sum(value string) digest {
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(value))
+	return digest(mac.Sum(nil))
+}
+
+// forms returns value as it appears in plain text and in JSON.
+func forms(value string) []string {
+	quoted, _ := json.Marshal(value)
+	escaped := string(quoted[1 : len(quoted)-1])
+	if escaped == value {
+		return []string{value}
+	}
+	return []string{value, escaped}
+}
+
+// SetPatterns replaces the configured regular expressions, which are
+// masked in addition to Builtin.
+func SetPatterns(patterns []string) error {
+	return std.SetPatterns(patterns)
+}
+
+func (r *Redactor) SetPatterns(patterns []string) error {
+	var compiled []*regexp.Regexp
+	for _, pattern := range append(Builtin, patterns...) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid redaction pattern %q: %w", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	r.mu.Lock()
+	r.patterns = compiled
+	r.mu.Unlock()
+	return nil
+}
+
+// String masks every known value and pattern match in s.
+func String(s string) string {
+	return std.String(s)
+}
+
+func (r *Redactor) String(s string) string {
+	r.mu.RLock()
+	s = r.maskKnown(s)
+	patterns := r.patterns
+	r.mu.RUnlock()
+
+	for _, re := range patterns {
+		s = re.ReplaceAllLiteralString(s, Mask)
+	}
+	return s
+}
+
+// maskKnown masks the known values in s. Every candidate is hashed at most
+// once per way of splitting s, so the cost is linear in the length of s
+// however many values are known.
+func (r *Redactor) maskKnown(s string) string {
+	if len(r.values) == 0 {
+		return s
+	}
+	type span struct{ start, end int }
+	var spans []span
+	check := func(start, end int) {
+		if r.lengths[end-start] == 0 {
+			return
+		}
+		if _, ok := r.values[r.sum(s[start:end])]; ok {
+			spans = append(spans, span{start, end})
+		}
+	}
+	check(0, len(s))
+	eachQuoted(s, check)
+	eachWord(s, unicode.IsSpace, check)
+	eachWord(s, func(c rune) bool { return unicode.IsSpace(c) || strings.ContainsRune(delimiters, c) }, check)
+	if len(spans) == 0 {
+		return s
+	}
+
+	slices.SortFunc(spans, func(a, b span) int { return a.start - b.start })
+	var masked strings.Builder
+	last := 0
+	for _, span := range spans {
+		if span.start < last {
+			last = max(last, span.end)
+			continue
+		}
+		masked.WriteString(s[last:span.start])
+		masked.WriteString(Mask)
+		last = span.end
+	}
+	masked.WriteString(s[last:])
+	return masked.String()
+}
+
+// eachQuoted calls fn with the bounds of the contents of every double
+// quoted string in s.
+func eachQuoted(s string, fn func(start, end int)) {
+	for i := 0; i < len(s); i++ {
+		if s[i] != '"' {
+			continue
+		}
+		j := i + 1
+		for ; j < len(s) && s[j] != '"'; j++ {
+			if s[j] == '\\' {
+				j++
+			}
+		}
+		if j < len(s) {
+			fn(i+1, j)
+		}
+		i = j
+	}
+}
+
+// eachWord calls fn with the bounds of every run of s between separators.
+func eachWord(s string, separator func(rune) bool, fn func(start, end int)) {
+	start := -1
+	for i, c := range s {
+		switch {
+		case !separator(c) && start < 0:
+			start = i
+		case separator(c) && start >= 0:
+			fn(start, i)
+			start = -1
+		}
+	}
+	if start >= 0 {
+		fn(start, len(s))
+	}
+}
+
+// Handler masks the message and attributes of every record before passing
+// it to the wrapped handler.
+type Handler struct {
+	next     slog.Handler
+	redactor *Redactor
+}
+
+// NewHandler wraps next with the default redactor.
+func NewHandler(next slog.Handler) *Handler {
+	return &Handler{next: next, redactor: std}
+}
+
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *Handler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, h.redactor.String(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(h.attr(attr))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		redacted[i] = h.attr(attr)
+	}
+	return &Handler{next: h.next.WithAttrs(redacted), redactor: h.redactor}
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	return &Handler{next: h.next.WithGroup(name), redactor: h.redactor}
+}
+
+func (h *Handler) attr(attr slog.Attr) slog.Attr {
+	value := attr.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, h.redactor.String(value.String()))
+	case slog.KindGroup:
+		group := value.Group()
+		redacted := make([]slog.Attr, len(group))
+		for i, member := range group {
+			redacted[i] = h.attr(member)
+		}
+		return slog.Attr{Key: attr.Key, Value: slog.GroupValue(redacted...)}
+	case slog.KindAny:
+		switch v := value.Any().(type) {
+		case error:
+			return slog.String(attr.Key, h.redactor.String(v.Error()))
+		case fmt.Stringer:
+			return slog.String(attr.Key, h.redactor.String(v.String()))
+		case []byte:
+			return slog.String(attr.Key, h.redactor.String(string(v)))
+		}
+	}
+	return slog.Attr{Key: attr.Key, Value: value}
+}
@@ -0,0 +1,98 @@
+package redact
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestString(t *testing.T) {
+	r := New()
+	r.Add("hunter2", "correct horse", `pa"ss`, "abc")
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"whole", "hunter2", Mask},
+		{"word", "password is hunter2 today", "password is " + Mask + " today"},
+		{"field", "value=hunter2, next", "value=" + Mask + ", next"},
+		{"json", `{"value":"hunter2"}`, `{"value":"` + Mask + `"}`},
+		{"quoted with space", `value="correct horse"`, `value="` + Mask + `"`},
+		{"json escaped", `{"value":"pa\"ss"}`, `{"value":"` + Mask + `"}`},
+		{"part of a word", "hunter2hunter2", "hunter2hunter2"},
+		{"too short", "abc", "abc"},
+		{"bearer", "Authorization: Bearer anything", "Authorization: " + Mask},
+		{"api key", "key bwsc_" + strings.Repeat("a", 43), "key " + Mask},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := r.String(test.in); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAddTokenForgetsOldest(t *testing.T) {
+	r := New()
+	r.Add("configured-token")
+	release := r.Hold("cached-secret")
+	for i := range maxTokens + 1 {
+		r.AddToken(fmt.Sprintf("token-%d", i))
+	}
+	tests := []struct {
+		value  string
+		masked bool
+	}{
+		{"token-0", false},
+		{fmt.Sprintf("token-%d", maxTokens), true},
+		{"configured-token", true},
+		{"cached-secret", true},
+	}
+	for _, test := range tests {
+		if got := r.String(test.value); (got == Mask) != test.masked {
+			t.Errorf("%s: got %q, want masked %t", test.value, got, test.masked)
+		}
+	}
+	if len(r.tokens) != maxTokens || len(r.values) != maxTokens+2 {
+		t.Errorf("holding %d tokens and %d values, want %d and %d", len(r.tokens), len(r.values), maxTokens, maxTokens+2)
+	}
+	release()
+	if got := r.String("cached-secret"); got != "cached-secret" {
+		t.Errorf("released value still masked: %q", got)
+	}
+}
+
+func TestHold(t *testing.T) {
+	r := New()
+	first := r.Hold("hunter2")
+	second := r.Hold("hunter2")
+	first()
+	first()
+	if got := r.String("hunter2"); got != Mask {
+		t.Errorf("value held twice and released once not masked: %q", got)
+	}
+	second()
+	if got := r.String("hunter2"); got != "hunter2" {
+		t.Errorf("released value still masked: %q", got)
+	}
+	r.Add("hunter2")
+	r.Hold("hunter2")()
+	if got := r.String("hunter2"); got != Mask {
+		t.Errorf("value added with Add not masked after a hold was released: %q", got)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var out bytes.Buffer
+	r := New()
+	r.Add("hunter2")
+	logger := slog.New(&Handler{next: slog.NewJSONHandler(&out, nil), redactor: r})
+	logger.With("token", "hunter2").Info("read hunter2", "value", "hunter2", slog.Group("secret", "value", "hunter2"), "err", fmt.Errorf("bad value hunter2"))
+	if strings.Contains(out.String(), "hunter2") {
+		t.Errorf("value logged: %s", out.String())
+	}
+}
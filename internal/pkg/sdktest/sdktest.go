@@ -0,0 +1,304 @@
+// Package sdktest fakes Bitwarden for tests, behind the SDK's client
+// interface.
+package sdktest
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	sdk "github.com/bitwarden/sdk-go"
+)
+
+// ErrUnauthorized is returned by a call made with a token the fake doesn't
+// accept.
+var ErrUnauthorized = errors.New("invalid access token")
+
+// Bitwarden holds the secrets and projects served by the clients it
+// creates.
+type Bitwarden struct {
+	mu       sync.Mutex
+	secrets  []sdk.SecretResponse
+	projects []sdk.ProjectResponse
+	// tokens accepted, every token is if empty.
+	tokens []string
+	// err fails every call other than login while set.
+	err   error
+	calls map[string]int
+}
+
+// New returns a fake accepting tokens, or any token if none are given.
+func New(tokens ...string) *Bitwarden {
+	return &Bitwarden{tokens: tokens, calls: make(map[string]int)}
+}
+
+// NewClient creates a client of the fake, with the signature of
+// sdk.NewBitwardenClient.
+func (b *Bitwarden) NewClient(apiURL *string, identityURL *string) (sdk.BitwardenClientInterface, error) {
+	return &fakeClient{bw: b}, nil
+}
+
+// AddProject adds a project and returns its ID.
+func (b *Bitwarden) AddProject(orgID string, name string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := fmt.Sprintf("project-%d", len(b.projects)+1)
+	b.projects = append(b.projects, sdk.ProjectResponse{ID: id, Name: name, OrganizationID: orgID})
+	return id
+}
+
+// AddSecret adds a secret and returns its ID. projectID may be empty.
+func (b *Bitwarden) AddSecret(orgID string, projectID string, key string, value string, note string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	secret := sdk.SecretResponse{
+		ID:             fmt.Sprintf("secret-%d", len(b.secrets)+1),
+		Key:            key,
+		Value:          value,
+		Note:           note,
+		OrganizationID: orgID,
+		RevisionDate:   revision(),
+	}
+	if projectID != "" {
+		secret.ProjectID = &projectID
+	}
+	b.secrets = append(b.secrets, secret)
+	return secret.ID
+}
+
+// SetValue changes the value of the secret with id, revising it.
+func (b *Bitwarden) SetValue(id string, value string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := range b.secrets {
+		if b.secrets[i].ID == id {
+			b.secrets[i].Value = value
+			b.secrets[i].RevisionDate = revision()
+		}
+	}
+}
+
+// SetKey renames the secret with id to key, revising it.
+func (b *Bitwarden) SetKey(id string, key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := range b.secrets {
+		if b.secrets[i].ID == id {
+			b.secrets[i].Key = key
+			b.secrets[i].RevisionDate = revision()
+		}
+	}
+}
+
+// Remove deletes the secret with id.
+func (b *Bitwarden) Remove(id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.secrets = slices.DeleteFunc(b.secrets, func(secret sdk.SecretResponse) bool { return secret.ID == id })
+}
+
+// Fail makes every call other than login fail with err, or succeed again
+// if err is nil.
+func (b *Bitwarden) Fail(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.err = err
+}
+
+// Calls returns the number of calls made to operation, named like
+// "secrets.get_by_ids".
+func (b *Bitwarden) Calls(operation string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.calls[operation]
+}
+
+func (b *Bitwarden) call(operation string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls[operation]++
+	return b.err
+}
+
+// revision returns a revision date unique to each change.
+func revision() string {
+	time.Sleep(time.Microsecond)
+	return time.Now().UTC().Format(time.RFC3339Nano)
+}
+
+type fakeClient struct {
+	bw    *Bitwarden
+	token string
+}
+
+func (c *fakeClient) AccessTokenLogin(accessToken string, statePath *string) error {
+	c.bw.mu.Lock()
+	defer c.bw.mu.Unlock()
+	c.bw.calls["login"]++
+	if len(c.bw.tokens) > 0 && !slices.Contains(c.bw.tokens, accessToken) {
+		return ErrUnauthorized
+	}
+	c.token = accessToken
+	return nil
+}
+
+func (c *fakeClient) Projects() sdk.ProjectsInterface {
+	return fakeProjects{c}
+}
+
+func (c *fakeClient) Secrets() sdk.SecretsInterface {
+	return fakeSecrets{c}
+}
+
+func (c *fakeClient) Close() {}
+
+func (c *fakeClient) call(operation string) error {
+	if c.token == "" {
+		return ErrUnauthorized
+	}
+	return c.bw.call(operation)
+}
+
+type fakeSecrets struct {
+	*fakeClient
+}
+
+func (s fakeSecrets) Create(key, value, note string, organizationID string, projectIDs []string) (*sdk.SecretResponse, error) {
+	if err := s.call("secrets.create"); err != nil {
+		return nil, err
+	}
+	projectID := ""
+	if len(projectIDs) > 0 {
+		projectID = projectIDs[0]
+	}
+	return s.Get(s.bw.AddSecret(organizationID, projectID, key, value, note))
+}
+
+func (s fakeSecrets) List(organizationID string) (*sdk.SecretIdentifiersResponse, error) {
+	if err := s.call("secrets.list"); err != nil {
+		return nil, err
+	}
+	s.bw.mu.Lock()
+	defer s.bw.mu.Unlock()
+	res := &sdk.SecretIdentifiersResponse{Data: []sdk.SecretIdentifierResponse{}}
+	for _, secret := range s.bw.secrets {
+		if secret.OrganizationID == organizationID {
+			res.Data = append(res.Data, sdk.SecretIdentifierResponse{ID: secret.ID, Key: secret.Key, OrganizationID: organizationID})
+		}
+	}
+	return res, nil
+}
+
+func (s fakeSecrets) Get(secretID string) (*sdk.SecretResponse, error) {
+	if err := s.call("secrets.get"); err != nil {
+		return nil, err
+	}
+	s.bw.mu.Lock()
+	defer s.bw.mu.Unlock()
+	for _, secret := range s.bw.secrets {
+		if secret.ID == secretID {
+			return &secret, nil
+		}
+	}
+	return nil, fmt.Errorf("secret not found: %s", secretID)
+}
+
+func (s fakeSecrets) GetByIDS(secretIDs []string) (*sdk.SecretsResponse, error) {
+	if err := s.call("secrets.get_by_ids"); err != nil {
+		return nil, err
+	}
+	s.bw.mu.Lock()
+	defer s.bw.mu.Unlock()
+	res := &sdk.SecretsResponse{Data: []sdk.SecretResponse{}}
+	for _, secret := range s.bw.secrets {
+		if slices.Contains(secretIDs, secret.ID) {
+			res.Data = append(res.Data, secret)
+		}
+	}
+	return res, nil
+}
+
+func (s fakeSecrets) Update(secretID string, key, value, note string, organizationID string, projectIDs []string) (*sdk.SecretResponse, error) {
+	if err := s.call("secrets.update"); err != nil {
+		return nil, err
+	}
+	s.bw.SetValue(secretID, value)
+	return s.Get(secretID)
+}
+
+func (s fakeSecrets) Delete(secretIDs []string) (*sdk.SecretsDeleteResponse, error) {
+	if err := s.call("secrets.delete"); err != nil {
+		return nil, err
+	}
+	res := &sdk.SecretsDeleteResponse{}
+	for _, id := range secretIDs {
+		s.bw.Remove(id)
+		res.Data = append(res.Data, sdk.SecretDeleteResponse{ID: id})
+	}
+	return res, nil
+}
+
+func (s fakeSecrets) Sync(organizationID string, lastSyncedDate *time.Time) (*sdk.SecretsSyncResponse, error) {
+	if err := s.call("secrets.sync"); err != nil {
+		return nil, err
+	}
+	s.bw.mu.Lock()
+	defer s.bw.mu.Unlock()
+	res := &sdk.SecretsSyncResponse{HasChanges: true}
+	for _, secret := range s.bw.secrets {
+		if secret.OrganizationID == organizationID {
+			res.Secrets = append(res.Secrets, secret)
+		}
+	}
+	return res, nil
+}
+
+type fakeProjects struct {
+	*fakeClient
+}
+
+func (p fakeProjects) Create(organizationID string, name string) (*sdk.ProjectResponse, error) {
+	if err := p.call("projects.create"); err != nil {
+		return nil, err
+	}
+	return p.Get(p.bw.AddProject(organizationID, name))
+}
+
+func (p fakeProjects) List(organizationID string) (*sdk.ProjectsResponse, error) {
+	if err := p.call("projects.list"); err != nil {
+		return nil, err
+	}
+	p.bw.mu.Lock()
+	defer p.bw.mu.Unlock()
+	res := &sdk.ProjectsResponse{Data: []sdk.ProjectResponse{}}
+	for _, project := range p.bw.projects {
+		if project.OrganizationID == organizationID {
+			res.Data = append(res.Data, project)
+		}
+	}
+	return res, nil
+}
+
+func (p fakeProjects) Get(projectID string) (*sdk.ProjectResponse, error) {
+	if err := p.call("projects.get"); err != nil {
+		return nil, err
+	}
+	p.bw.mu.Lock()
+	defer p.bw.mu.Unlock()
+	for _, project := range p.bw.projects {
+		if project.ID == projectID {
+			return &project, nil
+		}
+	}
+	return nil, fmt.Errorf("project not found: %s", projectID)
+}
+
+func (p fakeProjects) Update(projectID string, organizationID string, name string) (*sdk.ProjectResponse, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (p fakeProjects) Delete(projectIDs []string) (*sdk.ProjectsDeleteResponse, error) {
+	return nil, errors.New("not implemented")
+}
@@ -0,0 +1,141 @@
+// Package secmem keeps secret material out of swap and core dumps. Buffers
+// are carved from memory locked with mlock and are zeroed when freed.
+package secmem
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// chunkSize is how much memory is mapped and locked at a time.
+const chunkSize = 256 << 10
+
+// classes are the block sizes buffers are rounded up to. Larger buffers get
+// a chunk of their own.
+var classes = []int{64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536}
+
+type Arena struct {
+	mu     sync.Mutex
+	free   [][][]byte
+	warned bool
+}
+
+// Buffer is a block of arena memory holding a copy of some secret.
+type Buffer struct {
+	mu    sync.Mutex
+	block []byte
+	n     int
+	class int
+	arena *Arena
+	// mapped is set when block is a chunk of its own that was mapped, and
+	// so has to be unmapped.
+	mapped bool
+	freed  bool
+}
+
+var std = NewArena()
+
+// mapMemory is mapLocked, replaced in tests.
+var mapMemory = mapLocked
+
+func NewArena() *Arena {
+	return &Arena{free: make([][][]byte, len(classes))}
+}
+
+// Alloc copies data into the default arena.
+func Alloc(data []byte) *Buffer {
+	return std.Alloc(data)
+}
+
+func (a *Arena) Alloc(data []byte) *Buffer {
+	class := len(classes)
+	for i, size := range classes {
+		if len(data) <= size {
+			class = i
+			break
+		}
+	}
+
+	a.mu.Lock()
+	var block []byte
+	mapped := false
+	if class == len(classes) {
+		block, mapped = a.chunk(len(data))
+	} else {
+		if len(a.free[class]) == 0 {
+			size := classes[class]
+			chunk, _ := a.chunk(chunkSize)
+			for offset := 0; offset+size <= len(chunk); offset += size {
+				a.free[class] = append(a.free[class], chunk[offset:offset+size:offset+size])
+			}
+		}
+		last := len(a.free[class]) - 1
+		block = a.free[class][last]
+		a.free[class] = a.free[class][:last]
+	}
+	a.mu.Unlock()
+
+	copy(block, data)
+	return &Buffer{block: block, n: len(data), class: class, arena: a, mapped: mapped}
+}
+
+// chunk maps and locks at least size bytes, falling back to unlocked memory
+// if locking isn't permitted, reporting whether the memory was mapped. Must
+// be called with a.mu held.
+func (a *Arena) chunk(size int) ([]byte, bool) {
+	mem, err := mapMemory(size)
+	if err != nil && !a.warned {
+		a.warned = true
+		slog.Warn(fmt.Sprintf("Unable to lock memory for secrets, they may be written to swap: %v", err))
+	}
+	if mem == nil {
+		return make([]byte, size), false
+	}
+	return mem, true
+}
+
+// Use calls fn with the contents of the buffer unless it has been freed,
+// reporting whether it did. fn must not keep the slice.
+func (b *Buffer) Use(fn func(data []byte)) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.freed {
+		return false
+	}
+	fn(b.block[:b.n])
+	return true
+}
+
+// Size returns the bytes of memory the buffer takes up.
+func (b *Buffer) Size() int {
+	return len(b.block)
+}
+
+// Free zeroes the buffer and returns it to its arena. Freeing a buffer
+// more than once does nothing.
+func (b *Buffer) Free() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.freed {
+		return
+	}
+	b.freed = true
+	Zero(b.block)
+
+	a := b.arena
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if b.class == len(classes) {
+		if b.mapped {
+			unmap(b.block)
+		}
+		return
+	}
+	a.free[b.class] = append(a.free[b.class], b.block)
+}
+
+// Zero overwrites data with zeros.
+func Zero(data []byte) {
+	clear(data)
+}
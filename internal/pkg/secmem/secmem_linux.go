@@ -0,0 +1,42 @@
+package secmem
+
+import (
+	"os"
+	"syscall"
+)
+
+// madvDontDump excludes a mapping from core dumps.
+const madvDontDump = 0x10
+
+// mapLocked returns size bytes, rounded up to whole pages, of anonymous
+// memory excluded from core dumps. The memory is returned along with the
+// error if only locking it failed.
+func mapLocked(size int) ([]byte, error) {
+	page := os.Getpagesize()
+	size = (size + page - 1) / page * page
+	mem, err := syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return nil, err
+	}
+	syscall.Madvise(mem, madvDontDump)
+	if err := syscall.Mlock(mem); err != nil {
+		return mem, err
+	}
+	return mem, nil
+}
+
+func unmap(mem []byte) {
+	syscall.Munmap(mem[:cap(mem)])
+}
+
+// DisableCoreDumps stops the process from writing core dumps, and from
+// being attached to or read through /proc by other unprivileged processes.
+func DisableCoreDumps() error {
+	if err := syscall.Setrlimit(syscall.RLIMIT_CORE, &syscall.Rlimit{}); err != nil {
+		return err
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_DUMPABLE, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
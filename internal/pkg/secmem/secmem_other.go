@@ -0,0 +1,15 @@
+//go:build !linux
+
+package secmem
+
+import "errors"
+
+func mapLocked(size int) ([]byte, error) {
+	return nil, errors.New("memory locking is only supported on linux")
+}
+
+func unmap(mem []byte) {}
+
+func DisableCoreDumps() error {
+	return errors.New("disabling core dumps is only supported on linux")
+}
@@ -0,0 +1,91 @@
+package secmem
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestAllocSizeClasses(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int
+		class int
+	}{
+		{"empty", 0, 0},
+		{"smallest class", 64, 0},
+		{"next class", 65, 1},
+		{"largest class", 65536, len(classes) - 1},
+		{"own chunk", 65537, len(classes)},
+	}
+	a := NewArena()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := bytes.Repeat([]byte{'x'}, test.size)
+			b := a.Alloc(data)
+			defer b.Free()
+			if b.class != test.class {
+				t.Errorf("got class %d, want %d", b.class, test.class)
+			}
+			if test.class < len(classes) && b.Size() != classes[test.class] {
+				t.Errorf("got %d bytes, want %d", b.Size(), classes[test.class])
+			}
+			if b.Size() < test.size {
+				t.Errorf("got %d bytes, want at least %d", b.Size(), test.size)
+			}
+			if !b.Use(func(got []byte) {
+				if !bytes.Equal(got, data) {
+					t.Error("contents don't match the data copied in")
+				}
+			}) {
+				t.Error("unable to use a buffer that wasn't freed")
+			}
+		})
+	}
+}
+
+func TestFree(t *testing.T) {
+	a := NewArena()
+	b := a.Alloc([]byte("hunter2"))
+	block := b.block
+	free := len(a.free[b.class])
+	b.Free()
+	b.Free()
+
+	if !bytes.Equal(block, make([]byte, len(block))) {
+		t.Error("freed buffer not zeroed")
+	}
+	if b.Use(func([]byte) { t.Error("used a freed buffer") }) {
+		t.Error("Use reported using a freed buffer")
+	}
+	if got := len(a.free[b.class]); got != free+1 {
+		t.Errorf("got %d free blocks after freeing twice, want %d", got, free+1)
+	}
+	if reused := a.Alloc([]byte("other")); &reused.block[0] != &block[0] {
+		t.Error("freed block not reused")
+	}
+}
+
+func TestAllocWithoutLockedMemory(t *testing.T) {
+	mapMemory = func(size int) ([]byte, error) { return nil, errors.New("not permitted") }
+	t.Cleanup(func() { mapMemory = mapLocked })
+	a := NewArena()
+	for _, size := range []int{7, 65537} {
+		b := a.Alloc(bytes.Repeat([]byte{'x'}, size))
+		if b.mapped {
+			t.Errorf("%d bytes: buffer marked as mapped", size)
+		}
+		if !b.Use(func(got []byte) {
+			if len(got) != size {
+				t.Errorf("got %d bytes, want %d", len(got), size)
+			}
+		}) {
+			t.Errorf("%d bytes: unable to use buffer", size)
+		}
+		// Memory that wasn't mapped must not be unmapped.
+		b.Free()
+	}
+	if !a.warned {
+		t.Error("failing to lock memory wasn't logged")
+	}
+}
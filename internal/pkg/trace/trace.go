@@ -0,0 +1,243 @@
+// Package trace records OpenTelemetry spans with the OpenTelemetry SDK.
+package trace
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"bws-cache/internal/pkg/redact"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// Kind is the span kind.
+type Kind = oteltrace.SpanKind
+
+const (
+	Internal = oteltrace.SpanKindInternal
+	Server   = oteltrace.SpanKindServer
+	Client   = oteltrace.SpanKindClient
+)
+
+// Span is a timed operation. A nil *Span, as returned when tracing is
+// disabled, ignores every call.
+type Span struct {
+	span oteltrace.Span
+}
+
+// Config has the fields of config.Tracing, which it is converted from.
+type Config struct {
+	Exporter    string
+	Endpoint    string
+	File        string
+	Headers     map[string]string
+	SampleRatio float64
+}
+
+// Tracer starts spans and hands them to an exporter once they end.
+type Tracer struct {
+	provider *sdktrace.TracerProvider
+	tracer   oteltrace.Tracer
+	close    func() error
+}
+
+var defaultTracer atomic.Pointer[Tracer]
+
+var propagator = propagation.TraceContext{}
+
+// New returns a tracer for config that reports spans from version of
+// bws-cache, or nil if tracing is disabled.
+func New(config Config, version string) (*Tracer, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	closeFile := func() error { return nil }
+	switch config.Exporter {
+	case "":
+		return nil, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "file":
+		var f *os.File
+		f, err = os.OpenFile(config.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open trace file: %w", err)
+		}
+		closeFile = f.Close
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(io.Writer(f)))
+	case "otlp":
+		exporter, err = otlptracehttp.New(context.Background(),
+			otlptracehttp.WithEndpointURL(strings.TrimSuffix(config.Endpoint, "/")+"/v1/traces"),
+			otlptracehttp.WithHeaders(config.Headers))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter: %s", config.Exporter)
+	}
+	if err != nil {
+		closeFile()
+		return nil, fmt.Errorf("unable to create trace exporter: %w", err)
+	}
+	tracer := newTracer(sdktrace.NewBatchSpanProcessor(exporter), config.SampleRatio, version)
+	tracer.close = closeFile
+	return tracer, nil
+}
+
+func newTracer(processor sdktrace.SpanProcessor, ratio float64, version string) *Tracer {
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithSampler(newSampler(ratio)),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "bws-cache"),
+			attribute.String("service.version", version),
+		)),
+	)
+	return &Tracer{
+		provider: provider,
+		tracer:   provider.Tracer("bws-cache", oteltrace.WithInstrumentationVersion(version)),
+		close:    func() error { return nil },
+	}
+}
+
+// SetDefault makes t the tracer used by Start, nil disables tracing.
+func SetDefault(t *Tracer) {
+	defaultTracer.Store(t)
+}
+
+// Shutdown exports the spans that have ended and stops the exporter.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	err := t.provider.Shutdown(ctx)
+	if closeErr := t.close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// untrustedKey marks a context whose remote parent was received from a
+// client that isn't a trusted proxy, see sampler.
+type untrustedKey struct{}
+
+// sampler keeps ratio of new traces, decided by the trace ID so every
+// instance agrees, and follows the sampled flag of the parent. The flag of
+// an untrusted remote parent is ignored, so clients can't make every
+// request of theirs recorded.
+type sampler struct {
+	ratio       sdktrace.Sampler
+	parentBased sdktrace.Sampler
+}
+
+func newSampler(ratio float64) sdktrace.Sampler {
+	ratioBased := sdktrace.TraceIDRatioBased(ratio)
+	return sampler{ratio: ratioBased, parentBased: sdktrace.ParentBased(ratioBased)}
+}
+
+func (s sampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	parent := oteltrace.SpanContextFromContext(p.ParentContext)
+	if untrusted, _ := p.ParentContext.Value(untrustedKey{}).(bool); untrusted && parent.IsRemote() {
+		result := s.ratio.ShouldSample(p)
+		result.Tracestate = parent.TraceState()
+		return result
+	}
+	return s.parentBased.ShouldSample(p)
+}
+
+func (s sampler) Description() string {
+	return "TrustedParentBased{" + s.ratio.Description() + "}"
+}
+
+// Start starts a span named name, a child of the span in ctx if there is
+// one.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	return StartKind(ctx, name, Internal)
+}
+
+// StartKind is Start for a span of kind.
+func StartKind(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	tracer := defaultTracer.Load()
+	if tracer == nil {
+		return ctx, nil
+	}
+	ctx, span := tracer.tracer.Start(ctx, name, oteltrace.WithSpanKind(kind))
+	return ctx, &Span{span: span}
+}
+
+// StartRemote starts a server span continuing the trace in the W3C
+// traceparent header of a request, or a new trace if there is none. The
+// sampled flag of the header is only followed if trusted, otherwise the
+// trace is sampled like a new one.
+func StartRemote(ctx context.Context, name string, header http.Header, trusted bool) (context.Context, *Span) {
+	if defaultTracer.Load() == nil {
+		return ctx, nil
+	}
+	ctx = propagator.Extract(ctx, propagation.HeaderCarrier(header))
+	if !trusted {
+		ctx = context.WithValue(ctx, untrustedKey{}, true)
+	}
+	return StartKind(ctx, name, Server)
+}
+
+// SetAttribute records a string, bool, integer or float attribute.
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil || !s.span.IsRecording() {
+		return
+	}
+	var attr attribute.KeyValue
+	switch value := value.(type) {
+	case bool:
+		attr = attribute.Bool(key, value)
+	case int:
+		attr = attribute.Int(key, value)
+	case int64:
+		attr = attribute.Int64(key, value)
+	case float64:
+		attr = attribute.Float64(key, value)
+	default:
+		attr = attribute.String(key, fmt.Sprint(value))
+	}
+	s.span.SetAttributes(attr)
+}
+
+// SetError marks the span as failed if err isn't nil. The message is
+// redacted.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.span.SetStatus(codes.Error, redact.String(err.Error()))
+}
+
+// SetName renames the span, e.g. once the route of a request is known.
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.span.SetName(name)
+}
+
+// Finish ends the span, exporting it if it is sampled.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.span.End()
+}
+
+// SpanContext returns the IDs and sampled flag of the span.
+func (s *Span) SpanContext() oteltrace.SpanContext {
+	if s == nil {
+		return oteltrace.SpanContext{}
+	}
+	return s.span.SpanContext()
+}
@@ -0,0 +1,140 @@
+package trace
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"bws-cache/internal/pkg/redact"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const (
+	remoteTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	remoteSpanID  = "00f067aa0ba902b7"
+)
+
+func useTracer(t *testing.T, ratio float64) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	tracer := newTracer(recorder, ratio, "test")
+	SetDefault(tracer)
+	t.Cleanup(func() {
+		SetDefault(nil)
+		tracer.Shutdown(context.Background())
+	})
+	return recorder
+}
+
+func TestStartRemote(t *testing.T) {
+	tests := []struct {
+		name        string
+		ratio       float64
+		traceparent string
+		trusted     bool
+		sampled     bool
+		continued   bool
+	}{
+		{"new trace", 1, "", false, true, false},
+		{"new trace not sampled", 0, "", false, false, false},
+		{"trusted sampled", 0, "00-" + remoteTraceID + "-" + remoteSpanID + "-01", true, true, true},
+		{"trusted not sampled", 1, "00-" + remoteTraceID + "-" + remoteSpanID + "-00", true, false, true},
+		{"untrusted sampled", 0, "00-" + remoteTraceID + "-" + remoteSpanID + "-01", false, false, true},
+		{"untrusted not sampled", 1, "00-" + remoteTraceID + "-" + remoteSpanID + "-00", false, true, true},
+		{"invalid", 1, "00-xyz-" + remoteSpanID + "-01", true, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := useTracer(t, test.ratio)
+			header := http.Header{}
+			if test.traceparent != "" {
+				header.Set("traceparent", test.traceparent)
+			}
+			ctx, span := StartRemote(context.Background(), "GET", header, test.trusted)
+			_, child := Start(ctx, "child")
+			child.Finish()
+			span.Finish()
+
+			sc := span.SpanContext()
+			if sc.IsSampled() != test.sampled {
+				t.Errorf("got sampled %t, want %t", sc.IsSampled(), test.sampled)
+			}
+			if continued := sc.TraceID().String() == remoteTraceID; continued != test.continued {
+				t.Errorf("got trace %s, want continued %t", sc.TraceID(), test.continued)
+			}
+			if child.SpanContext().IsSampled() != test.sampled || child.SpanContext().TraceID() != sc.TraceID() {
+				t.Error("child span doesn't follow its parent")
+			}
+			want := 0
+			if test.sampled {
+				want = 2
+			}
+			if ended := len(recorder.Ended()); ended != want {
+				t.Errorf("exported %d spans, want %d", ended, want)
+			}
+		})
+	}
+}
+
+func TestSpan(t *testing.T) {
+	recorder := useTracer(t, 1)
+	redact.Add("hunter2-value")
+	_, span := StartKind(context.Background(), "sdk.login", Client)
+	span.SetAttribute("cache.hit", true)
+	span.SetAttribute("keymap.keys", 3)
+	span.SetName("sdk.secrets_get")
+	span.SetError(errors.New("bad value hunter2-value"))
+	span.Finish()
+	span.Finish()
+
+	ended := recorder.Ended()
+	if len(ended) != 1 {
+		t.Fatalf("exported %d spans, want 1", len(ended))
+	}
+	got := ended[0]
+	if got.Name() != "sdk.secrets_get" || got.SpanKind() != Client || len(got.Attributes()) != 2 {
+		t.Errorf("got %s %s with %v", got.SpanKind(), got.Name(), got.Attributes())
+	}
+	if got.Status().Code != codes.Error || got.Status().Description != "bad value "+redact.Mask {
+		t.Errorf("got status %+v", got.Status())
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	SetDefault(nil)
+	ctx, span := StartRemote(context.Background(), "GET", http.Header{}, true)
+	if span != nil || ctx != context.Background() {
+		t.Fatal("started a span with tracing disabled")
+	}
+	span.SetAttribute("key", "value")
+	span.SetError(errors.New("failed"))
+	span.SetName("name")
+	span.Finish()
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		exporter string
+		valid    bool
+	}{
+		{"", true},
+		{"stdout", true},
+		{"file", true},
+		{"otlp", true},
+		{"zipkin", false},
+	}
+	for _, test := range tests {
+		t.Run(test.exporter, func(t *testing.T) {
+			tracer, err := New(Config{Exporter: test.exporter, Endpoint: "http://localhost:4318", File: t.TempDir() + "/traces.jsonl", SampleRatio: 1}, "test")
+			if (err == nil) != test.valid {
+				t.Fatalf("got error %v, want valid %t", err, test.valid)
+			}
+			if err := tracer.Shutdown(context.Background()); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
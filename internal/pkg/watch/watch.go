@@ -0,0 +1,56 @@
+package watch
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// File calls onChange when file is written, created or replaced. The
+// directory is watched rather than the file so that editors replacing the
+// file are picked up, as are symlinks in the directory being swapped to
+// point file elsewhere, like Kubernetes does with ..data when it updates a
+// mounted secret or config map. Close the returned watcher to stop
+// watching.
+func File(file string, onChange func()) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	file = filepath.Clean(file)
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	resolved, _ := filepath.EvalSymlinks(file)
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				// A file that is missing mid-replace resolves to "".
+				target, _ := filepath.EvalSymlinks(file)
+				swapped := target != "" && target != resolved
+				if swapped {
+					resolved = target
+				}
+				if !swapped && (filepath.Clean(event.Name) != file || event.Op&(fsnotify.Write|fsnotify.Create) == 0) {
+					continue
+				}
+				slog.Debug(fmt.Sprintf("File event: %s", event))
+				onChange()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Error(fmt.Sprintf("File watcher: %v", err))
+			}
+		}
+	}()
+	return watcher, nil
+}
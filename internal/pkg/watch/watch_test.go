@@ -0,0 +1,86 @@
+package watch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.yml")
+	if err := os.WriteFile(file, []byte("a"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	changed := make(chan struct{}, 10)
+	watcher, err := File(file, func() { changed <- struct{}{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	if err := os.WriteFile(filepath.Join(dir, "other.yml"), []byte("b"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	expectNone(t, changed)
+	if err := os.WriteFile(file, []byte("b"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, changed)
+}
+
+// TestFileSymlinkSwap updates a file the way Kubernetes updates a mounted
+// secret: file is a symlink into ..data, itself a symlink that is swapped
+// to a new directory.
+func TestFileSymlinkSwap(t *testing.T) {
+	dir := t.TempDir()
+	for _, version := range []string{"..v1", "..v2"} {
+		if err := os.Mkdir(filepath.Join(dir, version), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, version, "tls.crt"), []byte(version), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("..v1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "tls.crt")
+	if err := os.Symlink(filepath.Join("..data", "tls.crt"), file); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := make(chan struct{}, 10)
+	watcher, err := File(file, func() { changed <- struct{}{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	if err := os.Symlink("..v2", filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, changed)
+}
+
+func expect(t *testing.T, changed chan struct{}) {
+	t.Helper()
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("change not seen")
+	}
+}
+
+func expectNone(t *testing.T, changed chan struct{}) {
+	t.Helper()
+	select {
+	case <-changed:
+		t.Fatal("unexpected change")
+	case <-time.After(100 * time.Millisecond):
+	}
+}